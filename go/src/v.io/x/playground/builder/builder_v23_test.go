@@ -94,17 +94,27 @@ func TestV23PlaygroundBuilder(t *testing.T) {
 		}
 	}
 
+	// Patterns matching the "ready" events of both files, and the "exit"
+	// event of ping with an exit code matching code.
+	lifecycle := func(code string) []string {
+		return []string{
+			`"File":"src/pong/pong.go","Message":"Ready.","Stream":"ready"`,
+			`"File":"src/ping/ping.go","Message":"Ready.","Stream":"ready"`,
+			`"File":"src/ping/ping.go","Message":"Exited[^"]*","Stream":"exit","Timestamp":[0-9]+,"Exit":\{"Code":` + code + `,"Signal":0,"WallTime":[0-9]+`,
+		}
+	}
+
 	t.Logf("Test as the same principal")
-	runCases("", []string{"PING", "PONG"})
+	runCases("", append([]string{"PING", "PONG"}, lifecycle("0")...))
 
 	t.Logf("Test with authorized blessings")
-	runCases("src/ids/authorized.id", []string{"PING", "PONG"})
+	runCases("src/ids/authorized.id", append([]string{"PING", "PONG"}, lifecycle("0")...))
 
 	t.Logf("Test with expired blessings")
-	runCases("src/ids/expired.id", []string{"not authorized"})
+	runCases("src/ids/expired.id", append([]string{"not authorized"}, lifecycle("[1-9][0-9]*")...))
 
 	t.Logf("Test with unauthorized blessings")
-	runCases("src/ids/unauthorized.id", []string{"not authorized"})
+	runCases("src/ids/unauthorized.id", append([]string{"not authorized"}, lifecycle("[1-9][0-9]*")...))
 }
 
 // Tests that default playground examples specified in `config.json` execute
@@ -0,0 +1,113 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Parsing of Go compiler and vdl tool output into structured diagnostics.
+// Raw compiler output is still streamed to clients as "<compile>" events;
+// diagnostics are sent in addition, as "diagnostic" stream events.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"v.io/x/playground/lib/event"
+)
+
+// Matches lines of the form "file.go:12:3: message" (Go compiler) and
+// "file.vdl:12:3 message" (vdl). The column is optional.
+var diagnosticRegexp = regexp.MustCompile(`^\s*(\S+\.(?:go|vdl)):(\d+)(?::(\d+))?:?\s+(.*)$`)
+
+// diagnosticCollector is an io.Writer that saves all written output, so that
+// it can be parsed into diagnostics once the compiler exits.
+type diagnosticCollector struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *diagnosticCollector) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.Write(p)
+}
+
+// diagnostics parses the collected output. srcDir is the directory the
+// compiler was run in; it is used to resolve relative paths. Only diagnostics
+// for files in the bundle are returned, with File set to the bundle-relative
+// file name.
+func (c *diagnosticCollector) diagnostics(srcDir string, files []*codeFile) []event.Diagnostic {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return parseDiagnostics(c.buf.String(), srcDir, files)
+}
+
+func parseDiagnostics(output, srcDir string, files []*codeFile) []event.Diagnostic {
+	// Bundle file names are relative to the parent of srcDir.
+	bundleRoot := filepath.Dir(srcDir)
+	known := make(map[string]bool)
+	for _, f := range files {
+		known[path.Clean(f.Name)] = true
+	}
+
+	var diags []event.Diagnostic
+	seen := make(map[event.Diagnostic]bool)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		m := diagnosticRegexp.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		name, ok := bundleFileName(m[1], srcDir, bundleRoot)
+		if !ok || !known[name] {
+			continue
+		}
+		line, err := strconv.Atoi(m[2])
+		if err != nil {
+			continue
+		}
+		col := 0
+		if m[3] != "" {
+			if col, err = strconv.Atoi(m[3]); err != nil {
+				continue
+			}
+		}
+		d := event.Diagnostic{
+			File:     name,
+			Line:     line,
+			Column:   col,
+			Severity: "error",
+			Message:  strings.TrimSpace(m[4]),
+		}
+		if msg := strings.TrimPrefix(d.Message, "warning:"); msg != d.Message {
+			d.Severity = "warning"
+			d.Message = strings.TrimSpace(msg)
+		}
+		// The go tool may repeat errors for packages that are built more than
+		// once (e.g. for vdl generation and install).
+		if !seen[d] {
+			seen[d] = true
+			diags = append(diags, d)
+		}
+	}
+	return diags
+}
+
+// bundleFileName converts a path printed by the compiler into a bundle file
+// name. Returns false if the path is outside the bundle.
+func bundleFileName(p, srcDir, bundleRoot string) (string, bool) {
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(srcDir, p)
+	}
+	rel, err := filepath.Rel(bundleRoot, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
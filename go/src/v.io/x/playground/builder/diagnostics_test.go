@@ -0,0 +1,40 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"v.io/x/playground/lib/event"
+)
+
+func TestParseDiagnostics(t *testing.T) {
+	files := []*codeFile{
+		{Name: "src/server/server.go"},
+		{Name: "src/client/client.go"},
+		{Name: "src/fortune/fortune.vdl"},
+	}
+	output := `# server
+./server/server.go:12:3: undefined: foo
+server/server.go:20:1: warning: unused variable
+/work/src/client/client.go:7: missing return
+/work/src/client/client.go:7: missing return
+/work/src/fortune/fortune.vdl:3:5 syntax error
+/work/src/fortune/fortune.vdl.go:10:2: generated file error
+/usr/lib/go/src/fmt/print.go:1:1: outside bundle
+Compilation failed.
+`
+	got := parseDiagnostics(output, "/work/src", files)
+	want := []event.Diagnostic{
+		{File: "src/server/server.go", Line: 12, Column: 3, Severity: "error", Message: "undefined: foo"},
+		{File: "src/server/server.go", Line: 20, Column: 1, Severity: "warning", Message: "unused variable"},
+		{File: "src/client/client.go", Line: 7, Column: 0, Severity: "error", Message: "missing return"},
+		{File: "src/fortune/fortune.vdl", Line: 3, Column: 5, Severity: "error", Message: "syntax error"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected diagnostics %#v but got %#v", want, got)
+	}
+}
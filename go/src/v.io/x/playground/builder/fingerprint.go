@@ -0,0 +1,75 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Fingerprint of the builder and toolchain. compilerd includes it in response
+// cache keys, so that responses are not reused across toolchain upgrades.
+//
+// Computing the fingerprint runs "go version" and "git" and hashes the builder
+// binary, which is too slow to do for every request. Instead, compilerd probes
+// builder once at startup with a request with Probe set, and builder reports
+// its fingerprint only in response to such requests, which compilerd does not
+// accept from clients. The Vanadium revision can be passed by flag, e.g. when
+// building the Docker image, to avoid needing the git repository at run time.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"v.io/x/playground/lib/event"
+)
+
+var vanadiumRevision = flag.String("vanadiumRevision", "", "Vanadium revision to report in the builder fingerprint. If empty, it is read from the v.io/x/ref git repository under JIRI_ROOT.")
+
+const unknownFingerprintPart = "unknown"
+
+// reportFingerprint writes the builder fingerprint as a "fingerprint" event,
+// which is sent regardless of --verbose.
+func reportFingerprint() {
+	panicOnError(out.Write(event.NewFingerprint(computeFingerprint())))
+}
+
+func computeFingerprint() event.Fingerprint {
+	f := event.Fingerprint{
+		GoVersion:        unknownFingerprintPart,
+		VanadiumRevision: *vanadiumRevision,
+		BuilderID:        unknownFingerprintPart,
+	}
+	if out, err := exec.Command("go", "version").Output(); err == nil {
+		f.GoVersion = strings.TrimSpace(string(out))
+	}
+	if f.VanadiumRevision == "" {
+		f.VanadiumRevision = unknownFingerprintPart
+		cmd := exec.Command("git", "rev-parse", "HEAD")
+		cmd.Dir = filepath.Join(os.Getenv("JIRI_ROOT"), "release", "go", "src", "v.io", "x", "ref")
+		if out, err := cmd.Output(); err == nil {
+			f.VanadiumRevision = strings.TrimSpace(string(out))
+		}
+	}
+	if id, err := builderID(); err == nil {
+		f.BuilderID = id
+	}
+	return f
+}
+
+// builderID returns the hash of the running builder binary.
+func builderID() (string, error) {
+	bin, err := os.Open("/proc/self/exe")
+	if err != nil {
+		return "", err
+	}
+	defer bin.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, bin); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
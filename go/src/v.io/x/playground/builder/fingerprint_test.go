@@ -0,0 +1,37 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"v.io/x/playground/lib/event"
+)
+
+func TestReportFingerprint(t *testing.T) {
+	defer func(old string) { *vanadiumRevision = old }(*vanadiumRevision)
+	*vanadiumRevision = "abc123"
+
+	// The fingerprint is reported even when debug events are filtered out.
+	var outBuf bytes.Buffer
+	out = event.NewJsonSink(&outBuf, true)
+	reportFingerprint()
+
+	var ev event.Event
+	if err := json.NewDecoder(&outBuf).Decode(&ev); err != nil {
+		t.Fatalf("Expected a fingerprint event, got %v", err)
+	}
+	if ev.Stream != "fingerprint" || ev.Fingerprint == nil {
+		t.Fatalf("Expected a fingerprint event, got %#v", ev)
+	}
+	if got, want := ev.Fingerprint.VanadiumRevision, "abc123"; got != want {
+		t.Errorf("Expected Vanadium revision %q, got %q", want, got)
+	}
+	if ev.Fingerprint.BuilderID == unknownFingerprintPart {
+		t.Errorf("Expected builder ID to be computed, got %#v", ev.Fingerprint)
+	}
+}
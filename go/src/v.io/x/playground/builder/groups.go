@@ -0,0 +1,83 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Process groups of the commands started by builder.
+//
+// Builder runs every command it starts (compilers, services and user programs)
+// in its own process group, so that it can be killed together with any
+// processes it spawns. Since these groups are not in builder's own process
+// group, they would outlive builder if it were killed. When compilerd cancels
+// a job, it sends SIGTERM to builder, which kills all the groups it started
+// before exiting. compilerd kills builder's process group if it does not exit
+// promptly.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var errTerminating = errors.New("Builder is terminating")
+
+var (
+	groupsMu sync.Mutex
+	// Pids of the leaders of the process groups started by startInGroup.
+	groups []int
+	// Set once the groups have been killed. No more commands are started.
+	terminating bool
+)
+
+// startInGroup starts cmd in its own process group, which is killed if
+// builder is terminated. Returns errTerminating if builder is terminating.
+func startInGroup(cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	if terminating {
+		return errTerminating
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	groups = append(groups, cmd.Process.Pid)
+	return nil
+}
+
+// killGroup sends sig to all processes in the process group led by pid.
+// Returns true iff the group still existed.
+func killGroup(pid int, sig syscall.Signal) bool {
+	return syscall.Kill(-pid, sig) == nil
+}
+
+// killAllGroups kills all process groups started by startInGroup, and keeps
+// any more from being started.
+func killAllGroups() {
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	terminating = true
+	for _, pid := range groups {
+		killGroup(pid, syscall.SIGKILL)
+	}
+}
+
+// handleTermination makes builder kill all process groups it started and exit
+// when it receives SIGTERM or SIGINT.
+func handleTermination() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigs
+		debug("Received", sig, "killing all processes")
+		killAllGroups()
+		os.Exit(1)
+	}()
+}
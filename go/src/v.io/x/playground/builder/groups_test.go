@@ -0,0 +1,97 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"v.io/x/playground/lib/event"
+)
+
+// Set in the environment of the test binary when it is run as a builder by
+// TestTerminationKillsGroups.
+const terminationTestEnv = "PLAYGROUND_BUILDER_TERMINATION_TEST"
+
+func init() {
+	if os.Getenv(terminationTestEnv) == "" {
+		return
+	}
+	out = event.NewJsonSink(os.Stderr, true)
+	handleTermination()
+	// Like a service, the command forks a child in its process group. Both
+	// print their pids.
+	cmd := exec.Command("sh", "-c", "sleep 30 & echo $!; echo $$; wait")
+	cmd.Stdout = os.Stdout
+	if err := startInGroup(cmd); err != nil {
+		fmt.Println("start failed:", err)
+		os.Exit(2)
+	}
+	cmd.Wait()
+	os.Exit(0)
+}
+
+func TestTerminationKillsGroups(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(exe)
+	cmd.Env = append(os.Environ(), terminationTestEnv+"=1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var pids []int
+	scanner := bufio.NewScanner(stdout)
+	for len(pids) < 2 && scanner.Scan() {
+		pid, err := strconv.Atoi(scanner.Text())
+		if err != nil {
+			cmd.Process.Kill()
+			t.Fatalf("Expected a pid, got %q", scanner.Text())
+		}
+		pids = append(pids, pid)
+	}
+	if len(pids) < 2 {
+		cmd.Process.Kill()
+		t.Fatalf("Expected 2 pids, got %v", pids)
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	if err := cmd.Wait(); err == nil {
+		t.Errorf("Expected terminated builder to exit with an error")
+	}
+	for _, pid := range pids {
+		for deadline := time.Now().Add(time.Second); !processGone(pid) && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !processGone(pid) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Errorf("Expected process %d to be killed with builder", pid)
+		}
+	}
+}
+
+func TestStartInGroupTerminating(t *testing.T) {
+	defer func() {
+		groupsMu.Lock()
+		groups, terminating = nil, false
+		groupsMu.Unlock()
+	}()
+
+	killAllGroups()
+	if err := startInGroup(exec.Command("true")); err != errTerminating {
+		t.Errorf("Expected %v, got %v", errTerminating, err)
+	}
+}
@@ -3,7 +3,8 @@
 // license that can be found in the LICENSE file.
 
 // Compiles and runs code for the Vanadium playground. Code is passed via
-// os.Stdin as a JSON encoded request struct.
+// os.Stdin as a JSON encoded request struct, optionally followed by input for
+// interactive files (see stdin.go).
 
 // NOTE(nlacasse): We use log.Panic() instead of log.Fatal() everywhere in this
 // file.  We do this because log.Panic calls panic(), which allows any deferred
@@ -23,13 +24,13 @@ import (
 	"fmt"
 	"go/parser"
 	"go/token"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
 	"syscall"
@@ -45,8 +46,7 @@ var (
 	verbose              = flag.Bool("verbose", true, "Whether to output debug messages.")
 	includeServiceOutput = flag.Bool("includeServiceOutput", false, "Whether to stream service (mounttable, proxy) output to clients.")
 	includeProfileEnv    = flag.Bool("includeProfileEnv", false, "Whether to log the output of \"jiri profile env\" before compilation.")
-	// TODO(ivanpi): Separate out mounttable and proxy timeouts. Add compile timeout. Revise default.
-	runTimeout = flag.Duration("runTimeout", 5*time.Second, "Time limit for running user code.")
+	stopGracePeriod      = flag.Duration("stopGracePeriod", time.Second, "Time to wait after sending SIGTERM to a user process before killing its process group.")
 
 	stopped  = false    // Whether we have stopped execution of running files.
 	out      event.Sink // Sink for writing events (debug and run output) to stdout as JSON, one event per line.
@@ -61,13 +61,33 @@ var (
 type request struct {
 	Files       []*codeFile
 	Credentials []credentials
+	// Set by compilerd to learn the builder fingerprint, see fingerprint.go.
+	// Builder reports it and exits without processing any files. compilerd
+	// rejects client requests that set it.
+	Probe bool
 }
 
-// Type of file data.  Only Name and Body should be initially set.  The other
+// Type of file data.  Only exported fields should be initially set.  The other
 // fields are added as the file is parsed.
 type codeFile struct {
 	Name string
 	Body string
+	// Kind of executable, either kindService or kindTask. Ignored for files
+	// that are not executable. See runFiles for how it affects termination.
+	Kind string
+	// Names of files that must be ready before this file is started.
+	WaitFor []string
+	// Regexp matched against lines of the file's output. The file is ready
+	// once a line matches. If empty, the file is ready as soon as it starts.
+	Ready string
+	// Extra command-line arguments, environment variables and stdin for the
+	// file's process. See options.go for limits.
+	Args  []string
+	Env   map[string]string
+	Stdin string
+	// Whether the file's process reads stdin from frames sent after the
+	// request while it runs, instead of Stdin. See stdin.go.
+	Interactive bool
 	// Language the file is written in.  Inferred from the file extension.
 	lang string
 	// Credentials to associate with the file's process.
@@ -78,17 +98,61 @@ type codeFile struct {
 	executable bool
 	// Name of the binary (for go files).
 	binaryName string
-	// Running cmd process for the file.
+	// Running cmd process for the file. The process is the leader of its own
+	// process group, which also contains any processes it spawns.
 	cmd *exec.Cmd
+	// Closed once the process has exited.
+	done chan struct{}
+	// Whether the process group had to be killed after the stop grace period.
+	// Guarded by mu.
+	forceKilled bool
+	// Pipe to the process's stdin, for interactive files only.
+	stdinReader, stdinWriter *os.File
 	// Any subprocesses that are needed to support running the file (e.g. mounttable).
 	subprocs []*os.Process
 	// The index of the file in the request.
 	index int
+	// Compiled Ready regexp, and the files listed in WaitFor.
+	readyRegexp *regexp.Regexp
+	deps        []*codeFile
+	// Run state, only accessed from runFiles.
+	started, ready, exited, abandoned bool
 }
 
+const (
+	// Long-running process, stopped once all tasks have finished.
+	kindService = "service"
+	// Process that is expected to run to completion.
+	kindTask = "task"
+)
+
 type exit struct {
-	name string
+	file *codeFile
 	err  error
+	// Set only if the process was started.
+	state    *os.ProcessState
+	wallTime time.Duration
+}
+
+// status converts the exit into a machine-readable exit status.
+func (e exit) status() event.ExitStatus {
+	s := event.ExitStatus{Code: -1, WallTime: e.wallTime}
+	if e.state == nil {
+		return s
+	}
+	s.UserTime = e.state.UserTime()
+	s.SystemTime = e.state.SystemTime()
+	if ws, ok := e.state.Sys().(syscall.WaitStatus); ok {
+		if ws.Exited() {
+			s.Code = ws.ExitStatus()
+		} else if ws.Signaled() {
+			s.Signal = int(ws.Signal())
+		}
+	}
+	if ru, ok := e.state.SysUsage().(*syscall.Rusage); ok {
+		s.MaxRSS = int64(ru.Maxrss)
+	}
+	return s
 }
 
 func debug(args ...interface{}) {
@@ -117,14 +181,12 @@ func logProfileEnv() error {
 //
 // If no credentials are specified in the request, then all files will use the
 // same principal.
-func parseRequest(in io.Reader) (request, error) {
+//
+// Only the request is read from dec, leaving any input for interactive files.
+func parseRequest(dec *json.Decoder) (request, error) {
 	debug("Parsing input")
-	data, err := ioutil.ReadAll(in)
-	if err != nil {
-		return request{}, err
-	}
 	var r request
-	if err = json.Unmarshal(data, &r); err != nil {
+	if err := dec.Decode(&r); err != nil {
 		return r, err
 	}
 	m := make(map[string]*codeFile)
@@ -158,6 +220,15 @@ func parseRequest(in io.Reader) (request, error) {
 				return r, fmt.Errorf("Unknown file type: %q", f.Name)
 			}
 
+			switch f.Kind {
+			case "", kindService, kindTask:
+			default:
+				return r, fmt.Errorf("Unknown kind %q for file %q", f.Kind, f.Name)
+			}
+			if err := f.validateRunOptions(); err != nil {
+				return r, err
+			}
+
 			basename := path.Base(f.Name)
 			if _, ok := m[basename]; ok {
 				return r, fmt.Errorf("Two files with same basename: %q", basename)
@@ -165,6 +236,9 @@ func parseRequest(in io.Reader) (request, error) {
 			m[basename] = f
 		}
 	}
+	if err := resolveDependencies(m); err != nil {
+		return r, err
+	}
 	if len(r.Credentials) == 0 {
 		// Run everything as the same principal.
 		for _, file := range m {
@@ -197,26 +271,28 @@ func writeFiles(files []*codeFile) error {
 }
 
 // If compilation failed due to user error (bad input), returns badInput=true
-// and cerr=nil. Only internal errors return non-nil cerr.
-func compileFiles(files []*codeFile) (badInput bool, cerr error) {
+// and cerr=nil. If a compilation phase ran out of time, returns timedOut=true
+// and cerr=nil, after notifying the client. Only internal errors return non-nil
+// cerr.
+func compileFiles(files []*codeFile) (badInput, timedOut bool, cerr error) {
 	found := make(map[string]bool)
 	for _, f := range files {
 		found[f.lang] = true
 	}
 	if !found["go"] && !found["vdl"] {
 		// No need to compile.
-		return false, nil
+		return false, false, nil
 	}
 
 	debug("Compiling files")
 	pwd, err := os.Getwd()
 	if err != nil {
-		return false, fmt.Errorf("Error getting current directory: %v", err)
+		return false, false, fmt.Errorf("Error getting current directory: %v", err)
 	}
 	srcd := filepath.Join(pwd, "src")
 	if err = os.Chdir(srcd); err != nil {
 		panicOnError(out.Write(event.New("", "stderr", ".go or .vdl files outside src/ directory.")))
-		return true, nil
+		return true, false, nil
 	}
 	os.Setenv("GOPATH", pwd+":"+os.Getenv("GOPATH"))
 	os.Setenv("VDLPATH", pwd+"/src:"+os.Getenv("VDLPATH"))
@@ -225,53 +301,220 @@ func compileFiles(files []*codeFile) (badInput bool, cerr error) {
 	// TODO(ivanpi): We assume *exec.ExitError results from uncompilable input
 	// files; other cases can result from bugs in playground backend or compiler
 	// itself.
-	if found["go"] {
-		debug("Generating VDL for Go and compiling Go")
-		cmd, err := makeCmd("<compile>", false, "", "jiri", "go", "install", "./...")
-		if err != nil {
-			return false, err
+	if found["vdl"] {
+		debug("Generating VDL for Go")
+		badInput, timedOut, err := runCompileStep(startPhase("vdl", *vdlTimeout), srcd, files, "vdl", "generate", "--lang=go", "./...")
+		if badInput || timedOut || err != nil {
+			return badInput, timedOut, err
 		}
-		err = cmd.Run()
-		if _, ok := err.(*exec.ExitError); ok {
-			return true, nil
-		} else if err != nil {
-			return false, err
+	}
+	if found["go"] {
+		debug("Compiling Go")
+		badInput, timedOut, err := runCompileStep(startPhase("compile", *compileTimeout), srcd, files, "jiri", "go", "install", "./...")
+		if badInput || timedOut || err != nil {
+			return badInput, timedOut, err
 		}
 	}
 	if err := os.Chdir(pwd); err != nil {
-		return false, fmt.Errorf("Error returning to parent directory: %v", err)
+		return false, false, fmt.Errorf("Error returning to parent directory: %v", err)
+	}
+	return false, false, nil
+}
+
+// runCompileStep runs a compilation command within the given phase. Compiler
+// output is streamed to the client, and also parsed into diagnostics if the
+// command fails. Results are as for compileFiles.
+func runCompileStep(p *phase, srcd string, files []*codeFile, progName string, args ...string) (badInput, timedOut bool, cerr error) {
+	cmd, err := makeCmd("<compile>", false, "", progName, args...)
+	if err != nil {
+		return false, false, err
 	}
-	return false, nil
+	// Collect compiler output so it can be parsed into diagnostics.
+	collector := new(diagnosticCollector)
+	cmd.Stdout.(*lib.MultiWriter).Add(collector)
+	cmd.Stderr.(*lib.MultiWriter).Add(collector)
+	err = p.run(cmd)
+	if err == errPhaseTimeout {
+		return false, true, nil
+	} else if _, ok := err.(*exec.ExitError); ok {
+		for _, d := range collector.diagnostics(srcd, files) {
+			panicOnError(out.Write(event.NewDiagnostic("<compile>", d)))
+		}
+		return true, false, nil
+	}
+	return false, false, err
 }
 
+// compile compiles the files, notifying the client if they cannot be run.
+// Returns true iff they can be run.
+func compile(files []*codeFile) bool {
+	badInput, timedOut, err := compileFiles(files)
+	// Panic on internal error, but not on user error.
+	panicOnError(err)
+	if timedOut {
+		// The client has been sent the phase timeout event.
+		return false
+	}
+	if badInput {
+		panicOnError(out.Write(event.New("<compile>", "stderr", "Compilation error.")))
+		return false
+	}
+	return true
+}
+
+// runFiles runs all executable files until the run ends or times out, then
+// stops any that are still running. Files are started once all the files
+// they wait for are ready; see readiness.go.
+//
+// If no file declares its Kind, the run ends as soon as any executable exits.
+// Otherwise, executables without a declared Kind are treated as tasks, and the
+// run ends once all tasks have exited; services are stopped afterwards. If all
+// executables are services, there is no task to wait for: the run ends once
+// every service is ready (or has exited or will never start), so that the
+// client sees the services come up.
 func runFiles(files []*codeFile) {
 	debug("Running files")
-	exit := make(chan exit)
-	running := 0
+	declaredKinds := false
+	tasks := 0
 	for _, f := range files {
 		if f.executable {
-			f.run(exit)
-			running++
+			if f.Kind != "" {
+				declaredKinds = true
+			}
+			if f.isTask() {
+				tasks++
+			}
+		}
+	}
+
+	exit := make(chan exit)
+	// Buffered so that readiness notifications never block.
+	ready := make(chan *codeFile, len(files))
+	running := 0
+
+	// taskDone is called when a task exits or will never be started.
+	taskDone := func() {
+		tasks--
+		if tasks == 0 {
+			debug("All tasks finished, stopping services")
+			stopAll(files)
+		}
+	}
+
+	// startPending starts all files whose dependencies are ready, and gives up
+	// on files that wait for a file which will never become ready (e.g. it
+	// exited before becoming ready, or is not executable).
+	startPending := func() {
+		for changed := true; changed; {
+			changed = false
+			for _, f := range files {
+				if !f.executable || f.started || f.abandoned {
+					continue
+				}
+				if dep := f.deadDependency(); dep != nil {
+					f.abandoned = true
+					changed = true
+					panicOnError(out.Write(event.New(f.Name, "stderr", fmt.Sprintf("Not started: %q will never become ready.", dep.Name))))
+					if declaredKinds && f.isTask() {
+						taskDone()
+					}
+				} else if f.canStart() && !isStopped() {
+					f.started = true
+					changed = true
+					f.run(exit, ready)
+					running++
+				}
+			}
 		}
 	}
 
-	timeout := time.After(*runTimeout)
+	markReady := func(f *codeFile) {
+		f.ready = true
+		panicOnError(out.Write(event.New(f.Name, "ready", "Ready.")))
+	}
 
+	// checkServicesSettled stops the run if all executables are services and
+	// none of them is still starting up.
+	checkServicesSettled := func() {
+		if !declaredKinds || tasks > 0 {
+			return
+		}
+		for _, f := range files {
+			if f.executable && !f.ready && !f.exited && !f.abandoned {
+				return
+			}
+		}
+		debug("All services ready, stopping them")
+		stopAll(files)
+	}
+
+	run := startPhase("run", *runTimeout)
+	timeout := run.timeout()
+
+	startPending()
+	checkServicesSettled()
 	for running > 0 {
 		select {
 		case <-timeout:
-			panicOnError(out.Write(event.New("", "stderr", "Ran for too long; terminated.")))
+			run.exceeded()
 			stopAll(files)
+		case f := <-ready:
+			markReady(f)
+			startPending()
+			checkServicesSettled()
 		case status := <-exit:
-			if status.err == nil {
-				panicOnError(out.Write(event.New(status.name, "stdout", "Exited cleanly.")))
-			} else {
-				panicOnError(out.Write(event.New(status.name, "stderr", fmt.Sprintf("Exited with error: %v", status.err))))
+			// A file's readiness notification is always sent before its exit, so
+			// process any pending notifications first.
+		Drain:
+			for {
+				select {
+				case f := <-ready:
+					markReady(f)
+				default:
+					break Drain
+				}
+			}
+			status.file.exited = true
+			msg := "Exited cleanly."
+			if status.err != nil {
+				msg = fmt.Sprintf("Exited with error: %v", status.err)
 			}
+			exitStatus := status.status()
+			mu.Lock()
+			exitStatus.ForceKilled = status.file.forceKilled
+			mu.Unlock()
+			panicOnError(out.Write(event.NewExit(status.file.Name, msg, exitStatus)))
 			running--
-			stopAll(files)
+			if !declaredKinds {
+				stopAll(files)
+			} else if status.file.isTask() {
+				taskDone()
+			}
+			startPending()
+			checkServicesSettled()
 		}
 	}
+
+	for _, f := range files {
+		if f.executable && !f.started && !f.abandoned {
+			panicOnError(out.Write(event.New(f.Name, "stderr", "Not started: run ended before dependencies were ready.")))
+		}
+	}
+
+	// Kill any processes left behind by user programs.
+	for _, f := range files {
+		if f.started && f.cmd != nil && f.cmd.Process != nil {
+			if killGroup(f.cmd.Process.Pid, syscall.SIGKILL) {
+				panicOnError(out.Write(event.New(f.Name, "stderr", "Killed leftover child processes.")))
+			}
+		}
+	}
+}
+
+func isStopped() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return stopped
 }
 
 func stopAll(files []*codeFile) {
@@ -285,6 +528,10 @@ func stopAll(files []*codeFile) {
 	}
 }
 
+func (f *codeFile) isTask() bool {
+	return f.Kind != kindService
+}
+
 func (f *codeFile) maybeSetExecutableAndBinaryName() error {
 	debug("Parsing package from", f.Name)
 	file, err := parser.ParseFile(token.NewFileSet(), f.Name,
@@ -315,18 +562,51 @@ func (f *codeFile) write() error {
 	return ioutil.WriteFile(f.Name, []byte(f.Body), 0644)
 }
 
-func (f *codeFile) startGo() error {
+func (f *codeFile) startGo(readyCh chan<- *codeFile) error {
 	var err error
+	args := append([]string{"-v23.tcp.address=127.0.0.1:0"}, f.Args...)
 	f.cmd, err = makeCmd(f.Name, false, f.credentials,
-		filepath.Join("bin", f.binaryName),
-		"-v23.tcp.address=127.0.0.1:0")
+		filepath.Join("bin", f.binaryName), args...)
 	if err != nil {
 		return err
 	}
-	return f.cmd.Start()
+	if len(f.Env) > 0 {
+		vars := envvar.VarsFromSlice(f.cmd.Env)
+		for name, value := range f.Env {
+			vars.Set(name, value)
+		}
+		f.cmd.Env = vars.ToSlice()
+	}
+	if f.Stdin != "" {
+		f.cmd.Stdin = strings.NewReader(f.Stdin)
+	} else if f.stdinReader != nil {
+		f.cmd.Stdin = f.stdinReader
+	}
+	if f.readyRegexp != nil {
+		// Watch both output streams, reporting readiness only once.
+		onReady := lib.DoOnce(func() { readyCh <- f })
+		f.cmd.Stdout.(*lib.MultiWriter).Add(newLineMatcher(f.readyRegexp, onReady))
+		f.cmd.Stderr.(*lib.MultiWriter).Add(newLineMatcher(f.readyRegexp, onReady))
+	}
+	// The process gets its own process group, so that it can be stopped
+	// together with any processes it spawns (see groups.go).
+	if err := startInGroup(f.cmd); err != nil {
+		return err
+	}
+	if f.stdinReader != nil {
+		// The process has its own copy.
+		f.stdinReader.Close()
+	}
+	if f.readyRegexp == nil {
+		readyCh <- f
+	}
+	return nil
 }
 
-func (f *codeFile) run(ch chan exit) {
+// run starts the file's process. The exit status is sent on ch, and the file
+// is sent on readyCh once it is ready. readyCh must have enough capacity to
+// never block.
+func (f *codeFile) run(ch chan exit, readyCh chan<- *codeFile) {
 	debug("Running", f.Name)
 	err := func() error {
 		mu.Lock()
@@ -337,7 +617,7 @@ func (f *codeFile) run(ch chan exit) {
 
 		switch f.lang {
 		case "go":
-			return f.startGo()
+			return f.startGo(readyCh)
 		default:
 			return fmt.Errorf("Cannot run file %q", f.Name)
 		}
@@ -346,17 +626,25 @@ func (f *codeFile) run(ch chan exit) {
 		debug("Failed to start", f.Name, "-", err)
 		// Use a goroutine to avoid deadlock.
 		go func() {
-			ch <- exit{f.Name, err}
+			ch <- exit{file: f, err: err}
 		}()
 		return
 	}
 
 	// Wait for the process to exit and send result to channel.
+	start := time.Now()
+	f.done = make(chan struct{})
 	go func() {
 		debug("Waiting for", f.Name)
 		err := f.cmd.Wait()
 		debug("Done waiting for", f.Name)
-		ch <- exit{f.Name, err}
+		close(f.done)
+		ch <- exit{
+			file:     f,
+			err:      err,
+			state:    f.cmd.ProcessState,
+			wallTime: time.Since(start),
+		}
 	}()
 }
 
@@ -368,7 +656,24 @@ func (f *codeFile) stop() {
 		debug("Cannot stop:", f.Name, "cmd is not nil, but cmd.Process is nil")
 	} else {
 		debug("Sending SIGTERM to", f.Name)
-		f.cmd.Process.Signal(syscall.SIGTERM)
+		pid := f.cmd.Process.Pid
+		killGroup(pid, syscall.SIGTERM)
+		// Kill the process group if the process does not exit within the
+		// grace period. mu is held until the client is notified, so that the
+		// notification precedes the exit event, whose status is read under mu.
+		grace := *stopGracePeriod
+		go func() {
+			select {
+			case <-f.done:
+			case <-time.After(grace):
+				mu.Lock()
+				defer mu.Unlock()
+				f.forceKilled = killGroup(pid, syscall.SIGKILL)
+				if f.forceKilled {
+					panicOnError(out.Write(event.New(f.Name, "stderr", fmt.Sprintf("Did not exit within %v of SIGTERM; killed.", grace))))
+				}
+			}
+		}()
 	}
 	for i, subproc := range f.subprocs {
 		debug("Killing subprocess", i, "for", f.Name)
@@ -414,19 +719,31 @@ func main() {
 	flag.Parse()
 
 	out = event.NewJsonSink(os.Stdout, !*verbose)
+	handleTermination()
 
-	r, err := parseRequest(os.Stdin)
+	dec := json.NewDecoder(os.Stdin)
+	r, err := parseRequest(dec)
 	panicOnError(err)
 
+	if r.Probe {
+		reportFingerprint()
+		return
+	}
+
+	panicOnError(openStdin(r.Files))
+	go relayStdin(dec, r.Files)
+
 	credsMgr, err = newCredentialsManager(r.Credentials)
 	panicOnError(err)
 	defer credsMgr.Close()
 
-	mt, err := startMount(*runTimeout)
+	startup := startPhase("startup", *startupTimeout)
+
+	mt, err := startMount(startup)
 	panicOnError(err)
 	defer mt.Kill()
 
-	proxy, err := startProxy(*runTimeout)
+	proxy, err := startProxy(startup)
 	panicOnError(err)
 	defer proxy.Kill()
 
@@ -434,11 +751,7 @@ func main() {
 
 	logProfileEnv()
 
-	badInput, err := compileFiles(r.Files)
-	// Panic on internal error, but not on user error.
-	panicOnError(err)
-	if badInput {
-		panicOnError(out.Write(event.New("<compile>", "stderr", "Compilation error.")))
+	if !compile(r.Files) {
 		return
 	}
 	runFiles(r.Files)
@@ -0,0 +1,258 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"v.io/x/playground/lib/event"
+)
+
+// setupRun changes to a temporary directory with a bin subdirectory for the
+// binaries of script files, and resets the builder state for a new run.
+// Events are written to the returned buffer. The returned function restores
+// the working directory.
+func setupRun(t *testing.T) (*bytes.Buffer, func()) {
+	dir, err := ioutil.TempDir("", "builder-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	outBuf := new(bytes.Buffer)
+	out = event.NewJsonSink(outBuf, false)
+	stopped = false
+	return outBuf, func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+// newScriptFile returns an executable file of the given kind whose binary is
+// a shell script running script. It must be called after setupRun.
+func newScriptFile(t *testing.T, name, kind, script string) *codeFile {
+	if err := ioutil.WriteFile(filepath.Join("bin", name), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return &codeFile{
+		Name:       "src/" + name + "/main.go",
+		Kind:       kind,
+		lang:       "go",
+		executable: true,
+		binaryName: name,
+	}
+}
+
+// parseEvents returns the events written to outBuf, keyed by stream and then
+// by file. Only the last event of each stream and file is kept.
+func parseEvents(t *testing.T, outBuf *bytes.Buffer) map[string]map[string]event.Event {
+	events := make(map[string]map[string]event.Event)
+	dec := json.NewDecoder(outBuf)
+	for {
+		var ev event.Event
+		if err := dec.Decode(&ev); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if events[ev.Stream] == nil {
+			events[ev.Stream] = make(map[string]event.Event)
+		}
+		events[ev.Stream][ev.File] = ev
+	}
+	return events
+}
+
+// runWithTimeout runs the files with the given run phase budget, failing the
+// test if the run does not end before the budget runs out.
+func runWithTimeout(t *testing.T, files []*codeFile, budget time.Duration) {
+	defer func(old time.Duration) { *runTimeout = old }(*runTimeout)
+	*runTimeout = budget
+	start := time.Now()
+	runFiles(files)
+	if elapsed := time.Since(start); elapsed >= budget {
+		t.Errorf("Expected run to end before its time limit, took %v", elapsed)
+	}
+}
+
+func TestRunOnlyServices(t *testing.T) {
+	outBuf, cleanup := setupRun(t)
+	defer cleanup()
+
+	// With only services, the run ends once all of them are ready, and they
+	// are stopped.
+	server := newScriptFile(t, "server", kindService, "echo Serving; exec sleep 30")
+	server.readyRegexp = regexp.MustCompile("^Serving$")
+	client := newScriptFile(t, "client", kindService, "exec sleep 30")
+	client.deps = []*codeFile{server}
+	runWithTimeout(t, []*codeFile{server, client}, 10*time.Second)
+
+	events := parseEvents(t, outBuf)
+	for _, f := range []*codeFile{server, client} {
+		if _, ok := events["ready"][f.Name]; !ok {
+			t.Errorf("Expected %s to become ready, got events %v", f.Name, events)
+		}
+		if ev, ok := events["exit"][f.Name]; !ok || ev.Exit.Signal != int(syscall.SIGTERM) {
+			t.Errorf("Expected %s to be stopped with SIGTERM, got %v", f.Name, ev)
+		}
+	}
+	if _, ok := events["timeout"]; ok {
+		t.Errorf("Expected no timeout, got %v", events["timeout"])
+	}
+}
+
+func TestRunOnlyServicesExited(t *testing.T) {
+	outBuf, cleanup := setupRun(t)
+	defer cleanup()
+
+	// A service exiting before it is ready ends the run too, and files
+	// waiting for it are not started.
+	server := newScriptFile(t, "server", kindService, "exit 3")
+	server.readyRegexp = regexp.MustCompile("^Serving$")
+	client := newScriptFile(t, "client", kindService, "exec sleep 30")
+	client.deps = []*codeFile{server}
+	runWithTimeout(t, []*codeFile{server, client}, 10*time.Second)
+
+	events := parseEvents(t, outBuf)
+	if ev, ok := events["exit"][server.Name]; !ok || ev.Exit.Code != 3 {
+		t.Errorf("Expected server to exit with code 3, got %v", ev)
+	}
+	if client.started {
+		t.Errorf("Expected client not to be started")
+	}
+	if _, ok := events["stderr"][client.Name]; !ok {
+		t.Errorf("Expected an error event for the client, got events %v", events)
+	}
+}
+
+func TestRunTasksAndServices(t *testing.T) {
+	outBuf, cleanup := setupRun(t)
+	defer cleanup()
+
+	// Services keep running until the task exits.
+	server := newScriptFile(t, "server", kindService, "exec sleep 30")
+	task := newScriptFile(t, "task", "", "sleep 0.2")
+	task.deps = []*codeFile{server}
+	runWithTimeout(t, []*codeFile{server, task}, 10*time.Second)
+
+	events := parseEvents(t, outBuf)
+	if ev, ok := events["exit"][task.Name]; !ok || ev.Exit.Code != 0 {
+		t.Errorf("Expected task to exit cleanly, got %v", ev)
+	}
+	if ev, ok := events["exit"][server.Name]; !ok || ev.Exit.Signal != int(syscall.SIGTERM) {
+		t.Errorf("Expected server to be stopped with SIGTERM, got %v", ev)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	// runExit runs script and returns its exit, as sent by codeFile.run.
+	runExit := func(script string) exit {
+		cmd := exec.Command("sh", "-c", script)
+		err := cmd.Run()
+		return exit{err: err, state: cmd.ProcessState, wallTime: time.Second}
+	}
+
+	s := runExit("exit 3").status()
+	if s.Code != 3 || s.Signal != 0 {
+		t.Errorf("Expected exit code 3 and no signal, got %#v", s)
+	}
+	if s.WallTime != time.Second {
+		t.Errorf("Expected wall time %v, got %v", time.Second, s.WallTime)
+	}
+	if s.MaxRSS <= 0 {
+		t.Errorf("Expected a positive max RSS, got %#v", s)
+	}
+
+	s = runExit("kill -KILL $$").status()
+	if s.Code != -1 || s.Signal != int(syscall.SIGKILL) {
+		t.Errorf("Expected no exit code and signal %d, got %#v", syscall.SIGKILL, s)
+	}
+
+	// A busy loop uses measurable CPU time.
+	s = runExit("i=0; while [ $i -lt 100000 ]; do i=$((i+1)); done").status()
+	if s.Code != 0 || s.UserTime+s.SystemTime <= 0 {
+		t.Errorf("Expected exit code 0 and some CPU time, got %#v", s)
+	}
+
+	// Files that failed to start have no exit code.
+	s = exit{err: errors.New("not started")}.status()
+	if want := (event.ExitStatus{Code: -1}); s != want {
+		t.Errorf("Expected %#v, got %#v", want, s)
+	}
+}
+
+// processGone returns true iff the process does not exist or is a zombie.
+func processGone(pid int) bool {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	// The state follows the parenthesized command name.
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) == 0 || fields[0] == "Z"
+}
+
+func TestStopForceKills(t *testing.T) {
+	outBuf, cleanup := setupRun(t)
+	defer cleanup()
+	defer func(old time.Duration) { *stopGracePeriod = old }(*stopGracePeriod)
+	*stopGracePeriod = 200 * time.Millisecond
+
+	// The stubborn file ignores SIGTERM, as does the child it forks. The run
+	// ends when the other file exits, so both have to be killed.
+	stubborn := newScriptFile(t, "stubborn", "", "trap '' TERM; sleep 30 & echo $! > child.pid; echo started; wait")
+	stubborn.readyRegexp = regexp.MustCompile("^started$")
+	quick := newScriptFile(t, "quick", "", "exit 0")
+	quick.deps = []*codeFile{stubborn}
+	runWithTimeout(t, []*codeFile{stubborn, quick}, 10*time.Second)
+
+	events := parseEvents(t, outBuf)
+	if ev, ok := events["exit"][stubborn.Name]; !ok || !ev.Exit.ForceKilled || ev.Exit.Signal != int(syscall.SIGKILL) {
+		t.Errorf("Expected stubborn file to be force killed, got %v", ev)
+	}
+	if ev, ok := events["exit"][quick.Name]; !ok || ev.Exit.ForceKilled {
+		t.Errorf("Expected quick file to exit on its own, got %v", ev)
+	}
+	if !processGone(stubborn.cmd.Process.Pid) {
+		t.Errorf("Expected stubborn process to be killed")
+	}
+	body, err := ioutil.ReadFile("child.pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := strconv.Atoi(strings.TrimSpace(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); !processGone(child) && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !processGone(child) {
+		syscall.Kill(child, syscall.SIGKILL)
+		t.Errorf("Expected child process %d to be killed", child)
+	}
+}
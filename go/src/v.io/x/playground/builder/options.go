@@ -0,0 +1,85 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Validation of per-file run options (command-line arguments, environment
+// variables and stdin) passed in the request.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"v.io/x/ref"
+)
+
+const (
+	// Maximum number of command-line arguments per file.
+	maxArgs = 64
+	// Maximum number of environment variables per file.
+	maxEnvVars = 64
+	// Maximum combined size of arguments and environment variables per file.
+	maxArgsEnvSize = 1 << 12
+	// Maximum size of stdin per file.
+	maxStdinSize = 1 << 16
+)
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Environment variables that are set up by builder and must not be
+// overridden. Names with the "V23_" prefix are also reserved.
+var reservedEnvVars = []string{"PATH", "GOPATH", "VDLPATH", "HOME", ref.EnvNamespacePrefix, ref.EnvAgentPath}
+
+func isReservedEnvVar(name string) bool {
+	if strings.HasPrefix(name, "V23_") {
+		return true
+	}
+	for _, v := range reservedEnvVars {
+		if name == v {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRunOptions checks that the file's Args, Env and Stdin are well
+// formed and within size limits.
+func (f *codeFile) validateRunOptions() error {
+	if len(f.Args) > maxArgs {
+		return fmt.Errorf("Too many arguments for %q: %d > %d", f.Name, len(f.Args), maxArgs)
+	}
+	if len(f.Env) > maxEnvVars {
+		return fmt.Errorf("Too many environment variables for %q: %d > %d", f.Name, len(f.Env), maxEnvVars)
+	}
+	size := 0
+	for _, arg := range f.Args {
+		if strings.IndexByte(arg, 0) >= 0 {
+			return fmt.Errorf("Argument for %q contains a NUL byte", f.Name)
+		}
+		size += len(arg)
+	}
+	for name, value := range f.Env {
+		if !envNameRegexp.MatchString(name) {
+			return fmt.Errorf("Invalid environment variable name for %q: %q", f.Name, name)
+		}
+		if isReservedEnvVar(name) {
+			return fmt.Errorf("Cannot set environment variable %q for %q, it is reserved", name, f.Name)
+		}
+		if strings.IndexByte(value, 0) >= 0 {
+			return fmt.Errorf("Environment variable %q for %q contains a NUL byte", name, f.Name)
+		}
+		size += len(name) + len(value)
+	}
+	if size > maxArgsEnvSize {
+		return fmt.Errorf("Arguments and environment for %q too large: %d > %d bytes", f.Name, size, maxArgsEnvSize)
+	}
+	if len(f.Stdin) > maxStdinSize {
+		return fmt.Errorf("Stdin for %q too large: %d > %d bytes", f.Name, len(f.Stdin), maxStdinSize)
+	}
+	if f.Interactive && f.Stdin != "" {
+		return fmt.Errorf("Cannot set both Stdin and Interactive for %q", f.Name)
+	}
+	return nil
+}
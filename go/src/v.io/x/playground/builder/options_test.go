@@ -0,0 +1,39 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRunOptions(t *testing.T) {
+	valid := &codeFile{
+		Name:  "src/server/server.go",
+		Args:  []string{"-port=8080", "hello world"},
+		Env:   map[string]string{"GREETING": "hi", "_x1": ""},
+		Stdin: "some input\n",
+	}
+	if err := valid.validateRunOptions(); err != nil {
+		t.Errorf("Expected valid options, got error: %v", err)
+	}
+
+	invalid := []*codeFile{
+		{Name: "a.go", Args: make([]string, maxArgs+1)},
+		{Name: "a.go", Args: []string{"a\x00b"}},
+		{Name: "a.go", Args: []string{strings.Repeat("x", maxArgsEnvSize+1)}},
+		{Name: "a.go", Env: map[string]string{"1BAD": "x"}},
+		{Name: "a.go", Env: map[string]string{"PATH": "/tmp"}},
+		{Name: "a.go", Env: map[string]string{"V23_CREDENTIALS": "/tmp"}},
+		{Name: "a.go", Env: map[string]string{"X": strings.Repeat("x", maxArgsEnvSize)}},
+		{Name: "a.go", Stdin: strings.Repeat("x", maxStdinSize+1)},
+		{Name: "a.go", Stdin: "x", Interactive: true},
+	}
+	for _, f := range invalid {
+		if err := f.validateRunOptions(); err == nil {
+			t.Errorf("Expected invalid options for args %.20q, env %.20v, stdin length %d", f.Args, f.Env, len(f.Stdin))
+		}
+	}
+}
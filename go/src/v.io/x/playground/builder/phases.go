@@ -0,0 +1,90 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Time budgets for the phases of a builder run. Each phase is bounded
+// separately, and a "timeout" event naming the phase is sent to the client
+// when a phase exceeds its budget.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"v.io/x/playground/lib/event"
+)
+
+var (
+	startupTimeout = flag.Duration("startupTimeout", 5*time.Second, "Time limit for starting services (mounttable, proxy).")
+	vdlTimeout     = flag.Duration("vdlTimeout", 10*time.Second, "Time limit for generating Go code from VDL files.")
+	compileTimeout = flag.Duration("compileTimeout", 30*time.Second, "Time limit for compiling user code.")
+	runTimeout     = flag.Duration("runTimeout", 5*time.Second, "Time limit for running user code.")
+)
+
+var errPhaseTimeout = errors.New("phase time limit exceeded")
+
+// phase is a stage of the builder run with its own time budget. The budget
+// starts counting when the phase is created.
+type phase struct {
+	name     string
+	budget   time.Duration
+	deadline time.Time
+}
+
+func startPhase(name string, budget time.Duration) *phase {
+	debug("Starting phase", name, "with time limit", budget)
+	return &phase{
+		name:     name,
+		budget:   budget,
+		deadline: time.Now().Add(budget),
+	}
+}
+
+// remaining returns the time left until the phase deadline.
+func (p *phase) remaining() time.Duration {
+	if d := p.deadline.Sub(time.Now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// timeout returns a channel that fires at the phase deadline.
+func (p *phase) timeout() <-chan time.Time {
+	return time.After(p.remaining())
+}
+
+// exceeded notifies the client that the phase ran over its budget.
+func (p *phase) exceeded() {
+	panicOnError(out.Write(event.NewPhaseTimeout(p.name, p.budget)))
+}
+
+// run runs cmd, killing it if the phase deadline is reached. Returns
+// errPhaseTimeout (after notifying the client) if the command was killed.
+// Otherwise the error from cmd.Wait() is returned.
+//
+// The command is run in its own process group (see groups.go), which is
+// killed as a whole at the deadline. Killing only the command would leave its
+// children (e.g. "go" and "compile" under "jiri go install") running, and
+// since they hold the output pipes open, Wait would not return until they
+// finished on their own.
+func (p *phase) run(cmd *exec.Cmd) error {
+	if err := startInGroup(cmd); err != nil {
+		return err
+	}
+	exit := make(chan error, 1)
+	go func() { exit <- cmd.Wait() }()
+	select {
+	case err := <-exit:
+		return err
+	case <-p.timeout():
+		debug("Killing", cmd.Path, "after", p.name, "phase time limit")
+		killGroup(cmd.Process.Pid, syscall.SIGKILL)
+		<-exit
+		p.exceeded()
+		return errPhaseTimeout
+	}
+}
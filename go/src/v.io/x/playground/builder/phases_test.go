@@ -0,0 +1,123 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"v.io/x/playground/lib/event"
+)
+
+func TestPhaseRun(t *testing.T) {
+	var outBuf bytes.Buffer
+	out = event.NewJsonSink(&outBuf, false)
+
+	if err := startPhase("compile", 5*time.Second).run(exec.Command("true")); err != nil {
+		t.Errorf("Expected command to succeed, got %v", err)
+	}
+	if err := startPhase("compile", 5*time.Second).run(exec.Command("false")); err == nil || err == errPhaseTimeout {
+		t.Errorf("Expected command to fail, got %v", err)
+	}
+	if strings.Contains(outBuf.String(), "timeout") {
+		t.Errorf("Expected no timeout event, got %s", outBuf.String())
+	}
+}
+
+func TestCompileStepTimeout(t *testing.T) {
+	for _, name := range []string{"vdl", "compile"} {
+		var outBuf bytes.Buffer
+		out = event.NewJsonSink(&outBuf, false)
+
+		// The step forks a child that holds the output pipes open, like the
+		// go tool under "jiri go install". Both must be killed at the deadline.
+		start := time.Now()
+		badInput, timedOut, err := runCompileStep(startPhase(name, 100*time.Millisecond), "", nil, "sh", "-c", "sleep 30 & sleep 30")
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("Expected %s step to be killed at its deadline, took %v", name, elapsed)
+		}
+		if badInput || !timedOut || err != nil {
+			t.Errorf("Expected %s step to time out, got %v, %v, %v", name, badInput, timedOut, err)
+		}
+		want := event.NewPhaseTimeout(name, 100*time.Millisecond)
+		if !strings.Contains(outBuf.String(), want.Message) {
+			t.Errorf("Expected timeout event %q, got %s", want.Message, outBuf.String())
+		}
+	}
+}
+
+func TestCompileTimeoutEvents(t *testing.T) {
+	outBuf, cleanup := setupRun(t)
+	defer cleanup()
+	defer func(old time.Duration) { *compileTimeout = old }(*compileTimeout)
+	*compileTimeout = 100 * time.Millisecond
+	defer os.Setenv("GOPATH", os.Getenv("GOPATH"))
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+
+	// The compiler hangs, as "jiri go install" would on a pathological input.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join("bin", "jiri"), []byte("#!/bin/sh\nexec sleep 30\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("PATH", filepath.Join(wd, "bin")+":"+os.Getenv("PATH"))
+	f := &codeFile{Name: "src/main/main.go", Body: "package main\n\nfunc main() {}\n", lang: "go"}
+	if err := f.write(); err != nil {
+		t.Fatal(err)
+	}
+
+	if compile([]*codeFile{f}) {
+		t.Errorf("Expected files not to be run after the compile phase timed out")
+	}
+	var streams []string
+	for _, line := range strings.Split(strings.TrimSpace(outBuf.String()), "\n") {
+		var ev event.Event
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Stream != "debug" {
+			streams = append(streams, ev.Stream)
+		}
+		if ev.Message == "Compilation error." {
+			t.Errorf("Expected no compilation error after a timeout, got %#v", ev)
+		}
+	}
+	if want := []string{"timeout"}; !reflect.DeepEqual(streams, want) {
+		t.Errorf("Expected event streams %v, got %v", want, streams)
+	}
+}
+
+func TestStartupTimeout(t *testing.T) {
+	var outBuf bytes.Buffer
+	out = event.NewJsonSink(&outBuf, false)
+
+	cmd, err := makeCmd("<mounttable>", true, "", "sh", "-c", "echo starting; sleep 30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := startAndWaitFor(cmd, startPhase("startup", 100*time.Millisecond), regexp.MustCompile("Mount table service at: (.*)")); err == nil {
+		t.Errorf("Expected service startup to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected startup to time out at its deadline, took %v", elapsed)
+	}
+	want := event.NewPhaseTimeout("startup", 100*time.Millisecond)
+	if !strings.Contains(outBuf.String(), want.Message) {
+		t.Errorf("Expected timeout event %q, got %s", want.Message, outBuf.String())
+	}
+	cmd.Wait()
+}
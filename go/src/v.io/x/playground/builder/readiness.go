@@ -0,0 +1,132 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Startup ordering of user processes. A file may declare other files it must
+// wait for (WaitFor), and a regexp on its own output signalling that it is
+// ready to serve (Ready). A file is started only after all files it waits for
+// are ready. Files without a Ready regexp are ready as soon as they start.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"sync"
+)
+
+// resolveDependencies validates the WaitFor and Ready fields of all files and
+// links each file to the files it waits for. Files are keyed by basename.
+func resolveDependencies(files map[string]*codeFile) error {
+	for _, f := range files {
+		if f.Ready != "" {
+			re, err := regexp.Compile(f.Ready)
+			if err != nil {
+				return fmt.Errorf("Invalid readiness regexp for %q: %v", f.Name, err)
+			}
+			f.readyRegexp = re
+		}
+		for _, name := range f.WaitFor {
+			dep, ok := files[path.Base(name)]
+			if !ok {
+				return fmt.Errorf("File %q waits for unknown file %q", f.Name, name)
+			}
+			if dep == f {
+				return fmt.Errorf("File %q waits for itself", f.Name)
+			}
+			f.deps = append(f.deps, dep)
+		}
+	}
+	// Check for cycles using depth-first search.
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[*codeFile]int)
+	var visit func(f *codeFile) error
+	visit = func(f *codeFile) error {
+		switch state[f] {
+		case visiting:
+			return fmt.Errorf("Cyclic startup dependency involving %q", f.Name)
+		case visited:
+			return nil
+		}
+		state[f] = visiting
+		for _, dep := range f.deps {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		state[f] = visited
+		return nil
+	}
+	for _, f := range files {
+		if err := visit(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deadDependency returns a file that f waits for which will never become
+// ready, or nil if there is none.
+func (f *codeFile) deadDependency() *codeFile {
+	for _, dep := range f.deps {
+		if !dep.executable || dep.abandoned || (dep.exited && !dep.ready) {
+			return dep
+		}
+	}
+	return nil
+}
+
+// canStart returns true iff all files that f waits for are ready.
+func (f *codeFile) canStart() bool {
+	for _, dep := range f.deps {
+		if !dep.ready {
+			return false
+		}
+	}
+	return true
+}
+
+// lineMatcher is an io.Writer that calls onMatch the first time a complete
+// line of written output matches re. Writes never block or fail.
+type lineMatcher struct {
+	re      *regexp.Regexp
+	onMatch func()
+
+	mu      sync.Mutex
+	matched bool
+	partial []byte
+}
+
+func newLineMatcher(re *regexp.Regexp, onMatch func()) *lineMatcher {
+	return &lineMatcher{re: re, onMatch: onMatch}
+}
+
+func (lm *lineMatcher) Write(p []byte) (int, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if lm.matched {
+		return len(p), nil
+	}
+	lm.partial = append(lm.partial, p...)
+	for {
+		i := bytes.IndexByte(lm.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := lm.partial[:i]
+		lm.partial = lm.partial[i+1:]
+		if lm.re.Match(line) {
+			lm.matched = true
+			lm.partial = nil
+			lm.onMatch()
+			break
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestResolveDependencies(t *testing.T) {
+	server := &codeFile{Name: "src/server/server.go", Ready: "Serving: (.*)"}
+	client := &codeFile{Name: "src/client/client.go", WaitFor: []string{"src/server/server.go"}}
+	files := map[string]*codeFile{"server.go": server, "client.go": client}
+	if err := resolveDependencies(files); err != nil {
+		t.Fatalf("resolveDependencies failed: %v", err)
+	}
+	if len(client.deps) != 1 || client.deps[0] != server {
+		t.Errorf("Expected client to wait for server, got %v", client.deps)
+	}
+	if server.readyRegexp == nil {
+		t.Errorf("Expected server readiness regexp to be compiled")
+	}
+	if client.canStart() {
+		t.Errorf("Expected client not to be startable before server is ready")
+	}
+	server.ready = true
+	if !client.canStart() {
+		t.Errorf("Expected client to be startable after server is ready")
+	}
+
+	// Cycles, unknown files and bad regexps are rejected.
+	bad := []map[string]*codeFile{
+		{
+			"a.go": {Name: "src/a/a.go", WaitFor: []string{"b.go"}},
+			"b.go": {Name: "src/b/b.go", WaitFor: []string{"a.go"}},
+		},
+		{"a.go": {Name: "src/a/a.go", WaitFor: []string{"c.go"}}},
+		{"a.go": {Name: "src/a/a.go", WaitFor: []string{"a.go"}}},
+		{"a.go": {Name: "src/a/a.go", Ready: "("}},
+	}
+	for _, files := range bad {
+		if err := resolveDependencies(files); err == nil {
+			t.Errorf("Expected resolveDependencies to fail for %v", files)
+		}
+	}
+}
+
+func TestLineMatcher(t *testing.T) {
+	matches := 0
+	lm := newLineMatcher(regexp.MustCompile("^Serving"), func() { matches++ })
+	for _, s := range []string{"Starting\nServ", "ing: foo", "\nServing: bar\n"} {
+		if n, err := lm.Write([]byte(s)); n != len(s) || err != nil {
+			t.Errorf("Write(%q) returned %v, %v", s, n, err)
+		}
+	}
+	if matches != 1 {
+		t.Errorf("Expected exactly one match, got %v", matches)
+	}
+}
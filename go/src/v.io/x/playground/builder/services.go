@@ -15,7 +15,7 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
-	"time"
+	"syscall"
 
 	"v.io/x/playground/lib"
 	"v.io/x/ref"
@@ -35,12 +35,12 @@ func makeServiceCmd(progName string, args ...string) (*exec.Cmd, error) {
 // startMount starts a mounttabled process, and sets the V23_NAMESPACE env
 // variable to the mounttable's location.  We run one mounttabled process for
 // the entire environment.
-func startMount(timeLimit time.Duration) (proc *os.Process, err error) {
+func startMount(startup *phase) (proc *os.Process, err error) {
 	cmd, err := makeServiceCmd("mounttabled", "-v23.tcp.address=127.0.0.1:0")
 	if err != nil {
 		return nil, err
 	}
-	matches, err := startAndWaitFor(cmd, timeLimit, regexp.MustCompile("NAME=(.*)"))
+	matches, err := startAndWaitFor(cmd, startup, regexp.MustCompile("NAME=(.*)"))
 	if err != nil {
 		return nil, fmt.Errorf("Error starting mounttabled: %v", err)
 	}
@@ -53,7 +53,7 @@ func startMount(timeLimit time.Duration) (proc *os.Process, err error) {
 
 // startProxy starts a proxyd process.  We run one proxyd process for the
 // entire environment.
-func startProxy(timeLimit time.Duration) (proc *os.Process, err error) {
+func startProxy(startup *phase) (proc *os.Process, err error) {
 	cmd, err := makeServiceCmd(
 		"xproxyd",
 		"-log_dir=/tmp/logs",
@@ -63,22 +63,25 @@ func startProxy(timeLimit time.Duration) (proc *os.Process, err error) {
 	if err != nil {
 		return nil, err
 	}
-	if _, err := startAndWaitFor(cmd, timeLimit, regexp.MustCompile("NAME=(.*)")); err != nil {
+	if _, err := startAndWaitFor(cmd, startup, regexp.MustCompile("NAME=(.*)")); err != nil {
 		return nil, fmt.Errorf("Error starting proxy: %v", err)
 	}
 	return cmd.Process, nil
 }
 
 // Helper function to start a command and wait for output.  Arguments are a cmd
-// to run, a timeout, and a regexp.  The slice of strings matched by the regexp
-// is returned.
+// to run, the phase bounding the wait, and a regexp.  The slice of strings
+// matched by the regexp is returned.  If the phase runs out of time, the
+// command is killed and the client notified.
 // TODO(nlacasse): Consider standardizing how services log when they start
 // listening, and their endpoints (if any).  Then this could become a common
 // util function.
-func startAndWaitFor(cmd *exec.Cmd, timeout time.Duration, outputRegexp *regexp.Regexp) ([]string, error) {
+func startAndWaitFor(cmd *exec.Cmd, p *phase, outputRegexp *regexp.Regexp) ([]string, error) {
 	reader, writer := io.Pipe()
 	cmd.Stdout.(*lib.MultiWriter).Add(writer)
-	if err := cmd.Start(); err != nil {
+	// As in phase.run, the service gets its own process group, so that the
+	// whole group can be killed if it fails to start in time.
+	if err := startInGroup(cmd); err != nil {
 		return nil, err
 	}
 
@@ -94,7 +97,9 @@ func startAndWaitFor(cmd *exec.Cmd, timeout time.Duration, outputRegexp *regexp.
 		close(ch)
 	})()
 	select {
-	case <-time.After(timeout):
+	case <-p.timeout():
+		killGroup(cmd.Process.Pid, syscall.SIGKILL)
+		p.exceeded()
 		return nil, fmt.Errorf("Timeout starting service: %v", cmd.Path)
 	case matches := <-ch:
 		return matches, nil
@@ -0,0 +1,89 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Interactive stdin. After the request, builder's stdin may carry a stream of
+// JSON-encoded event.Stdin frames, each addressed to a file by basename, like
+// WaitFor, so the full name, as in output events, works too. Files marked
+// Interactive read their stdin from a pipe, and frames addressed to them are
+// written to it as they arrive. Input sent before the process starts
+// is buffered in the pipe. A file's stdin is closed when a frame asks for it,
+// or when the input stream ends.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+
+	"v.io/x/playground/lib/event"
+)
+
+// openStdin creates stdin pipes for interactive files.
+func openStdin(files []*codeFile) error {
+	for _, f := range files {
+		if !f.Interactive {
+			continue
+		}
+		var err error
+		if f.stdinReader, f.stdinWriter, err = os.Pipe(); err != nil {
+			return fmt.Errorf("Error creating stdin pipe for %q: %v", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// closeStdin closes stdin of all interactive files, so that their processes
+// read EOF once they have consumed any buffered input.
+func closeStdin(files []*codeFile) {
+	for _, f := range files {
+		if f.Interactive {
+			f.stdinWriter.Close()
+		}
+	}
+}
+
+// relayStdin reads stdin frames from dec until the input stream ends, and
+// writes them to the stdin pipes of the files they are addressed to. Stdin of
+// all interactive files is closed once the stream ends, or once writing an
+// event fails, since the output is then lost anyway.
+func relayStdin(dec *json.Decoder, files []*codeFile) {
+	defer closeStdin(files)
+	// Basenames are unique, see parseRequest.
+	m := make(map[string]*codeFile)
+	for _, f := range files {
+		m[path.Base(f.Name)] = f
+	}
+	for {
+		var in event.Stdin
+		if err := dec.Decode(&in); err != nil {
+			if err != io.EOF {
+				debug("Error reading stdin frame:", err)
+			}
+			return
+		}
+		f := m[path.Base(in.File)]
+		if f == nil || !f.Interactive {
+			// This runs in its own goroutine, so panicking would not run the
+			// deferred cleanup of main.
+			if err := out.Write(event.New(in.File, "stderr", "Ignoring input for a file that is not interactive.")); err != nil {
+				log.Printf("Error writing event: %v", err)
+				return
+			}
+			continue
+		}
+		if in.Data != "" {
+			// Fails if the process has exited or its stdin was closed.
+			if _, err := io.WriteString(f.stdinWriter, in.Data); err != nil {
+				debug("Error writing stdin of", f.Name, "-", err)
+			}
+		}
+		if in.Close {
+			f.stdinWriter.Close()
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"v.io/x/playground/lib/event"
+)
+
+func TestRelayStdin(t *testing.T) {
+	var outBuf bytes.Buffer
+	out = event.NewJsonSink(&outBuf, false)
+
+	a := &codeFile{Name: "src/a/a.go", Interactive: true}
+	b := &codeFile{Name: "src/b/b.go", Interactive: true}
+	c := &codeFile{Name: "src/c/c.go"}
+	files := []*codeFile{a, b, c}
+	if err := openStdin(files); err != nil {
+		t.Fatal(err)
+	}
+
+	input := `{"Files": []}
+{"File": "src/a/a.go", "Data": "hello "}
+{"File": "src/b/b.go", "Data": "x", "Close": true}
+{"File": "b.go", "Data": "after close"}
+{"File": "src/c/c.go", "Data": "not interactive"}
+{"File": "a.go", "Data": "world\n"}
+`
+	dec := json.NewDecoder(strings.NewReader(input))
+	if _, err := parseRequest(dec); err != nil {
+		t.Fatal(err)
+	}
+	relayStdin(dec, files)
+
+	// The stream has ended, so all pipes are closed and can be read to EOF.
+	for _, test := range []struct {
+		f    *codeFile
+		want string
+	}{
+		{a, "hello world\n"},
+		{b, "x"},
+	} {
+		got, err := ioutil.ReadAll(test.f.stdinReader)
+		if err != nil {
+			t.Errorf("Failed reading stdin of %s: %v", test.f.Name, err)
+		}
+		if string(got) != test.want {
+			t.Errorf("Expected stdin of %s to be %q, got %q", test.f.Name, test.want, got)
+		}
+	}
+	if !strings.Contains(outBuf.String(), "not interactive") {
+		t.Errorf("Expected an error event for the non-interactive file, got %s", outBuf.String())
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestRelayStdinWriteError(t *testing.T) {
+	out = event.NewJsonSink(failingWriter{}, false)
+
+	a := &codeFile{Name: "src/a/a.go", Interactive: true}
+	files := []*codeFile{a}
+	if err := openStdin(files); err != nil {
+		t.Fatal(err)
+	}
+
+	// Relaying stops when the error event cannot be written, and closes stdin.
+	input := `{"File": "unknown.go", "Data": "x"}
+{"File": "a.go", "Data": "ignored"}
+`
+	relayStdin(json.NewDecoder(strings.NewReader(input)), files)
+	got, err := ioutil.ReadAll(a.stdinReader)
+	if err != nil {
+		t.Errorf("Failed reading stdin of %s: %v", a.Name, err)
+	}
+	if len(got) != 0 {
+		t.Errorf("Expected no input after the write error, got %q", got)
+	}
+}
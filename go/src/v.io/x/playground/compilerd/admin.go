@@ -0,0 +1,94 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Handlers for administrative HTTP requests. They are served on a separate
+// address (--admin-address), which should not be reachable from the
+// internet, since the requests are not authenticated.
+//
+// handlerFlushCache() handles a POST request that deletes cached responses
+// produced by builders other than the current one (see cached_response.go).
+//
+// handlerWorkers() shows the job queue and workers of the dispatcher, and
+// resizes the worker pool on a POST request.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"v.io/x/playground/lib/log"
+)
+
+var adminAddress = flag.String("admin-address", "", "Address to serve administrative requests on, e.g. localhost:8182. If empty, administrative requests are disabled.")
+
+// newAdminServeMux returns a handler for all administrative requests.
+func (c *compiler) newAdminServeMux() *http.ServeMux {
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/flush-cache", c.handlerFlushCache)
+	serveMux.HandleFunc("/workers", c.handlerWorkers)
+	return serveMux
+}
+
+// POST request that deletes cached responses for all builder fingerprints
+// except the one given by the keep parameter, by default the fingerprint of
+// the builder used by this instance.
+func (c *compiler) handlerFlushCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	keep := r.FormValue("keep")
+	if keep == "" {
+		keep = c.currentFingerprint()
+	}
+	if keep == "" {
+		http.Error(w, "Builder fingerprint not known yet, please retry or specify keep.", http.StatusServiceUnavailable)
+		return
+	}
+	deleted, err := c.cache.Flush(keep)
+	if err != nil {
+		log.Errorf("Error flushing cache: %v", err)
+		http.Error(w, fmt.Sprintf("Error flushing cache after deleting %d responses.", deleted), http.StatusInternalServerError)
+		return
+	}
+	log.Debugf("Flushed %d cached responses not matching fingerprint %q.", deleted, keep)
+	fmt.Fprintf(w, "Deleted %d cached responses not matching fingerprint %s.\n", deleted, keep)
+}
+
+// GET request that shows the number of queued jobs and the state of each
+// worker, or POST request that first sets the number of workers to the size
+// parameter. Jobs running on removed workers are allowed to finish.
+func (c *compiler) handlerWorkers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		size, err := strconv.Atoi(r.FormValue("size"))
+		if err != nil || size < 0 {
+			http.Error(w, "Invalid size, expected a non-negative number of workers.", http.StatusBadRequest)
+			return
+		}
+		log.Debugf("Resizing worker pool to %d workers.", size)
+		c.dispatcher.Resize(size)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s := c.dispatcher.Stats()
+	fmt.Fprintf(w, "Workers: %d (%d running jobs), queued jobs: %d, uptime: %v.\n", s.Size, s.Running, s.Queued, s.Uptime.Round(time.Second))
+	for _, ws := range s.Workers {
+		state := "idle"
+		if ws.Job != "" {
+			state = fmt.Sprintf("running %s for %v", ws.Job, ws.JobTime.Round(time.Millisecond))
+		}
+		if ws.Retiring {
+			state += ", retiring"
+		}
+		fmt.Fprintf(w, "Worker %d: uptime %v, %s.\n", ws.ID, ws.Uptime.Round(time.Second), state)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cache implements stores for cached compile responses.
+//
+// Three implementations are available:
+//   - memory: a process-local LRU cache,
+//   - disk:   files in a directory, surviving compilerd restarts and
+//             shareable between instances on the same machine,
+//   - sql:    the response_cache table (see lib/storage), shared between all
+//             instances using the same database.
+// All of them are bounded by the total size of stored values and expire
+// entries after a fixed time to live. Values are opaque byte slices; encoding
+// responses is up to the caller.
+//
+// Each entry is tagged with the fingerprint of the builder that produced it
+// (see event.Fingerprint), so that entries produced by old builders can be
+// flushed after an upgrade.
+
+package cache
+
+import (
+	"encoding/hex"
+	"time"
+)
+
+// Key identifies a cache entry, usually the SHA256 of the request.
+type Key [32]byte
+
+func (k Key) String() string {
+	return hex.EncodeToString(k[:])
+}
+
+// Cache is a key-value store with bounded size and entry lifetime. Entries
+// may be evicted at any time. Implementations are safe for concurrent use.
+type Cache interface {
+	// Get returns the value stored under key. It returns false if there is
+	// no such value or if it has expired.
+	Get(key Key) ([]byte, bool, error)
+	// Add stores value under key, replacing any existing value. The entry is
+	// tagged with fingerprint.
+	Add(key Key, fingerprint string, value []byte) error
+	// Flush deletes all entries not tagged with fingerprint keep. It returns
+	// the number of entries deleted.
+	Flush(keep string) (int64, error)
+}
+
+// Maximum length of a fingerprint tag.
+const maxFingerprintLen = 255
+
+// Options bound the contents of a cache.
+type Options struct {
+	// Maximum total size of stored values in bytes. When exceeded, the least
+	// recently used entries (or, for caches that do not track use, the oldest
+	// entries) are evicted.
+	MaxBytes int64
+	// Time after which an entry expires.
+	TTL time.Duration
+}
@@ -0,0 +1,222 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// testCache is a Cache with a manually advanced clock.
+type testCache struct {
+	Cache
+	advance func(d time.Duration)
+}
+
+func newTestMemory(t *testing.T, opts Options) testCache {
+	c := newMemory(opts)
+	now := time.Unix(1000, 0)
+	c.now = func() time.Time { return now }
+	return testCache{c, func(d time.Duration) { now = now.Add(d) }}
+}
+
+func newTestDisk(t *testing.T, opts Options) testCache {
+	dir, err := ioutil.TempDir("", "pg-cache-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempDirs = append(tempDirs, dir)
+	// File modification times are set from the fake clock, so start close to
+	// the real time to keep file systems happy.
+	now := time.Now().Truncate(time.Second)
+	c, err := newDisk(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.now = func() time.Time { return now }
+	return testCache{c, func(d time.Duration) { now = now.Add(d) }}
+}
+
+// Directories created by newTestDisk, removed by TestMain.
+var tempDirs []string
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	for _, dir := range tempDirs {
+		os.RemoveAll(dir)
+	}
+	os.Exit(code)
+}
+
+var implementations = []struct {
+	name string
+	new  func(t *testing.T, opts Options) testCache
+	// Per-entry overhead counted against MaxBytes.
+	overhead int64
+}{
+	{"memory", newTestMemory, 0},
+	{"disk", newTestDisk, diskHeaderSize + int64(len(testFingerprint))},
+}
+
+const testFingerprint = "fp"
+
+func key(s string) Key {
+	var k Key
+	copy(k[:], s)
+	return k
+}
+
+func value(size int64, fill byte) []byte {
+	return bytes.Repeat([]byte{fill}, int(size))
+}
+
+func expectGet(t *testing.T, name string, c Cache, k string, want []byte) {
+	got, ok, err := c.Get(key(k))
+	if err != nil {
+		t.Fatalf("%s: Get(%q) failed: %v", name, k, err)
+	}
+	switch {
+	case want == nil && ok:
+		t.Errorf("%s: Expected %q not to be in cache, but it was", name, k)
+	case want != nil && !ok:
+		t.Errorf("%s: Expected %q to be in cache, but it was not", name, k)
+	case want != nil && !bytes.Equal(got, want):
+		t.Errorf("%s: Expected %q to have value %q, got %q", name, k, want, got)
+	}
+}
+
+func TestGetAdd(t *testing.T) {
+	for _, impl := range implementations {
+		c := impl.new(t, Options{MaxBytes: 1 << 20, TTL: time.Hour})
+		expectGet(t, impl.name, c, "a", nil)
+		if err := c.Add(key("a"), testFingerprint, []byte("foo")); err != nil {
+			t.Fatalf("%s: Add failed: %v", impl.name, err)
+		}
+		expectGet(t, impl.name, c, "a", []byte("foo"))
+		expectGet(t, impl.name, c, "b", nil)
+
+		// Add replaces existing values.
+		if err := c.Add(key("a"), testFingerprint, []byte("bar")); err != nil {
+			t.Fatalf("%s: Add failed: %v", impl.name, err)
+		}
+		expectGet(t, impl.name, c, "a", []byte("bar"))
+	}
+}
+
+func TestTTL(t *testing.T) {
+	for _, impl := range implementations {
+		c := impl.new(t, Options{MaxBytes: 1 << 20, TTL: time.Hour})
+		c.Add(key("a"), testFingerprint, []byte("foo"))
+		c.advance(30 * time.Minute)
+		c.Add(key("b"), testFingerprint, []byte("bar"))
+		c.advance(30 * time.Minute)
+		expectGet(t, impl.name, c, "a", nil)
+		expectGet(t, impl.name, c, "b", []byte("bar"))
+		c.advance(30 * time.Minute)
+		expectGet(t, impl.name, c, "b", nil)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	for _, impl := range implementations {
+		entry := 100 + impl.overhead
+		// Room for 3.5 entries, so that pruning the disk cache down to
+		// diskPruneRatio of the limit still keeps 3.
+		c := impl.new(t, Options{MaxBytes: 3*entry + entry/2, TTL: time.Hour})
+		c.Add(key("a"), testFingerprint, value(100, 'a'))
+		c.advance(time.Second)
+		c.Add(key("b"), testFingerprint, value(100, 'b'))
+		c.advance(time.Second)
+		c.Add(key("c"), testFingerprint, value(100, 'c'))
+		c.advance(time.Second)
+
+		// Using "a" makes "b" the least recently used entry.
+		expectGet(t, impl.name, c, "a", value(100, 'a'))
+		c.advance(time.Second)
+		c.Add(key("d"), testFingerprint, value(100, 'd'))
+		expectGet(t, impl.name, c, "b", nil)
+		for _, k := range []string{"a", "c", "d"} {
+			expectGet(t, impl.name, c, k, value(100, k[0]))
+		}
+
+		// Values larger than the whole cache are not stored.
+		c.Add(key("e"), testFingerprint, value(4*entry, 'e'))
+		expectGet(t, impl.name, c, "e", nil)
+		expectGet(t, impl.name, c, "a", value(100, 'a'))
+	}
+}
+
+func TestFlush(t *testing.T) {
+	for _, impl := range implementations {
+		c := impl.new(t, Options{MaxBytes: 1 << 20, TTL: time.Hour})
+		c.Add(key("a"), "old", []byte("foo"))
+		c.Add(key("b"), "new", []byte("bar"))
+		c.Add(key("c"), "older", []byte("baz"))
+		deleted, err := c.Flush("new")
+		if err != nil {
+			t.Fatalf("%s: Flush failed: %v", impl.name, err)
+		}
+		if deleted != 2 {
+			t.Errorf("%s: Expected Flush to delete 2 entries, got %v", impl.name, deleted)
+		}
+		expectGet(t, impl.name, c, "a", nil)
+		expectGet(t, impl.name, c, "b", []byte("bar"))
+		expectGet(t, impl.name, c, "c", nil)
+	}
+}
+
+func TestDiskSurvivesRestart(t *testing.T) {
+	opts := Options{MaxBytes: 1 << 20, TTL: time.Hour}
+	c1 := newTestDisk(t, opts)
+	c1.Add(key("a"), testFingerprint, []byte("foo"))
+	c2, err := NewDisk(c1.Cache.(*diskCache).dir, opts)
+	if err != nil {
+		t.Fatalf("NewDisk failed: %v", err)
+	}
+	expectGet(t, "disk", c2, "a", []byte("foo"))
+}
+
+func TestDiskReplaceSize(t *testing.T) {
+	entry := 100 + diskHeaderSize + int64(len(testFingerprint))
+	c := newTestDisk(t, Options{MaxBytes: 2 * entry, TTL: time.Hour})
+	c.Add(key("a"), testFingerprint, value(100, 'a'))
+	c.Add(key("b"), testFingerprint, value(100, 'b'))
+	// Replacing an entry does not grow the tracked size, so nothing is evicted.
+	for i := 0; i < 5; i++ {
+		c.Add(key("a"), testFingerprint, value(100, 'A'))
+	}
+	if size := c.Cache.(*diskCache).size; size != 2*entry {
+		t.Errorf("Expected size %d, got %d", 2*entry, size)
+	}
+	expectGet(t, "disk", c, "a", value(100, 'A'))
+	expectGet(t, "disk", c, "b", value(100, 'b'))
+}
+
+func TestDiskPruneSlack(t *testing.T) {
+	entry := 100 + diskHeaderSize + int64(len(testFingerprint))
+	c := newTestDisk(t, Options{MaxBytes: 10 * entry, TTL: time.Hour})
+	dc := c.Cache.(*diskCache)
+	for i := 0; i < 11; i++ {
+		c.advance(time.Second)
+		c.Add(key(string(rune('a'+i))), testFingerprint, value(100, 'x'))
+	}
+	// Exceeding the limit prunes down to 90% of it, evicting the two least
+	// recently used entries.
+	if size := dc.size; size != 9*entry {
+		t.Errorf("Expected size %d after pruning, got %d", 9*entry, size)
+	}
+	expectGet(t, "disk", c, "a", nil)
+	expectGet(t, "disk", c, "b", nil)
+	expectGet(t, "disk", c, "c", value(100, 'x'))
+
+	// The next entry fits without pruning.
+	c.Add(key("z"), testFingerprint, value(100, 'x'))
+	if infos, err := ioutil.ReadDir(dc.dir); err != nil || len(infos) != 10 {
+		t.Errorf("Expected 10 entries, got %d, %v", len(infos), err)
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each entry is stored in a file named after the hex-encoded key. The file
+// starts with a header containing the expiry time in Unix nanoseconds (8
+// bytes, big endian) and the fingerprint (1 byte length, followed by the
+// fingerprint), followed by the value. The file modification time is the time
+// of last use.
+const diskHeaderSize = 9
+
+// Files being written are created with this prefix, then renamed, so that
+// readers never see partial entries.
+const diskTempPrefix = ".tmp-"
+
+// Once the size limit is exceeded, entries are removed until the total size
+// is within this fraction of the limit, so that the directory is not rescanned
+// on every Add.
+const diskPruneRatio = 0.9
+
+// diskCache stores entries as files in a directory. Multiple compilerd
+// instances may share the directory. Each instance tracks the total size of
+// the directory approximately, and rescans it when the size limit may have
+// been exceeded.
+type diskCache struct {
+	dir  string
+	opts Options
+	// Returns the current time. Replaced in tests.
+	now func() time.Time
+
+	mu   sync.Mutex
+	size int64
+}
+
+var _ Cache = (*diskCache)(nil)
+
+// NewDisk returns a cache storing entries in dir, which is created if it does
+// not exist.
+func NewDisk(dir string, opts Options) (Cache, error) {
+	return newDisk(dir, opts)
+}
+
+func newDisk(dir string, opts Options) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Error creating cache dir: %v", err)
+	}
+	c := &diskCache{
+		dir:  dir,
+		opts: opts,
+		now:  time.Now,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.prune(opts.MaxBytes); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *diskCache) path(key Key) string {
+	return filepath.Join(c.dir, key.String())
+}
+
+func (c *diskCache) Get(key Key) ([]byte, bool, error) {
+	p := c.path(key)
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	now := c.now()
+	expiresAt, _, headerSize, ok := parseDiskHeader(data)
+	if !ok {
+		os.Remove(p)
+		return nil, false, fmt.Errorf("Corrupt cache entry %s", key)
+	}
+	if !now.Before(expiresAt) {
+		os.Remove(p)
+		return nil, false, nil
+	}
+	// Mark as recently used. Failure only affects eviction order.
+	os.Chtimes(p, now, now)
+	return data[headerSize:], true, nil
+}
+
+// parseDiskHeader parses the header at the start of data, returning false if
+// it is incomplete.
+func parseDiskHeader(data []byte) (expiresAt time.Time, fingerprint string, size int, ok bool) {
+	if len(data) < diskHeaderSize {
+		return time.Time{}, "", 0, false
+	}
+	size = diskHeaderSize + int(data[diskHeaderSize-1])
+	if len(data) < size {
+		return time.Time{}, "", 0, false
+	}
+	expiresAt = time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+	return expiresAt, string(data[diskHeaderSize:size]), size, true
+}
+
+func (c *diskCache) Add(key Key, fingerprint string, value []byte) error {
+	if len(fingerprint) > maxFingerprintLen {
+		return fmt.Errorf("Fingerprint too long: %d bytes", len(fingerprint))
+	}
+	size := int64(diskHeaderSize + len(fingerprint) + len(value))
+	if size > c.opts.MaxBytes {
+		return nil
+	}
+	now := c.now()
+	f, err := ioutil.TempFile(c.dir, diskTempPrefix)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, diskHeaderSize, size)
+	binary.BigEndian.PutUint64(data, uint64(now.Add(c.opts.TTL).UnixNano()))
+	data[diskHeaderSize-1] = byte(len(fingerprint))
+	data = append(append(data, fingerprint...), value...)
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(f.Name(), now, now)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The entry being replaced, if any, no longer counts.
+	p := c.path(key)
+	if info, err := os.Stat(p); err == nil {
+		c.size -= info.Size()
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	c.size += size
+	if c.size > c.opts.MaxBytes {
+		return c.prune(int64(float64(c.opts.MaxBytes) * diskPruneRatio))
+	}
+	return nil
+}
+
+func (c *diskCache) Flush(keep string) (int64, error) {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return 0, err
+	}
+	var deleted int64
+	header := make([]byte, diskHeaderSize+maxFingerprintLen)
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), diskTempPrefix) {
+			continue
+		}
+		p := filepath.Join(c.dir, info.Name())
+		f, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return deleted, err
+		}
+		n, _ := io.ReadFull(f, header)
+		f.Close()
+		// Corrupt entries are deleted too.
+		if _, fingerprint, _, ok := parseDiskHeader(header[:n]); ok && fingerprint == keep {
+			continue
+		}
+		if err := os.Remove(p); err == nil {
+			deleted++
+		} else if !os.IsNotExist(err) {
+			return deleted, err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return deleted, c.prune(c.opts.MaxBytes)
+}
+
+// prune removes expired entries, then removes the least recently used entries
+// until the total size is at most target. Must be called with mu held.
+func (c *diskCache) prune(target int64) error {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	now := c.now()
+	var entries []os.FileInfo
+	c.size = 0
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(info.Name(), diskTempPrefix) {
+			// Leftover from a crashed writer, or being written by another
+			// instance right now.
+			if now.Sub(info.ModTime()) > time.Hour {
+				os.Remove(filepath.Join(c.dir, info.Name()))
+			}
+			continue
+		}
+		// Entries unused for longer than the TTL have expired.
+		if now.Sub(info.ModTime()) >= c.opts.TTL {
+			os.Remove(filepath.Join(c.dir, info.Name()))
+			continue
+		}
+		entries = append(entries, info)
+		c.size += info.Size()
+	}
+	sort.Sort(byModTime(entries))
+	for _, info := range entries {
+		if c.size <= target {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.dir, info.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		c.size -= info.Size()
+	}
+	return nil
+}
+
+type byModTime []os.FileInfo
+
+func (s byModTime) Len() int           { return len(s) }
+func (s byModTime) Less(i, j int) bool { return s[i].ModTime().Before(s[j].ModTime()) }
+func (s byModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
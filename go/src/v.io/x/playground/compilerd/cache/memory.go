@@ -0,0 +1,106 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	key         Key
+	fingerprint string
+	value       []byte
+	expiresAt   time.Time
+}
+
+// memoryCache is an in-memory LRU cache.
+type memoryCache struct {
+	opts Options
+	// Returns the current time. Replaced in tests.
+	now func() time.Time
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List // of *memoryEntry, most recently used first
+	index map[Key]*list.Element
+}
+
+var _ Cache = (*memoryCache)(nil)
+
+// NewMemory returns a process-local cache.
+func NewMemory(opts Options) Cache {
+	return newMemory(opts)
+}
+
+func newMemory(opts Options) *memoryCache {
+	return &memoryCache{
+		opts:  opts,
+		now:   time.Now,
+		lru:   list.New(),
+		index: make(map[Key]*list.Element),
+	}
+}
+
+func (c *memoryCache) Get(key Key) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.index[key]
+	if !ok {
+		return nil, false, nil
+	}
+	e := el.Value.(*memoryEntry)
+	if !c.now().Before(e.expiresAt) {
+		c.remove(el)
+		return nil, false, nil
+	}
+	c.lru.MoveToFront(el)
+	return e.value, true, nil
+}
+
+func (c *memoryCache) Add(key Key, fingerprint string, value []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.index[key]; ok {
+		c.remove(el)
+	}
+	if int64(len(value)) > c.opts.MaxBytes {
+		return nil
+	}
+	c.index[key] = c.lru.PushFront(&memoryEntry{
+		key:         key,
+		fingerprint: fingerprint,
+		value:       value,
+		expiresAt:   c.now().Add(c.opts.TTL),
+	})
+	c.size += int64(len(value))
+	for c.size > c.opts.MaxBytes {
+		c.remove(c.lru.Back())
+	}
+	return nil
+}
+
+func (c *memoryCache) Flush(keep string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var deleted int64
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*memoryEntry).fingerprint != keep {
+			c.remove(el)
+			deleted++
+		}
+		el = next
+	}
+	return deleted, nil
+}
+
+// remove removes the entry from the cache. Must be called with mu held.
+func (c *memoryCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*memoryEntry)
+	delete(c.index, e.key)
+	c.size -= int64(len(e.value))
+}
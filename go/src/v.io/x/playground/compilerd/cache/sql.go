@@ -0,0 +1,87 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"v.io/x/playground/lib/log"
+	"v.io/x/playground/lib/storage"
+)
+
+// The SQL table is pruned in the background, at most this often.
+const sqlPruneInterval = time.Minute
+
+// sqlCache stores entries in the response_cache table. The table does not
+// track use, so the oldest entries are evicted first.
+type sqlCache struct {
+	opts Options
+
+	mu        sync.Mutex
+	pruning   bool
+	lastPrune time.Time
+}
+
+var _ Cache = (*sqlCache)(nil)
+
+// NewSQL returns a cache backed by the SQL database. storage.Connect must be
+// called before the cache is used.
+func NewSQL(opts Options) Cache {
+	return &sqlCache{opts: opts}
+}
+
+func (c *sqlCache) Get(key Key) ([]byte, bool, error) {
+	cr, err := storage.GetCachedResponse(key[:])
+	if err == storage.ErrNotFound {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return cr.Data, true, nil
+}
+
+func (c *sqlCache) Add(key Key, fingerprint string, value []byte) error {
+	if int64(len(value)) > c.opts.MaxBytes {
+		return nil
+	}
+	if err := storage.StoreCachedResponse(&storage.CachedResponse{
+		Hash:        key[:],
+		Fingerprint: fingerprint,
+		Data:        value,
+		ExpiresAt:   time.Now().Add(c.opts.TTL),
+	}); err != nil {
+		return err
+	}
+	c.maybePrune()
+	return nil
+}
+
+func (c *sqlCache) Flush(keep string) (int64, error) {
+	return storage.DeleteCachedResponsesExcept(keep)
+}
+
+// maybePrune starts pruning the table in the background, unless it was pruned
+// recently or is being pruned.
+func (c *sqlCache) maybePrune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pruning || time.Since(c.lastPrune) < sqlPruneInterval {
+		return
+	}
+	c.pruning = true
+	go func() {
+		deleted, err := storage.PruneCachedResponses(c.opts.MaxBytes)
+		if err != nil {
+			log.Warnf("Pruning response cache failed: %v", err)
+		} else if deleted > 0 {
+			log.Debugf("Pruned %d cached responses.", deleted)
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.pruning = false
+		c.lastPrune = time.Now()
+	}()
+}
@@ -0,0 +1,252 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Caching of compile responses.
+//
+// Responses are stored in a cache.Cache selected by flags, keyed by the hash
+// of the canonical encoding of the request bundle (see bundle.Canonical), so
+// that requests differing only in JSON formatting, file order and the like
+// share entries, and the fingerprint of the builder that produced them
+// (see event.Fingerprint). compilerd learns the fingerprint by probing builder
+// once at startup, so upgrading the builder image or toolchain (which requires
+// restarting compilerd) changes all cache keys. Responses are not cached until
+// the fingerprint is known. Entries for old fingerprints can be flushed using
+// the admin endpoint.
+//
+// Since caches can outlive compilerd and be shared between instances running
+// different versions, cachedResponse is stored in a versioned encoding.
+// Entries with an unknown version are treated as misses.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"v.io/x/playground/compilerd/cache"
+	"v.io/x/playground/compilerd/jobqueue"
+	"v.io/x/playground/lib/bundle"
+	"v.io/x/playground/lib/event"
+	"v.io/x/playground/lib/hash"
+	"v.io/x/playground/lib/log"
+	"v.io/x/playground/lib/metrics"
+)
+
+var (
+	cacheType     = flag.String("cache", "memory", "Where to cache responses: \"memory\" (per instance), \"disk\" (in --cache-dir, survives restarts) or \"sql\" (in the database configured by --sqlconf, shared by all instances).")
+	cacheDir      = flag.String("cache-dir", "", "Directory for --cache=disk.")
+	cacheMaxBytes = flag.Int64("cache-max-bytes", 1<<28, "Maximum total size of cached responses in bytes.")
+	cacheTTL      = flag.Duration("cache-ttl", 24*time.Hour, "Time after which cached responses expire.")
+
+	// Formatting can move code, so compiler errors in a cached response may
+	// refer to different lines and columns than the request.
+	// A cancelled job's response is cut short when the builder is killed, so
+	// it differs from the response to an identical request that runs to
+	// completion.
+	cachePartialResults = flag.Bool("cache-partial-results", false, "Whether to cache the partial response of a job cancelled while running, e.g. because the client disconnected, for identical requests.")
+
+	cacheKeyGofmt = flag.Bool("cache-key-gofmt", false, "Whether requests differing only in gofmt formatting of Go sources share cached responses.")
+
+	cacheLookups = metrics.NewCounter("playground_cache_lookups_total", "Number of cached response lookups, by result: hit, miss or error.", "result")
+)
+
+// cachedResponseVersion is the current version of the cachedResponse
+// encoding. It must be incremented whenever cachedResponse or event.Event
+// change in a way that older or newer instances sharing the cache would
+// misinterpret.
+const cachedResponseVersion = 1
+
+// cachedResponse is the type of values stored in the cache.
+type cachedResponse struct {
+	Status int
+	Events []event.Event
+}
+
+// encode encodes the response as the version byte followed by JSON.
+func (cr *cachedResponse) encode() ([]byte, error) {
+	js, err := json.Marshal(cr)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{cachedResponseVersion}, js...), nil
+}
+
+func decodeCachedResponse(data []byte) (*cachedResponse, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty cached response")
+	}
+	if data[0] != cachedResponseVersion {
+		return nil, fmt.Errorf("unsupported cached response version %d", data[0])
+	}
+	var cr cachedResponse
+	if err := json.Unmarshal(data[1:], &cr); err != nil {
+		return nil, err
+	}
+	return &cr, nil
+}
+
+// newCacheFromFlags returns the cache selected by flags.
+func newCacheFromFlags() (cache.Cache, error) {
+	opts := cache.Options{
+		MaxBytes: *cacheMaxBytes,
+		TTL:      *cacheTTL,
+	}
+	switch *cacheType {
+	case "memory":
+		return cache.NewMemory(opts), nil
+	case "disk":
+		if *cacheDir == "" {
+			return nil, fmt.Errorf("--cache=disk requires --cache-dir")
+		}
+		return cache.NewDisk(*cacheDir, opts)
+	case "sql":
+		if *sqlConf == "" {
+			return nil, fmt.Errorf("--cache=sql requires --sqlconf")
+		}
+		return cache.NewSQL(opts), nil
+	default:
+		return nil, fmt.Errorf("Unknown cache %q", *cacheType)
+	}
+}
+
+// canonicalRequest returns the canonical encoding of the request bundle. If
+// the request cannot be parsed, builder will reject it too, so the request
+// body is returned as is. It cannot collide with a canonical encoding, which
+// always parses.
+func canonicalRequest(requestBody []byte) []byte {
+	canonical, err := bundle.Canonical(requestBody, bundle.CanonicalOptions{Gofmt: *cacheKeyGofmt})
+	if err != nil {
+		log.Debugf("Error canonicalizing request, hashing it as is: %v", err)
+		return requestBody
+	}
+	return canonical
+}
+
+// cacheKey returns the cache key for a canonical request (see
+// canonicalRequest) handled by builders with the given fingerprint.
+func cacheKey(fingerprint string, canonicalRequest []byte) cache.Key {
+	return cache.Key(hash.Raw(append([]byte(fingerprint+"\x00"), canonicalRequest...)))
+}
+
+// fingerprintOf returns the ID of the builder fingerprint reported in the
+// events, or "" if there is none.
+func fingerprintOf(events []event.Event) string {
+	for _, e := range events {
+		if e.Fingerprint != nil {
+			return e.Fingerprint.ID()
+		}
+	}
+	return ""
+}
+
+// currentFingerprint returns the ID of the fingerprint most recently reported
+// by builder, or "" if none has been reported yet.
+func (c *compiler) currentFingerprint() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fingerprint
+}
+
+// updateFingerprint records the fingerprint reported by builder.
+func (c *compiler) updateFingerprint(fingerprint string) {
+	if fingerprint == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fingerprint != fingerprint {
+		log.Debugf("Builder fingerprint changed from %q to %q.", c.fingerprint, fingerprint)
+		c.fingerprint = fingerprint
+	}
+}
+
+// isProbeRequest returns true if the request body sets the builder's Probe
+// field. Builder only reports its fingerprint in response to such requests,
+// and bundle.Canonical drops the field, so they must not be accepted from
+// clients. Like encoding/json, which builder decodes requests with, keys are
+// matched case-insensitively.
+func isProbeRequest(requestBody []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(requestBody, &fields); err != nil {
+		return false
+	}
+	for name := range fields {
+		if strings.EqualFold(name, "Probe") {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay between attempts to probe the builder fingerprint.
+const probeRetryDelay = 10 * time.Second
+
+// probeFingerprint runs builder on a probe request to learn its fingerprint,
+// retrying until it succeeds or the dispatcher is stopped.
+func (c *compiler) probeFingerprint() {
+	for !c.tryProbeFingerprint() {
+		time.Sleep(probeRetryDelay)
+	}
+}
+
+// tryProbeFingerprint probes the builder fingerprint once. Returns false if
+// the probe should be retried.
+func (c *compiler) tryProbeFingerprint() bool {
+	res := event.NewResponseEventSink(ioutil.Discard, false)
+	job := jobqueue.NewJob([]byte(`{"Files": [], "Probe": true}`), res, *maxSize, *maxTime, c.newRunner)
+	resultChan, err := c.dispatcher.Enqueue(job)
+	if err == jobqueue.ErrStopped {
+		return true
+	} else if err != nil {
+		log.Warnf("Error probing builder fingerprint: %v", err)
+		return false
+	}
+	result := <-resultChan
+	fingerprint := fingerprintOf(result.Events)
+	if fingerprint == "" {
+		log.Warn("Builder did not report a fingerprint.")
+		return false
+	}
+	c.updateFingerprint(fingerprint)
+	return true
+}
+
+// getCachedResponse returns the response cached under key, if any. Cache
+// errors are logged and treated as misses.
+func (c *compiler) getCachedResponse(key cache.Key) (*cachedResponse, bool) {
+	data, ok, err := c.cache.Get(key)
+	if err != nil {
+		log.Warnf("Error reading cached response %v: %v", key, err)
+		cacheLookups.Inc("error")
+		return nil, false
+	}
+	if !ok {
+		cacheLookups.Inc("miss")
+		return nil, false
+	}
+	cr, err := decodeCachedResponse(data)
+	if err != nil {
+		log.Warnf("Ignoring cached response %v: %v", key, err)
+		cacheLookups.Inc("error")
+		return nil, false
+	}
+	cacheLookups.Inc("hit")
+	return cr, true
+}
+
+// addCachedResponse caches the response under key, tagged with the builder
+// fingerprint. Cache errors are logged.
+func (c *compiler) addCachedResponse(key cache.Key, fingerprint string, cr *cachedResponse) {
+	data, err := cr.encode()
+	if err != nil {
+		log.Panicf("Error encoding cached response: %v", err)
+	}
+	if err := c.cache.Add(key, fingerprint, data); err != nil {
+		log.Warnf("Error caching response %v: %v", key, err)
+	}
+}
@@ -6,33 +6,32 @@
 //
 // handlerCompile() handles a POST request with bundled example source code.
 // The bundle is passed to the builder command, which is run inside a Docker
-// sandbox. Builder output is streamed back to the client in realtime and
-// cached.
+// container or another sandbox (see jobqueue.Runner). Builder output is
+// streamed back to the client in realtime and cached (see
+// cached_response.go).
 
 package main
 
 import (
 	"flag"
+	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/golang/groupcache/lru"
-
+	"v.io/x/playground/compilerd/cache"
+	"v.io/x/playground/compilerd/fakebuilder"
 	"v.io/x/playground/compilerd/jobqueue"
 	"v.io/x/playground/lib"
 	"v.io/x/playground/lib/event"
-	"v.io/x/playground/lib/hash"
 	"v.io/x/playground/lib/log"
 )
 
 var (
-	// In-memory LRU cache of request/response bodies. Keys are sha256 sums of
-	// request bodies (32 bytes each), values are of type cachedResponse.
-	// NOTE(nlacasse): The cache size (10k) was chosen arbitrarily and should
-	// perhaps be optimized.
-	cache = lru.New(10000)
+	runner = flag.String("runner", "docker", "How to run builder: \"docker\", \"sandbox\" (native Linux sandbox using namespaces, a read-only root file system, rlimits, a pids cgroup and seccomp), \"direct\" (no isolation, for development only) or \"fake\" (replays --fake-builder-script instead of running builder, for development only).")
 
-	useDocker = flag.Bool("use-docker", true, "Whether to use Docker to run builder; if false, we run the builder directly.")
+	fakeBuilderScript = flag.String("fake-builder-script", "", "Fake builder script to replay when --runner=fake. See package fakebuilder for the format.")
 
 	// TODO(nlacasse): Experiment with different values for parallelism and
 	// dockerMemLimit once we have performance testing.
@@ -40,9 +39,21 @@ var (
 	// docker daemon. The GCE n1-standard machines have 3.75GB of RAM, so the
 	// default value below should leave plenty of room.
 	parallelism    = flag.Int("parallelism", 5, "Maximum number of builds to run in parallel.")
-	dockerMemLimit = flag.Int("total-docker-memory", 5000, "Total memory limit for all Docker build instances in MB.")
+	dockerMemLimit = flag.Int("total-docker-memory", 5000, "Total memory limit for all Docker or sandbox build instances in MB.")
+
+	// See jobqueue/docker_pool.go.
+	dockerPoolSize             = flag.Int("docker-pool-size", 2, "Number of Docker containers to create ahead of jobs, to reduce job startup time. Pooled containers are only started by jobs, so they do not count against --total-docker-memory while idle. A value of 0 disables the pool.")
+	dockerCleanupQueueCapacity = flag.Int("docker-cleanup-queue-capacity", 100, "Maximum number of finished Docker containers waiting to be removed. Containers finishing while the queue is full are removed at the next startup.")
+	dockerCleanupWorkers       = flag.Int("docker-cleanup-workers", 3, "Number of workers removing finished Docker containers.")
+	dockerCleanupRetries       = flag.Int("docker-cleanup-retries", 3, "Number of times to retry removing a Docker container.")
+
+	// See jobqueue/sandbox_linux.go.
+	sandboxToolchain  = flag.String("sandbox-toolchain", "", "Comma-separated host directories containing the Go and Vanadium toolchains and builder, mounted read-only in the native sandbox. They must not contain secrets. Defaults to GOROOT, $JIRI_ROOT/.jiri_root/bin, $JIRI_ROOT/release/go/{bin,pkg,src} and the directory of builder. Never pass all of $JIRI_ROOT, which contains the playground SQL configs.")
+	sandboxPidsCgroup = flag.String("sandbox-pids-cgroup", "/sys/fs/cgroup/pids/playground", "Pids cgroup directory, writable by compilerd, in which each native sandbox gets a cgroup limiting its number of processes.")
+	sandboxMaxProcs   = flag.Int("sandbox-max-procs", 256, "Maximum number of processes in a native sandbox.")
 
-	// Arbitrary deadline (enough to compile, run, shutdown).
+	// Arbitrary deadline (enough to compile, run, shutdown). Must exceed the
+	// sum of the builder phase time limits.
 	// TODO(sadovsky): For now this is set high to avoid spurious timeouts.
 	// Playground execution speed needs to be optimized.
 	maxTime = flag.Duration("max-time", 60*time.Second, "Maximum time for build to run.")
@@ -50,24 +61,118 @@ var (
 	// TODO(nlacasse): The default value of 100 was chosen arbitrarily and
 	// should be tuned.
 	jobQueueCap = flag.Int("job-queue-capacity", 100, "Maximum number of jobs to allow in the job queue. Attempting to add a new job will fail if the queue is full.")
-)
 
-// cachedResponse is the type of values stored in the lru cache.
-type cachedResponse struct {
-	Status int
-	Events []event.Event
-}
+	// Used to tell clients when to retry if the job queue is full.
+	// TODO(ivanpi): Measure instead of estimating.
+	jobTimeEstimate = flag.Duration("job-time-estimate", 5*time.Second, "Estimated average time to run a job, used to compute Retry-After when the job queue is full, and to estimate the wait of queued jobs until jobs have finished.")
+
+	queueStatusInterval = flag.Duration("queue-status-interval", 2*time.Second, "Interval at which clients of queued jobs are sent their queue position and estimated wait. A value of 0 disables these events.")
+
+	scheduler = flag.String("scheduler", "fair", "Order in which queued jobs are run: \"fifo\" (in the order they were queued) or \"fair\" (low priority jobs last, taking turns between clients otherwise).")
+
+	coalesceJobs = flag.Bool("coalesce-jobs", true, "Whether concurrent requests with the same cache key share a single job instead of each running the bundle.")
+)
 
 // compiler handles compile requests by enqueuing them on the dispatcher's
 // work queue.
 type compiler struct {
 	dispatcher jobqueue.Dispatcher
+	newRunner  jobqueue.RunnerFactory
+	// Releases resources held by the runners, e.g. pooled Docker containers,
+	// once all jobs have finished. May be nil.
+	closeRunners func()
+	// Cache of responses, see cached_response.go.
+	cache cache.Cache
+	// If nil, requests are not rate limited.
+	limiter *rateLimiter
+
+	mu sync.Mutex
+	// ID of the builder fingerprint, see cached_response.go.
+	fingerprint string
+
+	jobsMu sync.Mutex
+	// Jobs submitted through the job API by ID, see jobs.go.
+	jobs map[string]*asyncJob
 }
 
 // newCompiler creates a new compiler.
-func newCompiler() *compiler {
+func newCompiler() (*compiler, error) {
+	newRunner, closeRunners, err := newRunnerFactory()
+	if err != nil {
+		return nil, err
+	}
+	limiter, err := newRateLimiterFromFlags()
+	if err != nil {
+		return nil, err
+	}
+	responseCache, err := newCacheFromFlags()
+	if err != nil {
+		return nil, err
+	}
+	s, err := jobqueue.NewScheduler(*scheduler)
+	if err != nil {
+		return nil, err
+	}
+	dispatcher := jobqueue.NewDispatcherFromConfig(jobqueue.DispatcherConfig{
+		Workers:         *parallelism,
+		QueueCap:        *jobQueueCap,
+		Scheduler:       s,
+		StatusInterval:  *queueStatusInterval,
+		JobTimeEstimate: *jobTimeEstimate,
+	})
+	if *coalesceJobs {
+		dispatcher = jobqueue.NewCoalescingDispatcher(dispatcher)
+	}
 	return &compiler{
-		dispatcher: jobqueue.NewDispatcher(*parallelism, *jobQueueCap),
+		dispatcher:   dispatcher,
+		newRunner:    newRunner,
+		closeRunners: closeRunners,
+		cache:        responseCache,
+		limiter:      limiter,
+	}, nil
+}
+
+// newRunnerFactory returns the builder RunnerFactory selected by flags, and a
+// function releasing its resources once all jobs have finished, if any.
+func newRunnerFactory() (jobqueue.RunnerFactory, func(), error) {
+	// Calculate memory limit for each builder instance.
+	memLimit := *dockerMemLimit
+	if *parallelism > 0 {
+		memLimit /= *parallelism
+	}
+
+	switch *runner {
+	case "docker":
+		newRunner, closeRunners := jobqueue.NewDockerRunnerFactoryFromConfig(jobqueue.DockerConfig{
+			MemoryMB:        memLimit,
+			PoolSize:        *dockerPoolSize,
+			CleanupQueueCap: *dockerCleanupQueueCapacity,
+			CleanupWorkers:  *dockerCleanupWorkers,
+			CleanupRetries:  *dockerCleanupRetries,
+		})
+		return newRunner, closeRunners, nil
+	case "sandbox":
+		var toolchain []string
+		if *sandboxToolchain != "" {
+			toolchain = strings.Split(*sandboxToolchain, ",")
+		}
+		return jobqueue.NewSandboxRunnerFactory(jobqueue.SandboxConfig{
+			MemoryMB:   memLimit,
+			MaxTime:    *maxTime,
+			Toolchain:  toolchain,
+			PidsCgroup: *sandboxPidsCgroup,
+			MaxProcs:   *sandboxMaxProcs,
+		}), nil, nil
+	case "direct":
+		return jobqueue.NewDirectRunnerFactory(), nil, nil
+	case "fake":
+		script, err := fakebuilder.LoadFile(*fakeBuilderScript)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error loading fake builder script: %v", err)
+		}
+		return jobqueue.NewFakeRunnerFactory(script.Run), nil, nil
+	default:
+		return nil, nil, fmt.Errorf("Unknown runner %q", *runner)
 	}
 }
 
@@ -91,15 +196,15 @@ func (c *compiler) handlerCompile(w http.ResponseWriter, r *http.Request) {
 	// sensitive information, so guarding with a query parameter is sufficient.
 	wantDebug := r.FormValue("debug") == "1"
 
+	// The job may send the response status before it finishes, see below.
+	rw := &responseWriter{ResponseWriter: w}
+	newResponse := func() *event.ResponseEventSink {
+		return newResponseSink(rw, wantDebug)
+	}
 	openResponse := func(status int) *event.ResponseEventSink {
-		w.Header().Add("Content-Type", "application/json")
-		// No Content-Length, using chunked encoding.
-		w.WriteHeader(status)
-		// The response is hard limited to 2*maxSize: maxSize for builder stdout,
-		// and another maxSize for compilerd error and status messages.
-		return event.NewResponseEventSink(lib.NewLimitedWriter(w, 2*(*maxSize), lib.DoOnce(func() {
-			log.Error("Hard response size limit reached.")
-		})), !wantDebug)
+		res := newResponse()
+		rw.WriteHeader(status)
+		return res
 	}
 
 	if len(requestBody) > *maxSize {
@@ -108,39 +213,48 @@ func (c *compiler) handlerCompile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if isProbeRequest(requestBody) {
+		res := openResponse(http.StatusBadRequest)
+		res.Write(event.New("", "stderr", "Probe requests are not allowed."))
+		return
+	}
+
 	log.Debug("Got valid compile request.")
 
-	// Hash the body and see if it's been cached. If so, return the cached
-	// response status and body.
+	// Hash the canonical request and see if it's been cached for the current
+	// builder. If so, return the cached response status and body.
 	// NOTE(sadovsky): In the client we may shift timestamps (based on current
 	// time) and introduce a fake delay.
-	requestBodyHash := hash.Raw(requestBody)
-	if cr, ok := cache.Get(requestBodyHash); ok {
-		if cachedResponseStruct, ok := cr.(cachedResponse); ok {
-			res := openResponse(cachedResponseStruct.Status)
-			event.Debug(res, "Sending cached response")
-			log.Debug("Sending cached response.")
-			res.Write(cachedResponseStruct.Events...)
-			return
-		} else {
-			log.Panicf("Invalid cached response: %v", cr)
-		}
+	canonical := canonicalRequest(requestBody)
+	key := cacheKey(c.currentFingerprint(), canonical)
+	if cr, ok := c.getCachedResponse(key); ok {
+		res := openResponse(cr.Status)
+		event.Debug(res, "Sending cached response")
+		log.Debug("Sending cached response.")
+		res.Write(cr.Events...)
+		return
 	}
 
-	res := openResponse(http.StatusOK)
-
-	// Calculate memory limit for the docker instance running this job.
-	dockerMem := *dockerMemLimit
-	if *parallelism > 0 {
-		dockerMem /= *parallelism
+	// Only requests that need to run a job count against the client's rate
+	// limit.
+	if !c.admitJob(rw, r, openResponse) {
+		return
 	}
 
-	// Create a new compile job and queue it.
-	job := jobqueue.NewJob(requestBody, res, *maxSize, *maxTime, *useDocker, dockerMem)
+	// The response status is not sent until the job is queued, since queuing
+	// can fail. Once queued, the job writes events to the response, including
+	// "queue" events while it waits for a worker, which implicitly sends a 200
+	// status.
+	res := newResponse()
+
+	// Create a new compile job and queue it. Concurrent requests missing the
+	// cache for the same key may share the job, see --coalesce-jobs.
+	job := jobqueue.NewJob(requestBody, res, *maxSize, *maxTime, c.newRunner)
+	job.SetKey(key.String())
+	c.scheduleJob(job, r)
 	resultChan, err := c.dispatcher.Enqueue(job)
 	if err != nil {
-		// TODO(nlacasse): This should send a StatusServiceUnavailable, not a StatusOK.
-		res.Write(event.New("", "stderr", "Service busy. Please try again later."))
+		rejectJob(rw, res, err)
 		return
 	}
 
@@ -159,29 +273,233 @@ func (c *compiler) handlerCompile(w http.ResponseWriter, r *http.Request) {
 		select {
 		case <-clientDisconnect:
 			// If the client disconnects before job finishes, cancel the job.
-			// If job has already started, the job will finish and the results
-			// will be cached.
+			// If job has already started, it is killed, and the partial results
+			// are cached if --cache-partial-results is set.
 			log.Debug("Client disconnected. Cancelling job.")
 			job.Cancel()
 		case result := <-resultChan:
-			if result.Success {
-				event.Debug(res, "Caching response")
-				log.Debug("Caching response.")
-				cache.Add(requestBodyHash, cachedResponse{
-					Status: http.StatusOK,
-					Events: result.Events,
-				})
-			} else {
-				event.Debug(res, "Internal errors encountered, not caching response.")
-				log.Warn("Internal errors encountered, not caching response.")
+			if result.Outcome == jobqueue.OutcomeStopped && !result.Partial {
+				// The job never ran, so the client can be told to retry as if the
+				// queue had been full. If queue events were sent, the status has
+				// been sent too, so only the retry event can be. The same goes for
+				// requests sharing the job, which get its queue events.
+				if rw.statusSent() {
+					log.Warn("Failed running job: ", jobqueue.ErrStopped)
+					res.Write(shutdownRetryEvent())
+				} else {
+					rejectJob(rw, res, jobqueue.ErrStopped)
+				}
+				return
 			}
+			c.finishJob(res, canonical, result)
 			return
 		}
 	}
 }
 
-// stop waits for any in-progress jobs to finish, and cancels any jobs that
-// have not started running yet.
+// responseWriter records whether the response status has been sent, which
+// happens on the first write or flush if WriteHeader is not called first.
+type responseWriter struct {
+	http.ResponseWriter
+
+	mu   sync.Mutex
+	sent bool
+}
+
+var _ http.Flusher = (*responseWriter)(nil)
+
+func (w *responseWriter) setSent() {
+	w.mu.Lock()
+	w.sent = true
+	w.mu.Unlock()
+}
+
+func (w *responseWriter) statusSent() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.sent
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	w.setSent()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.setSent()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *responseWriter) Flush() {
+	w.setSent()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// newResponseSink returns a sink for response events. The status is sent with
+// the first event, defaulting to 200 if WriteHeader is not called first.
+func newResponseSink(w http.ResponseWriter, wantDebug bool) *event.ResponseEventSink {
+	w.Header().Add("Content-Type", "application/json")
+	// No Content-Length, using chunked encoding.
+	// The response is hard limited to 2*maxSize: maxSize for builder stdout,
+	// and another maxSize for compilerd error and status messages.
+	return event.NewResponseEventSink(lib.NewLimitedWriter(w, 2*(*maxSize), lib.DoOnce(func() {
+		log.Error("Hard response size limit reached.")
+	})), !wantDebug)
+}
+
+// scheduleJob sets the client and priority used to schedule the job for the
+// request. Clients are identified as for rate limiting. Requests with
+// priority=low, e.g. cache warm-ups, only run when no other jobs are waiting.
+func (c *compiler) scheduleJob(job *jobqueue.Job, r *http.Request) {
+	job.SetClient(c.clientKey(r))
+	if r.FormValue("priority") == "low" {
+		job.SetPriority(jobqueue.PriorityLow)
+	}
+}
+
+// admitJob checks the rate limit of the client requesting a job. If the
+// client is over the limit, it sends a 429 response using openResponse and
+// returns false.
+func (c *compiler) admitJob(w http.ResponseWriter, r *http.Request, openResponse func(status int) *event.ResponseEventSink) bool {
+	if c.limiter == nil {
+		return true
+	}
+	ok, wait := c.limiter.admit(r)
+	if !ok {
+		log.Debug("Client rate limit exceeded.")
+		w.Header().Set("Retry-After", retryAfter(wait))
+		res := openResponse(http.StatusTooManyRequests)
+		res.Write(event.New("", "stderr", "Too many requests. Please try again later."))
+	}
+	return ok
+}
+
+// rejectJob sends a 503 response for a job that could not be queued, given
+// the error returned by Enqueue, or jobqueue.ErrStopped for a job rejected by
+// the dispatcher because it was stopped.
+func rejectJob(w http.ResponseWriter, res event.Sink, err error) {
+	log.Warn("Failed queuing job: ", err)
+	if err == jobqueue.ErrStopped {
+		// Other instances can run the job right away.
+		w.Header().Set("Retry-After", retryAfter(0))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		res.Write(shutdownRetryEvent())
+		return
+	}
+	w.Header().Set("Retry-After", retryAfter(queueWait(err)))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	res.Write(event.New("", "stderr", "Service busy. Please try again later."))
+}
+
+// shutdownRetryEvent returns the "retry" event sent for jobs that were not
+// run, or killed, because compilerd is shutting down.
+func shutdownRetryEvent() event.Event {
+	return event.NewRetry("Server shutting down. Please retry.")
+}
+
+// writeStatus sends the final status event of a finished job to res,
+// preceded by a "retry" event if the job was stopped by compilerd shutting
+// down. It returns the status event.
+func writeStatus(res event.Sink, result jobqueue.Result) event.Event {
+	if result.Outcome == jobqueue.OutcomeStopped {
+		res.Write(shutdownRetryEvent())
+	}
+	status := result.StatusEvent()
+	res.Write(status)
+	return status
+}
+
+// finishJob sends the final status event of a finished job to res, and
+// caches the response.
+func (c *compiler) finishJob(res event.Sink, canonical []byte, result jobqueue.Result) {
+	status := writeStatus(res, result)
+	// The status is cached with the response, so that cached responses end
+	// with it too.
+	if result.Events != nil {
+		result.Events = append(result.Events, status)
+	}
+	c.cacheResult(res, canonical, result)
+}
+
+// cacheResult caches the response of a successful job under the canonical
+// request, and reports whether it was cached to res as a debug event. The
+// partial response of a cancelled job is only cached if
+// --cache-partial-results is set.
+func (c *compiler) cacheResult(res event.Sink, canonical []byte, result jobqueue.Result) {
+	switch {
+	case result.Success():
+	case result.Outcome == jobqueue.OutcomeStopped:
+		// The client is told to retry, and must not get the partial response.
+		event.Debug(res, "Job stopped, not caching response.")
+		log.Debug("Job stopped, not caching response.")
+		return
+	case result.Partial && *cachePartialResults:
+	case result.Partial:
+		event.Debug(res, "Job cancelled, not caching partial response.")
+		log.Debug("Job cancelled, not caching partial response.")
+		return
+	case result.Outcome == jobqueue.OutcomeTimedOut || result.Outcome == jobqueue.OutcomeErrored:
+		event.Debug(res, "Internal errors encountered, not caching response.")
+		log.Warn("Internal errors encountered, not caching response.")
+		return
+	default:
+		msg := fmt.Sprintf("Job %v, not caching response.", result.Outcome)
+		event.Debug(res, msg)
+		log.Debug(msg)
+		return
+	}
+	fingerprint := c.currentFingerprint()
+	if fingerprint == "" {
+		event.Debug(res, "Builder fingerprint not known yet, not caching response.")
+		log.Debug("Builder fingerprint not known yet, not caching response.")
+		return
+	}
+	events := cacheableEvents(result.Events)
+	event.Debug(res, "Caching response")
+	log.Debug("Caching response.")
+	c.addCachedResponse(cacheKey(fingerprint, canonical), fingerprint, &cachedResponse{
+		Status: http.StatusOK,
+		Events: events,
+	})
+}
+
+// cacheableEvents returns the events of a response without "queue" events,
+// which describe the wait of a particular request rather than the response.
+func cacheableEvents(events []event.Event) []event.Event {
+	var res []event.Event
+	for _, e := range events {
+		if e.Stream != "queue" {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// queueWait estimates how long it will take for the job queue to have room,
+// given the error returned by Enqueue.
+func queueWait(err error) time.Duration {
+	qfe, ok := err.(*jobqueue.QueueFullError)
+	if !ok || qfe.Workers <= 0 {
+		return *jobTimeEstimate
+	}
+	// The queue has room once a worker takes the first queued job, but
+	// retrying clients compete for it, so spread retries over the time needed
+	// to run the whole backlog.
+	rounds := (qfe.Queued + qfe.Workers - 1) / qfe.Workers
+	if rounds < 1 {
+		rounds = 1
+	}
+	return time.Duration(rounds) * *jobTimeEstimate
+}
+
+// stop rejects new jobs, and runs the queued jobs for up to --drain-timeout.
+// Jobs left at the timeout are stopped, and their clients told to retry.
+// Resources held by the runners are then released.
 func (c *compiler) stop() {
-	c.dispatcher.Stop()
+	c.dispatcher.Drain(*drainTimeout)
+	if c.closeRunners != nil {
+		c.closeRunners()
+	}
 }
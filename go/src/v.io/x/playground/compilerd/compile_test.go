@@ -6,26 +6,41 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"v.io/x/playground/compilerd/cache"
+	"v.io/x/playground/compilerd/fakebuilder"
 	"v.io/x/playground/compilerd/jobqueue"
 	"v.io/x/playground/lib/event"
-	"v.io/x/playground/lib/hash"
+	"v.io/x/playground/lib/metrics"
 )
 
 // mockDispatcher implements the jobqueue.Dispatcher interface.
 type mockDispatcher struct {
 	jobs        []*jobqueue.Job
 	sendSuccess bool
+	// If set, results are partial, as if the job was cancelled while running.
+	sendPartial bool
+	// If set, overrides the outcome of results.
+	outcome jobqueue.Outcome
+	// If set, Enqueue fails as if the queue contained this many jobs.
+	queueFull int
 }
 
 // Enqueue responds to every job after 100ms. The only event message will
 // contain the job body. The result will be a success if "sendSuccess" is true.
 func (d *mockDispatcher) Enqueue(j *jobqueue.Job) (chan jobqueue.Result, error) {
+	if d.queueFull > 0 {
+		return nil, &jobqueue.QueueFullError{Queued: d.queueFull, Workers: 2}
+	}
 	d.jobs = append(d.jobs, j)
 
 	e := event.Event{
@@ -33,9 +48,18 @@ func (d *mockDispatcher) Enqueue(j *jobqueue.Job) (chan jobqueue.Result, error)
 	}
 
 	result := jobqueue.Result{
-		Success: d.sendSuccess,
+		Outcome: jobqueue.OutcomeErrored,
+		Partial: d.sendPartial,
 		Events:  []event.Event{e},
 	}
+	if d.sendSuccess {
+		result.Outcome = jobqueue.OutcomeSuccess
+	} else if d.sendPartial {
+		result.Outcome = jobqueue.OutcomeCancelled
+	}
+	if d.outcome != 0 {
+		result.Outcome = d.outcome
+	}
 
 	resultChan := make(chan jobqueue.Result)
 
@@ -50,8 +74,22 @@ func (d *mockDispatcher) Enqueue(j *jobqueue.Job) (chan jobqueue.Result, error)
 func (d *mockDispatcher) Stop() {
 }
 
+func (d *mockDispatcher) Drain(timeout time.Duration) {
+}
+
+func (d *mockDispatcher) Stats() jobqueue.Stats {
+	return jobqueue.Stats{}
+}
+
+func (d *mockDispatcher) Resize(n int) {
+}
+
 var _ = jobqueue.Dispatcher((*mockDispatcher)(nil))
 
+func newTestCache() cache.Cache {
+	return cache.NewMemory(cache.Options{MaxBytes: 1 << 20, TTL: time.Hour})
+}
+
 func sendCompileRequest(c *compiler, method string, body io.Reader) *httptest.ResponseRecorder {
 	path := "/compile"
 	req, err := http.NewRequest(method, path, body)
@@ -98,16 +136,18 @@ func TestSuccessResultsAreCached(t *testing.T) {
 		sendSuccess: true,
 	}
 	c := &compiler{
-		dispatcher: dispatcher,
+		dispatcher:  dispatcher,
+		cache:       newTestCache(),
+		fingerprint: testFingerprint,
 	}
 
 	bodyString := "foobar"
 	body := bytes.NewBufferString(bodyString)
 	bodyBytes := body.Bytes()
-	requestBodyHash := hash.Raw(bodyBytes)
+	requestBodyHash := cacheKey(testFingerprint, bodyBytes)
 
 	// Check that body is not already in cache.
-	if _, ok := cache.Get(requestBodyHash); ok {
+	if _, ok := c.getCachedResponse(requestBodyHash); ok {
 		t.Errorf("Expected request body not to be in cache, but it was.")
 	}
 
@@ -122,17 +162,17 @@ func TestSuccessResultsAreCached(t *testing.T) {
 	}
 
 	// Check that body is now in the cache.
-	if cr, ok := cache.Get(requestBodyHash); !ok {
+	if cr, ok := c.getCachedResponse(requestBodyHash); !ok {
 		t.Errorf("Expected request body to be in cache, but it was not.")
 	} else {
-		cachedResponseStruct := cr.(cachedResponse)
+		cachedResponseStruct := cr
 		if cachedResponseStruct.Status != http.StatusOK {
 			t.Errorf("Expected cached result status to be %v but got %v", http.StatusOK, cachedResponseStruct.Status)
 		}
 		want := string(bodyBytes)
-		if len(cachedResponseStruct.Events) != 1 || cachedResponseStruct.Events[0].Message != want {
-			t.Errorf("Expected cached result body to contain single event with message %v but got %v", want, cachedResponseStruct.Events)
-
+		// The job's event is followed by the status event.
+		if events := cachedResponseStruct.Events; len(events) != 2 || events[0].Message != want || events[1].Stream != "status" {
+			t.Errorf("Expected cached result body to contain event with message %v and status event but got %v", want, events)
 		}
 
 		// Check that the dispatcher did not queue the second request, since it was in the cache.
@@ -148,16 +188,18 @@ func TestErrorResultsAreNotCached(t *testing.T) {
 	}
 
 	c := &compiler{
-		dispatcher: dispatcher,
+		dispatcher:  dispatcher,
+		cache:       newTestCache(),
+		fingerprint: testFingerprint,
 	}
 
 	bodyString := "bazbar"
 	body := bytes.NewBufferString(bodyString)
 	bodyBytes := body.Bytes()
-	requestBodyHash := hash.Raw(bodyBytes)
+	requestBodyHash := cacheKey(testFingerprint, bodyBytes)
 
 	// Check that body is not already in cache.
-	if _, ok := cache.Get(requestBodyHash); ok {
+	if _, ok := c.getCachedResponse(requestBodyHash); ok {
 		t.Errorf("Expected request body not to be in cache, but it was.")
 	}
 
@@ -172,7 +214,553 @@ func TestErrorResultsAreNotCached(t *testing.T) {
 	}
 
 	// Check that body is still not in the cache.
-	if _, ok := cache.Get(requestBodyHash); ok {
+	if _, ok := c.getCachedResponse(requestBodyHash); ok {
 		t.Errorf("Expected request body not to be in cache, but it was.")
 	}
 }
+
+func TestPartialResultsAreCachedIfEnabled(t *testing.T) {
+	defer func(old bool) { *cachePartialResults = old }(*cachePartialResults)
+
+	for _, cachePartial := range []bool{false, true} {
+		*cachePartialResults = cachePartial
+		c := &compiler{
+			dispatcher:  &mockDispatcher{sendPartial: true},
+			cache:       newTestCache(),
+			fingerprint: testFingerprint,
+		}
+
+		body := []byte(`{"files": [{"name": "a.go", "body": "package a"}]}`)
+		sendCompileRequest(c, "POST", bytes.NewBuffer(body))
+		if _, ok := c.getCachedResponse(cacheKey(testFingerprint, canonicalRequest(body))); ok != cachePartial {
+			t.Errorf("With --cache-partial-results=%v, expected partial response cached to be %v, but got %v", cachePartial, cachePartial, ok)
+		}
+	}
+}
+
+func TestEquivalentRequestsShareCachedResponse(t *testing.T) {
+	dispatcher := &mockDispatcher{
+		sendSuccess: true,
+	}
+	c := &compiler{
+		dispatcher:  dispatcher,
+		cache:       newTestCache(),
+		fingerprint: testFingerprint,
+	}
+
+	first := `{"files": [{"name": "a.go", "body": "package a\n"}, {"name": "b.go", "body": "package b"}]}`
+	equivalent := []string{
+		`{"Files":[{"Body":"package b\n\n","Name":"b.go"},{"name":"a.go","body":"package a","unknown":1}]}`,
+		"{\n  \"files\": [\n    {\"name\": \"a.go\", \"body\": \"package a\"},\n    {\"name\": \"b.go\", \"body\": \"package b\"}\n  ]\n}\n",
+	}
+
+	sendCompileRequest(c, "POST", bytes.NewBufferString(first))
+	for _, body := range equivalent {
+		w := sendCompileRequest(c, "POST", bytes.NewBufferString(body))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected POST with body %v to result in status %v but got %v", body, http.StatusOK, w.Code)
+		}
+	}
+	if len(dispatcher.jobs) != 1 {
+		t.Errorf("Expected equivalent requests to be served from the cache, but %v jobs were queued", len(dispatcher.jobs))
+	}
+
+	different := `{"files": [{"name": "a.go", "body": "package a"}, {"name": "b.go", "body": "package b", "args": ["-v"]}]}`
+	sendCompileRequest(c, "POST", bytes.NewBufferString(different))
+	if len(dispatcher.jobs) != 2 {
+		t.Errorf("Expected a different request to be queued, but %v jobs were queued", len(dispatcher.jobs))
+	}
+}
+
+func TestStoppedJobIsServiceUnavailable(t *testing.T) {
+	c := &compiler{
+		dispatcher:  &mockDispatcher{outcome: jobqueue.OutcomeStopped},
+		cache:       newTestCache(),
+		fingerprint: testFingerprint,
+	}
+
+	w := sendCompileRequest(c, "POST", bytes.NewBufferString("stopped"))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected job rejected by a stopped dispatcher to result in status %v but got %v", http.StatusServiceUnavailable, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected Retry-After header to be set.")
+	}
+	if events := responseEvents(t, w); len(events) != 1 || events[0].Stream != "retry" {
+		t.Errorf("Expected a single retry event, got %#v", events)
+	}
+}
+
+func TestStoppedJobAfterQueueEvents(t *testing.T) {
+	// Stop waits for the running job, which hangs until it times out.
+	defer func(old time.Duration) { *maxTime = old }(*maxTime)
+	*maxTime = time.Second
+	c := newFakeCompiler(t, "hang.json")
+	c.dispatcher = jobqueue.NewCoalescingDispatcher(jobqueue.NewDispatcherFromConfig(jobqueue.DispatcherConfig{Workers: 1, QueueCap: 1, StatusInterval: 10 * time.Millisecond}))
+
+	// The first job hangs, occupying the only worker. The second one waits
+	// in the queue, shared by two requests, until the dispatcher is stopped.
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 3)
+	for i, body := range []string{"fake hang", "fake queued", "fake queued"} {
+		wg.Add(1)
+		go func(i int, body string) {
+			defer wg.Done()
+			responses[i] = sendCompileRequest(c, "POST", bytes.NewBufferString(`{"files": [{"name": "src/main/main.go", "body": "`+body+`"}]}`))
+		}(i, body)
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	c.dispatcher.Stop()
+	wg.Wait()
+
+	for _, w := range responses[1:] {
+		// The status was sent with the first queue event, so it is too late
+		// to change it or set headers.
+		if w.Code != http.StatusOK || w.Header().Get("Retry-After") != "" {
+			t.Errorf("Expected status %v without Retry-After, got %v, %v", http.StatusOK, w.Code, w.Header())
+		}
+		events := responseEvents(t, w)
+		if len(events) < 2 || events[0].Stream != "queue" || events[len(events)-1].Stream != "retry" {
+			t.Errorf("Expected queue events followed by a retry event, got %#v", events)
+		}
+	}
+}
+
+func TestDrainAfterQueueEvents(t *testing.T) {
+	defer func(old time.Duration) { *drainTimeout = old }(*drainTimeout)
+	*drainTimeout = 100 * time.Millisecond
+	c := newFakeCompiler(t, "hang.json")
+	c.dispatcher = jobqueue.NewCoalescingDispatcher(jobqueue.NewDispatcherFromConfig(jobqueue.DispatcherConfig{Workers: 1, QueueCap: 1, StatusInterval: 10 * time.Millisecond}))
+
+	// The first job hangs, so the second one is still queued when the drain
+	// times out.
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 2)
+	for i, body := range []string{"fake hang", "fake queued"} {
+		wg.Add(1)
+		go func(i int, body string) {
+			defer wg.Done()
+			responses[i] = sendCompileRequest(c, "POST", bytes.NewBufferString(`{"files": [{"name": "src/main/main.go", "body": "`+body+`"}]}`))
+		}(i, body)
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	c.stop()
+	wg.Wait()
+
+	// Both clients are told to retry, in 200 responses.
+	for i, w := range responses {
+		if w.Code != http.StatusOK || w.Header().Get("Retry-After") != "" {
+			t.Errorf("Expected job %d to get status %v without Retry-After, got %v, %v", i, http.StatusOK, w.Code, w.Header())
+		}
+	}
+	running := responseEvents(t, responses[0])
+	if len(running) < 2 || running[len(running)-2].Stream != "retry" || running[len(running)-1].Status == nil || running[len(running)-1].Status.Outcome != "stopped" {
+		t.Errorf("Expected running job to end with a retry event and stopped status, got %#v", running)
+	}
+	queued := responseEvents(t, responses[1])
+	if len(queued) < 2 || queued[0].Stream != "queue" || queued[len(queued)-1].Stream != "retry" {
+		t.Errorf("Expected queued job to get queue events followed by a retry event, got %#v", queued)
+	}
+}
+
+func TestStoppedRunningJobIsRetried(t *testing.T) {
+	defer func(old bool) { *cachePartialResults = old }(*cachePartialResults)
+	*cachePartialResults = true
+	c := &compiler{
+		dispatcher:  &mockDispatcher{outcome: jobqueue.OutcomeStopped, sendPartial: true},
+		cache:       newTestCache(),
+		fingerprint: testFingerprint,
+	}
+
+	body := []byte(`{"files": [{"name": "a.go", "body": "package a"}]}`)
+	w := sendCompileRequest(c, "POST", bytes.NewBuffer(body))
+	events := responseEvents(t, w)
+	if len(events) < 2 || events[len(events)-2].Stream != "retry" || events[len(events)-1].Stream != "status" {
+		t.Errorf("Expected retry event followed by status event, got %#v", events)
+	}
+	// The retried request must not get the partial response.
+	if _, ok := c.getCachedResponse(cacheKey(testFingerprint, canonicalRequest(body))); ok {
+		t.Errorf("Expected partial response of stopped job not to be cached.")
+	}
+}
+
+func TestFinalStatusEvent(t *testing.T) {
+	c := newFakeCompiler(t, "hello.json")
+	defer c.stop()
+
+	w := sendCompileRequest(c, "POST", bytes.NewBufferString(`{"files": [{"name": "src/main/main.go", "body": "fake status"}]}`))
+	events := responseEvents(t, w)
+	if len(events) == 0 {
+		t.Fatalf("Expected events, got none")
+	}
+	last := events[len(events)-1]
+	if last.Stream != "status" || last.Status == nil || last.Status.Outcome != "success" {
+		t.Fatalf("Expected final success status event, got %#v", last)
+	}
+	if got, want := last.Status.OutputBytes, len("PROGRAM START")+len("PROGRAM END"); got != want {
+		t.Errorf("Expected %d output bytes, got %d", want, got)
+	}
+}
+
+func TestQueueFullIsServiceUnavailable(t *testing.T) {
+	c := &compiler{
+		dispatcher:  &mockDispatcher{queueFull: 10},
+		cache:       newTestCache(),
+		fingerprint: testFingerprint,
+	}
+
+	w := sendCompileRequest(c, "POST", bytes.NewBufferString("queuefull"))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %v when the job queue is full but got %v", http.StatusServiceUnavailable, w.Code)
+	}
+	// 10 jobs waiting for 2 workers take 5 rounds.
+	want := retryAfter(5 * *jobTimeEstimate)
+	if got := w.Header().Get("Retry-After"); got != want {
+		t.Errorf("Expected Retry-After %q but got %q", want, got)
+	}
+	if events := responseEvents(t, w); !findEvent(events, "stderr", "Service busy.") {
+		t.Errorf("Expected service busy event in response, got %v", events)
+	}
+}
+
+func TestRateLimitedClientsAreRejected(t *testing.T) {
+	dispatcher := &mockDispatcher{
+		sendSuccess: false,
+	}
+	c := &compiler{
+		dispatcher:  dispatcher,
+		cache:       newTestCache(),
+		fingerprint: testFingerprint,
+		limiter:     newRateLimiter(bucketConfig{burst: 2, refill: 0.1}, nil),
+	}
+
+	for i := 0; i < 3; i++ {
+		w := sendCompileRequest(c, "POST", bytes.NewBufferString("ratelimited"))
+		if i < 2 {
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected request %d within burst to result in status %v but got %v", i, http.StatusOK, w.Code)
+			}
+			continue
+		}
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("Expected request exceeding burst to result in status %v but got %v", http.StatusTooManyRequests, w.Code)
+		}
+		if got := w.Header().Get("Retry-After"); got != "10" {
+			t.Errorf("Expected Retry-After %q but got %q", "10", got)
+		}
+	}
+	if len(dispatcher.jobs) != 2 {
+		t.Errorf("Expected len(dispatcher.jobs) to be 2 but got %v", len(dispatcher.jobs))
+	}
+}
+
+// Fingerprint ID of the builder in tests using a mock dispatcher.
+const testFingerprint = "test"
+
+// Fingerprint reported by the hello.json and slow.json fake builder scripts.
+var fakeFingerprint = event.Fingerprint{
+	GoVersion:        "go version go1.5.3 linux/amd64",
+	VanadiumRevision: "fake",
+	BuilderID:        "fake",
+}
+
+// newFakeCompiler returns a compiler running jobs on a real dispatcher, with
+// the builder replaced by the named fake builder script.
+func newFakeCompiler(t *testing.T, script string) *compiler {
+	s, err := fakebuilder.LoadFile(filepath.Join("fakebuilder", "testdata", script))
+	if err != nil {
+		t.Fatalf("Failed loading fake builder script: %v", err)
+	}
+	return &compiler{
+		dispatcher: jobqueue.NewCoalescingDispatcher(jobqueue.NewDispatcherFromConfig(jobqueue.DispatcherConfig{Workers: 1, QueueCap: 1, Scheduler: jobqueue.NewFairScheduler()})),
+		newRunner:  jobqueue.NewFakeRunnerFactory(s.Run),
+		cache:      newTestCache(),
+	}
+}
+
+// responseEvents parses the event stream in a compile response.
+func responseEvents(t *testing.T, w *httptest.ResponseRecorder) []event.Event {
+	var events []event.Event
+	dec := json.NewDecoder(w.Body)
+	for dec.More() {
+		var e event.Event
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("Failed decoding response event: %v", err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func findEvent(events []event.Event, stream, message string) bool {
+	for _, e := range events {
+		if e.Stream == stream && strings.Contains(e.Message, message) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFakeBuilderOutputIsRelayedAndCached(t *testing.T) {
+	c := newFakeCompiler(t, "slow.json")
+	defer c.stop()
+	c.probeFingerprint()
+
+	bodyString := `{"files": [{"name": "src/main/main.go", "body": "fake slow"}]}`
+	requestBodyHash := cacheKey(fakeFingerprint.ID(), canonicalRequest([]byte(bodyString)))
+
+	w := sendCompileRequest(c, "POST", bytes.NewBufferString(bodyString))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %v but got %v", http.StatusOK, w.Code)
+	}
+	events := responseEvents(t, w)
+	for _, want := range []string{"PROGRAM START", "PROGRAM MIDDLE", "PROGRAM END"} {
+		if !findEvent(events, "stdout", want) {
+			t.Errorf("Expected stdout event %q in response, got %v", want, events)
+		}
+	}
+	if findEvent(events, "debug", "") {
+		t.Errorf("Expected debug events to be filtered from response, got %v", events)
+	}
+
+	// The response is cached for the fingerprint reported by the builder.
+	if _, ok := c.getCachedResponse(cacheKey("", canonicalRequest([]byte(bodyString)))); ok {
+		t.Errorf("Expected response not to be cached without fingerprint, but it was.")
+	}
+	cr, ok := c.getCachedResponse(requestBodyHash)
+	if !ok {
+		t.Fatalf("Expected request body to be in cache, but it was not.")
+	}
+	if !findEvent(cr.Events, "stdout", "PROGRAM END") {
+		t.Errorf("Expected cached events to contain program output, got %v", cr.Events)
+	}
+
+	// The cached response is replayed without running the builder again.
+	w = sendCompileRequest(c, "POST", bytes.NewBufferString(bodyString))
+	if cached := responseEvents(t, w); !findEvent(cached, "stdout", "PROGRAM END") {
+		t.Errorf("Expected cached response to contain program output, got %v", cached)
+	}
+}
+
+func TestFakeBuilderFailuresAreNotCached(t *testing.T) {
+	tests := []struct {
+		script string
+		want   string
+	}{
+		{"malformed.json", "Internal error, please retry."},
+		{"crash.json", "Internal error, please retry."},
+	}
+	for _, test := range tests {
+		c := newFakeCompiler(t, test.script)
+
+		bodyString := `{"files": [{"name": "src/main/main.go", "body": "fake ` + test.script + `"}]}`
+		requestBodyHash := cacheKey("", canonicalRequest([]byte(bodyString)))
+
+		w := sendCompileRequest(c, "POST", bytes.NewBufferString(bodyString))
+		events := responseEvents(t, w)
+		if !findEvent(events, "stdout", "PROGRAM START") {
+			t.Errorf("%s: Expected output before the failure to be relayed, got %v", test.script, events)
+		}
+		if !findEvent(events, "stderr", test.want) {
+			t.Errorf("%s: Expected stderr event %q in response, got %v", test.script, test.want, events)
+		}
+		if _, ok := c.getCachedResponse(requestBodyHash); ok {
+			t.Errorf("%s: Expected request body not to be in cache, but it was.", test.script)
+		}
+		c.stop()
+	}
+}
+
+func TestFakeBuilderOversizedOutputIsTruncated(t *testing.T) {
+	c := newFakeCompiler(t, "oversized.json")
+	defer c.stop()
+
+	bodyString := `{"files": [{"name": "src/main/main.go", "body": "fake oversized"}]}`
+	w := sendCompileRequest(c, "POST", bytes.NewBufferString(bodyString))
+	if w.Body.Len() > 2*(*maxSize) {
+		t.Errorf("Expected response to be at most %v bytes, got %v", 2*(*maxSize), w.Body.Len())
+	}
+	events := responseEvents(t, w)
+	if !findEvent(events, "stderr", "Program output too large, killed.") {
+		t.Errorf("Expected output too large event in response, got %v", events[len(events)-1])
+	}
+	if findEvent(events, "stdout", "PROGRAM END") {
+		t.Errorf("Expected output to be truncated before program end.")
+	}
+}
+
+func TestCachedResponseEncoding(t *testing.T) {
+	cr := &cachedResponse{
+		Status: http.StatusOK,
+		Events: []event.Event{event.New("src/main/main.go", "stdout", "hello")},
+	}
+	data, err := cr.encode()
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	got, err := decodeCachedResponse(data)
+	if err != nil {
+		t.Fatalf("decodeCachedResponse failed: %v", err)
+	}
+	if got.Status != cr.Status || len(got.Events) != 1 || got.Events[0] != cr.Events[0] {
+		t.Errorf("Expected decoded response %v, got %v", cr, got)
+	}
+
+	// Entries written by other versions are ignored.
+	data[0] = cachedResponseVersion + 1
+	if _, err := decodeCachedResponse(data); err == nil {
+		t.Errorf("Expected decoding an unknown version to fail")
+	}
+	if _, err := decodeCachedResponse(nil); err == nil {
+		t.Errorf("Expected decoding an empty response to fail")
+	}
+}
+
+func TestProbeFingerprint(t *testing.T) {
+	c := newFakeCompiler(t, "hello.json")
+	defer c.stop()
+
+	if got := c.currentFingerprint(); got != "" {
+		t.Errorf("Expected no builder fingerprint before probing, got %q", got)
+	}
+	// Responses are not cached until the fingerprint is known.
+	bodyString := `{"files": [{"name": "src/main/main.go", "body": "fake hello"}]}`
+	sendCompileRequest(c, "POST", bytes.NewBufferString(bodyString))
+	if _, ok := c.getCachedResponse(cacheKey("", canonicalRequest([]byte(bodyString)))); ok {
+		t.Errorf("Expected response not to be cached without fingerprint, but it was.")
+	}
+
+	c.probeFingerprint()
+	if got, want := c.currentFingerprint(), fakeFingerprint.ID(); got != want {
+		t.Errorf("Expected builder fingerprint %q but got %q", want, got)
+	}
+	sendCompileRequest(c, "POST", bytes.NewBufferString(bodyString))
+	if _, ok := c.getCachedResponse(cacheKey(fakeFingerprint.ID(), canonicalRequest([]byte(bodyString)))); !ok {
+		t.Errorf("Expected response to be cached once the fingerprint is known, but it was not.")
+	}
+}
+
+func TestClientProbeRequestsAreRejected(t *testing.T) {
+	dispatcher := &mockDispatcher{sendSuccess: true}
+	c := &compiler{
+		dispatcher:  dispatcher,
+		cache:       newTestCache(),
+		fingerprint: testFingerprint,
+	}
+
+	bodies := []string{
+		`{"Files": [], "Probe": true}`,
+		`{"files": [], "probe": true}`,
+		`{"files": [], "PROBE": false}`,
+		`{"files": [], "Pr\u006fbe": true}`,
+		`{"files": [], "probe": false, "probe": true}`,
+	}
+	for _, body := range bodies {
+		w := sendCompileRequest(c, "POST", bytes.NewBufferString(body))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected probe request %s to result in status %v but got %v", body, http.StatusBadRequest, w.Code)
+		}
+		// Canonical requests drop Probe, so a cached probe response would be
+		// served for the same request without it.
+		if _, ok := c.getCachedResponse(cacheKey(testFingerprint, canonicalRequest([]byte(body)))); ok {
+			t.Errorf("Expected probe request %s not to be cached, but it was.", body)
+		}
+	}
+	if len(dispatcher.jobs) != 0 {
+		t.Errorf("Expected probe requests not to reach builder, but %v jobs were queued", len(dispatcher.jobs))
+	}
+}
+
+func sendFlushCacheRequest(c *compiler, query string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "/flush-cache"+query, nil)
+	if err != nil {
+		panic(err)
+	}
+	w := httptest.NewRecorder()
+	c.handlerFlushCache(w, req)
+	return w
+}
+
+func TestFlushCache(t *testing.T) {
+	c := &compiler{
+		cache: newTestCache(),
+	}
+	cr := &cachedResponse{Status: http.StatusOK}
+	c.addCachedResponse(cacheKey("old", []byte("a")), "old", cr)
+	c.addCachedResponse(cacheKey("new", []byte("a")), "new", cr)
+	c.addCachedResponse(cacheKey("newer", []byte("a")), "newer", cr)
+
+	// The fingerprint to keep must be known.
+	if w := sendFlushCacheRequest(c, ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %v with unknown fingerprint but got %v", http.StatusServiceUnavailable, w.Code)
+	}
+
+	c.updateFingerprint("new")
+	if w := sendFlushCacheRequest(c, ""); w.Code != http.StatusOK {
+		t.Errorf("Expected status %v but got %v", http.StatusOK, w.Code)
+	}
+	for fingerprint, want := range map[string]bool{"old": false, "new": true, "newer": false} {
+		if _, ok := c.getCachedResponse(cacheKey(fingerprint, []byte("a"))); ok != want {
+			t.Errorf("Expected response for fingerprint %q to be cached: %v, got %v", fingerprint, want, ok)
+		}
+	}
+
+	// An explicit fingerprint overrides the current one.
+	if w := sendFlushCacheRequest(c, "?keep=newer"); w.Code != http.StatusOK {
+		t.Errorf("Expected status %v but got %v", http.StatusOK, w.Code)
+	}
+	if _, ok := c.getCachedResponse(cacheKey("new", []byte("a"))); ok {
+		t.Errorf("Expected response for fingerprint %q to be flushed", "new")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	c := newFakeCompiler(t, "hello.json")
+	defer c.stop()
+	c.probeFingerprint()
+
+	hits, misses := cacheLookups.Value("hit"), cacheLookups.Value("miss")
+	bodyString := `{"files": [{"name": "src/main/main.go", "body": "fake metrics"}]}`
+	for i := 0; i < 2; i++ {
+		sendCompileRequest(c, "POST", bytes.NewBufferString(bodyString))
+	}
+	if got := cacheLookups.Value("miss") - misses; got != 1 {
+		t.Errorf("Expected 1 cache miss, got %v", got)
+	}
+	if got := cacheLookups.Value("hit") - hits; got != 1 {
+		t.Errorf("Expected 1 cache hit, got %v", got)
+	}
+
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, req)
+	for _, want := range []string{
+		"playground_cache_lookups_total{result=\"hit\"} ",
+		"playground_jobs_total{outcome=\"success\"} ",
+		"playground_job_duration_seconds_count{phase=\"run\"} ",
+		"playground_jobs_queued 0\n",
+		"playground_workers_busy 0\n",
+		"playground_lameduck 0\n",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, w.Body.String())
+		}
+	}
+}
+
+func TestQueueEventsAreNotCached(t *testing.T) {
+	events := []event.Event{
+		event.NewQueueStatus(event.QueueStatus{Position: 1}),
+		event.New("a.go", "stdout", "hello"),
+		event.NewJobStatus("Job success.", event.JobStatus{Outcome: "success"}),
+	}
+	got := cacheableEvents(events)
+	if len(got) != 2 || got[0].Message != "hello" || got[1].Stream != "status" {
+		t.Errorf("Expected queue event to be dropped, got %v", got)
+	}
+}
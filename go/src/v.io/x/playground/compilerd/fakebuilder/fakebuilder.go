@@ -0,0 +1,206 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fakebuilder implements a scripted stand-in for the builder command,
+// for hermetic tests of compilerd and jobqueue that need neither JIRI_ROOT nor
+// the Vanadium toolchain.
+//
+// A script is a JSON fixture listing steps that are replayed in order, e.g.:
+//
+//   {"steps": [
+//     {"event": {"File": "src/main/main.go", "Stream": "stdout", "Message": "hi"}},
+//     {"delay": "100ms"},
+//     {"stdout": "this is not JSON\n"},
+//     {"stderr": "panic: builder bug\n"},
+//     {"event": {"Stream": "stdout", "Message": "spam"}, "repeat": 1000},
+//     {"echo": true},
+//     {"hang": true},
+//     {"exit": 1}
+//   ]}
+//
+// Script.Run has the signature of jobqueue.FakeBuilder, so a script can be run
+// using jobqueue.NewFakeRunnerFactory(script.Run).
+
+package fakebuilder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"v.io/x/playground/lib/event"
+)
+
+// ErrKilled is returned by Run if the fake builder was killed.
+var ErrKilled = errors.New("signal: killed")
+
+// Step is a single step of a script. Exactly one of Event, Stdout, Stderr,
+// Delay, Echo, Hang and Exit should be set.
+type Step struct {
+	// Event to write to stdout as a JSON line. If Timestamp is unset, the
+	// current time is used.
+	Event *event.Event `json:"event"`
+	// Number of times to write Event. Defaults to 1.
+	Repeat int `json:"repeat"`
+	// Raw text to write to stdout, e.g. malformed JSON.
+	Stdout string `json:"stdout"`
+	// Raw text to write to stderr.
+	Stderr string `json:"stderr"`
+	// Time to wait, in time.ParseDuration format.
+	Delay string `json:"delay"`
+	// Read event.Stdin frames following the bundle on stdin, and write the
+	// data of each as a stdout event for its file, until a frame closes stdin
+	// or the input ends.
+	Echo bool `json:"echo"`
+	// Wait until killed.
+	Hang bool `json:"hang"`
+	// Exit immediately with the given code. Non-zero codes result in an error.
+	Exit int `json:"exit"`
+}
+
+// Script is a sequence of steps replayed by the fake builder. The fake builder
+// exits cleanly after the last step.
+type Script struct {
+	Steps []Step `json:"steps"`
+}
+
+// Parse parses a JSON-encoded script.
+func Parse(data []byte) (*Script, error) {
+	var s Script
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed parsing fake builder script: %v", err)
+	}
+	for i, step := range s.Steps {
+		if step.Delay != "" {
+			if _, err := time.ParseDuration(step.Delay); err != nil {
+				return nil, fmt.Errorf("invalid delay in step %d: %v", i, err)
+			}
+		}
+	}
+	return &s, nil
+}
+
+// LoadFile reads and parses a script from a file.
+func LoadFile(path string) (*Script, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Run replays the script, writing to stdout and stderr. The bundle is read
+// from stdin and discarded, like the real builder consumes it. Run returns
+// ErrKilled once killed is closed.
+func (s *Script) Run(stdin io.Reader, stdout, stderr io.Writer, killed <-chan struct{}) error {
+	// Any input for interactive files follows the bundle, and is only read by
+	// echo steps. Bundles that are not JSON are consumed entirely.
+	dec := json.NewDecoder(stdin)
+	var bundle json.RawMessage
+	if err := dec.Decode(&bundle); err != nil {
+		if _, err := io.Copy(ioutil.Discard, io.MultiReader(dec.Buffered(), stdin)); err != nil {
+			return err
+		}
+	}
+	for _, step := range s.Steps {
+		select {
+		case <-killed:
+			return ErrKilled
+		default:
+		}
+		switch {
+		case step.Event != nil:
+			repeat := step.Repeat
+			if repeat == 0 {
+				repeat = 1
+			}
+			for i := 0; i < repeat; i++ {
+				e := *step.Event
+				if e.Timestamp == 0 {
+					e.Timestamp = time.Now().UnixNano()
+				}
+				js, err := json.Marshal(&e)
+				if err != nil {
+					return err
+				}
+				if _, err := stdout.Write(append(js, '\n')); err != nil {
+					return err
+				}
+			}
+		case step.Stdout != "":
+			if _, err := io.WriteString(stdout, step.Stdout); err != nil {
+				return err
+			}
+		case step.Stderr != "":
+			if _, err := io.WriteString(stderr, step.Stderr); err != nil {
+				return err
+			}
+		case step.Delay != "":
+			d, _ := time.ParseDuration(step.Delay)
+			select {
+			case <-killed:
+				return ErrKilled
+			case <-time.After(d):
+			}
+		case step.Echo:
+			if err := echo(dec, stdout, killed); err != nil {
+				return err
+			}
+		case step.Hang:
+			<-killed
+			return ErrKilled
+		case step.Exit != 0:
+			return fmt.Errorf("exit status %d", step.Exit)
+		}
+	}
+	return nil
+}
+
+// echo writes the data of stdin frames read from dec as stdout events, until
+// a frame closes stdin or the input ends.
+func echo(dec *json.Decoder, stdout io.Writer, killed <-chan struct{}) error {
+	frames := make(chan event.Stdin)
+	go func() {
+		defer close(frames)
+		for {
+			var in event.Stdin
+			if err := dec.Decode(&in); err != nil {
+				return
+			}
+			select {
+			case frames <- in:
+			case <-killed:
+				return
+			}
+			if in.Close {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-killed:
+			return ErrKilled
+		case in, ok := <-frames:
+			if !ok {
+				return nil
+			}
+			if in.Data != "" {
+				js, err := json.Marshal(event.New(in.File, "stdout", in.Data))
+				if err != nil {
+					return err
+				}
+				if _, err := stdout.Write(append(js, '\n')); err != nil {
+					return err
+				}
+			}
+			if in.Close {
+				return nil
+			}
+		}
+	}
+}
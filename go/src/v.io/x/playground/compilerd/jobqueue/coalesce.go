@@ -0,0 +1,226 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Coalescing of identical concurrent jobs.
+//
+// When many clients load the same example at once, they all miss the response
+// cache until the first job finishes. A coalescing dispatcher runs such jobs
+// only once: a job with the same key as a job that is already queued or
+// running joins it instead of being queued. Each joined job gets a replay of
+// the events written so far, without the stale "queue" events, followed by
+// the events written from then on, and the same result.
+
+package jobqueue
+
+import (
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"v.io/x/playground/lib/event"
+	"v.io/x/playground/lib/log"
+	"v.io/x/playground/lib/metrics"
+)
+
+var jobsCoalesced = metrics.NewCounter("playground_jobs_coalesced_total", "Number of jobs that joined an identical job already queued or running instead of being queued.")
+
+// coalescingDispatcher implements Dispatcher interface.
+type coalescingDispatcher struct {
+	d Dispatcher
+
+	mu sync.Mutex
+	// Flights that have not finished, by key.
+	flights map[string]*flight
+}
+
+var _ = Dispatcher((*coalescingDispatcher)(nil))
+
+// flight is a job run by the underlying dispatcher on behalf of all jobs with
+// the same key.
+type flight struct {
+	key string
+	// The job queued on the underlying dispatcher. It writes to res, which
+	// keeps all events for replay to joining jobs.
+	job *Job
+	res *event.ResponseEventSink
+	// Closed when the job finishes.
+	done chan struct{}
+
+	// Set before done is closed.
+	result Result
+	events []event.Event
+
+	// Number of jobs waiting for the flight, protected by the dispatcher's mu.
+	members int
+}
+
+// NewCoalescingDispatcher returns a Dispatcher that queues jobs on d, except
+// that a job with a key (see Job.SetKey) joins the job with the same key that
+// is already queued or running on d, if any.
+func NewCoalescingDispatcher(d Dispatcher) Dispatcher {
+	return &coalescingDispatcher{
+		d:       d,
+		flights: make(map[string]*flight),
+	}
+}
+
+// SetKey sets the key identifying jobs that produce the same response, for a
+// coalescing dispatcher. Jobs with input are never coalesced.
+func (j *Job) SetKey(key string) {
+	j.key = key
+}
+
+// Enqueue queues the job on the underlying dispatcher, or joins the job with
+// the same key. It returns a *QueueFullError if the job needs to be queued
+// and the job queue is full.
+func (c *coalescingDispatcher) Enqueue(j *Job) (chan Result, error) {
+	if j.key == "" || j.input != nil {
+		return c.d.Enqueue(j)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.flights[j.key]
+	if f == nil {
+		res := event.NewResponseEventSink(ioutil.Discard, false)
+		job := NewJob(j.body, res, j.maxSize, j.maxTime, j.newRunner)
+		// The job is scheduled like the job starting the flight.
+		job.priority = j.priority
+		job.client = j.client
+		resultChan, err := c.d.Enqueue(job)
+		if err != nil {
+			return nil, err
+		}
+		f = &flight{
+			key:  j.key,
+			job:  job,
+			res:  res,
+			done: make(chan struct{}),
+		}
+		c.flights[j.key] = f
+		go c.land(f, resultChan)
+	} else {
+		log.Debugf("Job %v joining job %v.", j.id, f.job.id)
+		jobsCoalesced.Inc()
+	}
+	f.members++
+	go c.follow(f, j)
+	return j.resultChan, nil
+}
+
+// land waits for the flight's job to finish and publishes its result.
+func (c *coalescingDispatcher) land(f *flight, resultChan chan Result) {
+	result := <-resultChan
+
+	c.mu.Lock()
+	if c.flights[f.key] == f {
+		delete(c.flights, f.key)
+	}
+	c.mu.Unlock()
+
+	f.result = result
+	// Successful jobs return their events in the result; otherwise, they
+	// remain in res.
+	f.events = append(result.Events, f.res.PopWrittenEvents()...)
+	close(f.done)
+}
+
+// leave removes a cancelled job from the flight. The flight's job is
+// cancelled once no jobs are waiting for it, and later jobs with the same key
+// start a new flight.
+func (c *coalescingDispatcher) leave(f *flight) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f.members--
+	if f.members > 0 {
+		return
+	}
+	if c.flights[f.key] == f {
+		delete(c.flights, f.key)
+	}
+	f.job.Cancel()
+}
+
+// replayEvents returns the events written by a flight before a job joined it,
+// to be replayed to the job. Earlier "queue" events are dropped, since their
+// queue positions and waits are out of date; the last event is kept if it is
+// one, as the current status of the flight.
+func replayEvents(events []event.Event) []event.Event {
+	var replay []event.Event
+	for i, e := range events {
+		if e.Stream != "queue" || i == len(events)-1 {
+			replay = append(replay, e)
+		}
+	}
+	return replay
+}
+
+// follow relays the events of the flight to the job, and sends the job's
+// result once the flight finishes or the job is cancelled.
+func (c *coalescingDispatcher) follow(f *flight, j *Job) {
+	n := 0
+	for {
+		events, changed := f.res.WrittenSince(n)
+		if len(events) > 0 {
+			if n == 0 {
+				j.res.Write(replayEvents(events)...)
+			} else {
+				j.res.Write(events...)
+			}
+			n += len(events)
+		}
+		select {
+		case <-changed:
+		case <-f.done:
+			if n == 0 {
+				j.res.Write(replayEvents(f.events)...)
+			} else if n < len(f.events) {
+				j.res.Write(f.events[n:]...)
+			}
+			result := f.result
+			if result.Success() || result.Partial {
+				result.Events = j.res.PopWrittenEvents()
+			}
+			j.resultChan <- result
+			return
+		case <-j.cancel:
+			c.leave(f)
+			if n == 0 {
+				// Nothing was relayed, as if the job had not started.
+				j.resultChan <- Result{Outcome: OutcomeCancelled}
+				return
+			}
+			j.res.Write(event.New("", "stderr", "Program cancelled."))
+			j.resultChan <- Result{
+				Outcome: OutcomeCancelled,
+				Partial: true,
+				Events:  j.res.PopWrittenEvents(),
+			}
+			return
+		}
+	}
+}
+
+// Stop stops the underlying dispatcher. Jobs waiting for a flight receive its
+// result.
+func (c *coalescingDispatcher) Stop() {
+	c.d.Stop()
+}
+
+// Drain drains the underlying dispatcher. Jobs waiting for a flight receive
+// its result.
+func (c *coalescingDispatcher) Drain(timeout time.Duration) {
+	c.d.Drain(timeout)
+}
+
+// Stats returns the stats of the underlying dispatcher, where coalesced jobs
+// count as one.
+func (c *coalescingDispatcher) Stats() Stats {
+	return c.d.Stats()
+}
+
+// Resize resizes the underlying dispatcher.
+func (c *coalescingDispatcher) Resize(n int) {
+	c.d.Resize(n)
+}
@@ -0,0 +1,190 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jobqueue
+
+import (
+	"io"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"v.io/x/playground/compilerd/fakebuilder"
+	"v.io/x/playground/lib/event"
+)
+
+// countingRunnerFactory returns a RunnerFactory replaying the named fake
+// builder script, and a function returning the number of times it was run.
+func countingRunnerFactory(t *testing.T, script string) (RunnerFactory, func() int) {
+	s, err := fakebuilder.LoadFile(filepath.Join(fakeBuilderTestdata, script))
+	if err != nil {
+		t.Fatalf("Failed loading fake builder script: %v", err)
+	}
+	var mu sync.Mutex
+	runs := 0
+	run := func(stdin io.Reader, stdout, stderr io.Writer, killed <-chan struct{}) error {
+		mu.Lock()
+		runs++
+		mu.Unlock()
+		return s.Run(stdin, stdout, stderr, killed)
+	}
+	return NewFakeRunnerFactory(run), func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return runs
+	}
+}
+
+func newKeyedJob(key string, newRunner RunnerFactory) *Job {
+	job := NewJob(mockTestBody, newMockResponseEventSink(), defaultMaxSize, defaultMaxTime, newRunner)
+	job.SetKey(key)
+	return job
+}
+
+func enqueue(t *testing.T, d Dispatcher, job *Job) chan Result {
+	resultChan, err := d.Enqueue(job)
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	return resultChan
+}
+
+func TestCoalesceIdenticalJobs(t *testing.T) {
+	newRunner, runs := countingRunnerFactory(t, "slow.json")
+	d := NewCoalescingDispatcher(NewDispatcher(2, 10))
+	defer d.Stop()
+
+	job1 := newKeyedJob("a", newRunner)
+	resultChan1 := enqueue(t, d, job1)
+	// The second job joins while the first is running, so it needs a replay of
+	// the events written so far.
+	waitForEvent(job1.res, "PROGRAM START")
+	job2 := newKeyedJob("a", newRunner)
+	resultChan2 := enqueue(t, d, job2)
+	job3 := newKeyedJob("b", newRunner)
+	resultChan3 := enqueue(t, d, job3)
+
+	for i, resultChan := range []chan Result{resultChan1, resultChan2, resultChan3} {
+		r := <-resultChan
+		if !r.Success() {
+			t.Errorf("Expected job %d to succeed but it failed.", i+1)
+		}
+		for _, want := range []string{"PROGRAM START", "PROGRAM MIDDLE", "PROGRAM END"} {
+			if !eventsMatch(r.Events, want) {
+				t.Errorf("Event message %v not found in job %d events %#v", want, i+1, r.Events)
+			}
+		}
+	}
+	if got, want := runs(), 2; got != want {
+		t.Errorf("Expected builder to run %d times, got %d", want, got)
+	}
+
+	// Jobs with the same key run again once the earlier job has finished.
+	r := <-enqueue(t, d, newKeyedJob("a", newRunner))
+	if !r.Success() {
+		t.Errorf("Expected job to succeed but it failed.")
+	}
+	if got, want := runs(), 3; got != want {
+		t.Errorf("Expected builder to run %d times, got %d", want, got)
+	}
+}
+
+func TestCoalescedJobCancel(t *testing.T) {
+	newRunner, runs := countingRunnerFactory(t, "hang.json")
+	d := NewCoalescingDispatcher(NewDispatcher(1, 10))
+	defer d.Stop()
+
+	job1 := newKeyedJob("a", newRunner)
+	resultChan1 := enqueue(t, d, job1)
+	job2 := newKeyedJob("a", newRunner)
+	resultChan2 := enqueue(t, d, job2)
+	waitForEvent(job1.res, "PROGRAM START")
+	waitForEvent(job2.res, "PROGRAM START")
+
+	// Cancelling one job does not affect the other.
+	job1.Cancel()
+	r := <-resultChan1
+	if r.Success() || !r.Partial {
+		t.Errorf("Expected job 1 to fail with a partial result, got %#v", r)
+	}
+	for _, want := range []string{"PROGRAM START", "Program cancelled."} {
+		if !eventsMatch(r.Events, want) {
+			t.Errorf("Event message %v not found in %#v", want, r.Events)
+		}
+	}
+	select {
+	case r := <-resultChan2:
+		t.Fatalf("Expected job 2 to keep running, got %#v", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Cancelling the last job kills the builder, freeing the only worker for
+	// the next job.
+	job2.Cancel()
+	if r := <-resultChan2; r.Success() || !r.Partial {
+		t.Errorf("Expected job 2 to fail with a partial result, got %#v", r)
+	}
+	job3 := newKeyedJob("a", newRunner)
+	resultChan3 := enqueue(t, d, job3)
+	waitForEvent(job3.res, "PROGRAM START")
+	if got, want := runs(), 2; got != want {
+		t.Errorf("Expected builder to run %d times, got %d", want, got)
+	}
+	job3.Cancel()
+	<-resultChan3
+}
+
+func TestCoalescedJobCancelBeforeEvents(t *testing.T) {
+	newRunner, runs := countingRunnerFactory(t, "hello.json")
+	// The dispatcher has no free worker, so jobs stay queued.
+	blocking, blockingRuns := countingRunnerFactory(t, "hang.json")
+	d := NewCoalescingDispatcher(NewDispatcher(1, 10))
+	defer d.Stop()
+	blocker := newKeyedJob("blocker", blocking)
+	blockerResult := enqueue(t, d, blocker)
+	waitForEvent(blocker.res, "PROGRAM START")
+
+	job := newKeyedJob("a", newRunner)
+	resultChan := enqueue(t, d, job)
+	job.Cancel()
+	if r := <-resultChan; r.Success() || r.Partial {
+		t.Errorf("Expected job cancelled before any events to fail without a partial result, got %#v", r)
+	}
+
+	blocker.Cancel()
+	<-blockerResult
+	// The cancelled flight is skipped by the dispatcher.
+	r := <-enqueue(t, d, newKeyedJob("b", newRunner))
+	if !r.Success() {
+		t.Errorf("Expected job to succeed but it failed.")
+	}
+	if got, want := runs(), 1; got != want {
+		t.Errorf("Expected builder to run %d times, got %d", want, got)
+	}
+	if got, want := blockingRuns(), 1; got != want {
+		t.Errorf("Expected blocking builder to run %d times, got %d", want, got)
+	}
+}
+
+func TestReplayEvents(t *testing.T) {
+	queue3 := event.NewQueueStatus(event.QueueStatus{Position: 3})
+	queue2 := event.NewQueueStatus(event.QueueStatus{Position: 2})
+	out := event.New("main.go", "stdout", "x")
+	tests := []struct {
+		events, want []event.Event
+	}{
+		{nil, nil},
+		// A flight still queued replays only its current status.
+		{[]event.Event{queue3, queue2}, []event.Event{queue2}},
+		// A running flight replays no status.
+		{[]event.Event{queue3, queue2, out}, []event.Event{out}},
+	}
+	for _, test := range tests {
+		if got := replayEvents(test.events); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Expected replay of %v to be %v, got %v", test.events, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Container management for the Docker runner.
+//
+// Creating a container, which sets up its file system, is a slow part of
+// "docker run", so the Docker runner can keep a small pool of idle containers
+// created ahead of jobs. A job takes a pooled container, if any, and starts
+// it attached; otherwise it runs a new container as before. Pooled containers
+// are not running, so they use no memory until a job starts them. The pool is
+// refilled in the background, and its idle containers are removed when
+// compilerd stops.
+//
+// "docker rm" can be slow (several seconds), and seems to block other Docker
+// commands, thereby slowing down other concurrent requests (see
+// https://github.com/docker/docker/issues/6480). Finished containers are
+// killed and removed in the background by a few workers through a bounded
+// cleanup queue, retrying failed removals. Jobs never wait for Docker
+// commands or for room in the queue; if it is full, the container is killed
+// in the background and left behind.
+//
+// All builder containers are labeled, and containers left behind, e.g. when
+// the cleanup queue was full or compilerd was killed, are removed at startup.
+// Hence a Docker daemon must not be shared by several compilerd instances.
+
+package jobqueue
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"v.io/x/playground/lib/log"
+	"v.io/x/playground/lib/metrics"
+)
+
+// Label of all builder containers.
+const builderLabel = "io.v.playground.builder"
+
+var (
+	poolIdle          = metrics.NewGauge("playground_docker_pool_idle", "Number of created Docker containers waiting for a job.")
+	poolRequests      = metrics.NewCounter("playground_docker_pool_requests_total", "Number of jobs that found a created Docker container (hit) or had to run one (miss).", "result")
+	poolCreateErrors  = metrics.NewCounter("playground_docker_pool_create_errors_total", "Number of errors creating Docker containers for the pool.")
+	cleanupsQueued    = metrics.NewGauge("playground_docker_cleanups_queued", "Number of Docker containers waiting to be removed.")
+	cleanupOutcomes   = metrics.NewCounter("playground_docker_cleanups_total", "Number of Docker containers removed (removed) or given up on after retries (failed).", "outcome")
+	cleanupRetries    = metrics.NewCounter("playground_docker_cleanup_retries_total", "Number of retried Docker container removals.")
+	cleanupQueueFulls = metrics.NewCounter("playground_docker_cleanup_queue_full_total", "Number of Docker containers left behind because the cleanup queue was full.")
+	cleanupDuration   = metrics.NewHistogram("playground_docker_cleanup_duration_seconds", "Time spent killing and removing a Docker container, including retries.", metrics.DurationBuckets)
+)
+
+// runDocker runs docker with the given arguments, returning an error
+// including its output if it fails.
+func runDocker(args ...string) error {
+	if out, err := docker(args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("docker %s failed: %v: %s", args[0], err, out)
+	}
+	return nil
+}
+
+// listBuilderContainers returns the IDs of all builder containers, running or
+// not.
+func listBuilderContainers() ([]string, error) {
+	out, err := docker("ps", "-a", "-q", "--filter", "label="+builderLabel).Output()
+	if err != nil {
+		return nil, fmt.Errorf("docker ps failed: %v", err)
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// removeStaleContainers queues the builder containers returned by list for
+// removal through cleanup. It must be called before any containers are
+// created.
+func removeStaleContainers(list func() ([]string, error), cleanup *cleanupQueue) {
+	names, err := list()
+	if err != nil {
+		log.Errorf("Error listing stale containers: %v", err)
+		return
+	}
+	if len(names) > 0 {
+		log.Warnf("Removing %d stale containers.", len(names))
+	}
+	for _, name := range names {
+		cleanup.add(name)
+	}
+}
+
+////////////////////////////////////////
+// Container pool
+
+// containerPool keeps up to a fixed number of created containers.
+type containerPool struct {
+	create     func(name string) error
+	cleanup    *cleanupQueue
+	retryDelay time.Duration
+
+	// Receives a value for each container the pool is missing.
+	room chan struct{}
+	// Names of the created containers.
+	idle chan string
+	// Closed by close to stop filling the pool.
+	done chan struct{}
+	// Closed once fill has returned.
+	filled chan struct{}
+}
+
+// newContainerPool returns a pool of size containers created by create. If
+// creating a container fails, it is removed through cleanup, and creating
+// another one is retried after retryDelay.
+func newContainerPool(size int, retryDelay time.Duration, create func(name string) error, cleanup *cleanupQueue) *containerPool {
+	p := &containerPool{
+		create:     create,
+		cleanup:    cleanup,
+		retryDelay: retryDelay,
+		room:       make(chan struct{}, size),
+		idle:       make(chan string, size),
+		done:       make(chan struct{}),
+		filled:     make(chan struct{}),
+	}
+	for i := 0; i < size; i++ {
+		p.room <- struct{}{}
+	}
+	go p.fill()
+	return p
+}
+
+// fill creates containers whenever the pool has room, until the pool is
+// closed.
+func (p *containerPool) fill() {
+	defer close(p.filled)
+	for {
+		select {
+		case <-p.room:
+		case <-p.done:
+			return
+		}
+		name := <-uniq
+		if err := p.create(name); err != nil {
+			log.Errorf("Error creating container %s for the pool: %v", name, err)
+			poolCreateErrors.Inc()
+			p.cleanup.add(name)
+			select {
+			case <-time.After(p.retryDelay):
+			case <-p.done:
+				return
+			}
+			p.room <- struct{}{}
+			continue
+		}
+		poolIdle.Add(1)
+		p.idle <- name
+	}
+}
+
+// get returns the name of a created container and true, or false if the pool
+// is empty. The caller is responsible for starting and removing the
+// container.
+func (p *containerPool) get() (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	select {
+	case name := <-p.idle:
+		poolIdle.Add(-1)
+		poolRequests.Inc("hit")
+		p.room <- struct{}{}
+		return name, true
+	default:
+		poolRequests.Inc("miss")
+		return "", false
+	}
+}
+
+// close stops filling the pool, and removes its idle containers through
+// cleanup. Containers taken from the pool are removed by their jobs.
+func (p *containerPool) close() {
+	if p == nil {
+		return
+	}
+	close(p.done)
+	<-p.filled
+	for {
+		select {
+		case name := <-p.idle:
+			poolIdle.Add(-1)
+			p.cleanup.add(name)
+		default:
+			return
+		}
+	}
+}
+
+////////////////////////////////////////
+// Cleanup queue
+
+// cleanupQueue kills and removes containers in the background.
+type cleanupQueue struct {
+	kill       func(name string) error
+	remove     func(name string) error
+	retries    int
+	retryDelay time.Duration
+
+	names chan string
+	// Waits for the workers to exit.
+	wg sync.WaitGroup
+}
+
+// newCleanupQueue returns a queue of up to capacity containers waiting to be
+// killed by kill and removed by remove, which are run by the given number of
+// workers. Failed removals are retried up to retries times, waiting
+// retryDelay longer before each retry.
+func newCleanupQueue(capacity, workers, retries int, retryDelay time.Duration, kill, remove func(name string) error) *cleanupQueue {
+	q := &cleanupQueue{
+		kill:       kill,
+		remove:     remove,
+		retries:    retries,
+		retryDelay: retryDelay,
+		names:      make(chan string, capacity),
+	}
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.run()
+	}
+	return q
+}
+
+// add queues the container to be killed and removed. add never waits for
+// room in the queue: if it is full, the container is killed in the background
+// and left behind, to be removed at the next startup.
+func (q *cleanupQueue) add(name string) {
+	cleanupsQueued.Add(1)
+	select {
+	case q.names <- name:
+	default:
+		cleanupsQueued.Add(-1)
+		log.Errorf("Cleanup queue full, leaving container %s behind.", name)
+		cleanupQueueFulls.Inc()
+		go q.killContainer(name)
+	}
+}
+
+// killContainer kills the container, so that it stops using resources before
+// it is removed.
+func (q *cleanupQueue) killContainer(name string) {
+	// Fails if the container has already exited, or was never started.
+	if err := q.kill(name); err != nil {
+		log.Debugf("Error killing container %s: %v", name, err)
+	}
+}
+
+// close waits for the queued containers to be removed. add must not be
+// called afterwards.
+func (q *cleanupQueue) close() {
+	close(q.names)
+	q.wg.Wait()
+}
+
+func (q *cleanupQueue) run() {
+	defer q.wg.Done()
+	for name := range q.names {
+		cleanupsQueued.Add(-1)
+		start := time.Now()
+		q.killContainer(name)
+		err := q.remove(name)
+		for retry := 1; err != nil && retry <= q.retries; retry++ {
+			log.Warnf("Error removing container %s, retrying: %v", name, err)
+			cleanupRetries.Inc()
+			time.Sleep(time.Duration(retry) * q.retryDelay)
+			err = q.remove(name)
+		}
+		cleanupDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			log.Errorf("Error removing container %s, giving up: %v", name, err)
+			cleanupOutcomes.Inc("failed")
+		} else {
+			cleanupOutcomes.Inc("removed")
+		}
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jobqueue
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDocker is a fake docker command, which fails the first failures times.
+type fakeDocker struct {
+	mu       sync.Mutex
+	failures int
+	// Receives the name of every container passed to the command.
+	calls chan string
+	// If not nil, the command waits for it to be closed before returning.
+	gate chan struct{}
+}
+
+func newFakeDocker(failures int) *fakeDocker {
+	return &fakeDocker{failures: failures, calls: make(chan string, 100)}
+}
+
+func (f *fakeDocker) run(name string) error {
+	f.calls <- name
+	if f.gate != nil {
+		<-f.gate
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("fake docker failure")
+	}
+	return nil
+}
+
+// waitForCalls waits for the fake docker command to be called n times, and
+// returns the containers passed to it.
+func (f *fakeDocker) waitForCalls(t *testing.T, n int) []string {
+	var names []string
+	for i := 0; i < n; i++ {
+		select {
+		case name := <-f.calls:
+			names = append(names, name)
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %d docker calls, got %v", n, names)
+		}
+	}
+	return names
+}
+
+// expectNoCalls fails the test if the fake docker command is called within
+// a short time.
+func (f *fakeDocker) expectNoCalls(t *testing.T) {
+	select {
+	case name := <-f.calls:
+		t.Errorf("Expected no more docker calls, got %s", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCleanupQueueRetries(t *testing.T) {
+	kill, remove := newFakeDocker(0), newFakeDocker(2)
+	q := newCleanupQueue(10, 1, 3, time.Millisecond, kill.run, remove.run)
+	q.add("a")
+	q.add("b")
+	names := remove.waitForCalls(t, 4)
+	if want := []string{"a", "a", "a", "b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected removals %v, got %v", want, names)
+	}
+	if names, want := kill.waitForCalls(t, 2), []string{"a", "b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected kills %v, got %v", want, names)
+	}
+	q.close()
+
+	// Removals are given up on after the last retry.
+	remove = newFakeDocker(10)
+	q = newCleanupQueue(10, 1, 1, time.Millisecond, kill.run, remove.run)
+	q.add("c")
+	q.add("d")
+	names = remove.waitForCalls(t, 4)
+	if want := []string{"c", "c", "d", "d"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected removals %v, got %v", want, names)
+	}
+	q.close()
+}
+
+func TestCleanupQueueFull(t *testing.T) {
+	kill, remove := newFakeDocker(0), newFakeDocker(0)
+	remove.gate = make(chan struct{})
+	q := newCleanupQueue(1, 1, 0, time.Millisecond, kill.run, remove.run)
+
+	// The worker is busy removing a, and b fills the queue.
+	q.add("a")
+	remove.waitForCalls(t, 1)
+	q.add("b")
+	added := make(chan struct{})
+	go func() {
+		q.add("c")
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected add not to wait for room in the queue")
+	}
+	// The container that did not fit in the queue is killed anyway.
+	if names, want := kill.waitForCalls(t, 2), []string{"a", "c"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected kills %v, got %v", want, names)
+	}
+
+	// The container that did not fit in the queue is left behind.
+	close(remove.gate)
+	if names, want := remove.waitForCalls(t, 1), []string{"b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected removals %v, got %v", want, names)
+	}
+	if names, want := kill.waitForCalls(t, 1), []string{"b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected kills %v, got %v", want, names)
+	}
+	q.close()
+	remove.expectNoCalls(t)
+}
+
+func TestCleanupQueueKillsInWorkers(t *testing.T) {
+	kill, remove := newFakeDocker(0), newFakeDocker(0)
+	kill.gate = make(chan struct{})
+	q := newCleanupQueue(10, 1, 0, time.Millisecond, kill.run, remove.run)
+
+	// Jobs do not wait for containers to be killed.
+	added := make(chan struct{})
+	go func() {
+		q.add("a")
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected add not to wait for the container to be killed")
+	}
+
+	// Containers are removed once killed.
+	kill.waitForCalls(t, 1)
+	remove.expectNoCalls(t)
+	close(kill.gate)
+	if names, want := remove.waitForCalls(t, 1), []string{"a"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected removals %v, got %v", want, names)
+	}
+	q.close()
+}
+
+func TestCleanupQueueWorkers(t *testing.T) {
+	kill, remove := newFakeDocker(0), newFakeDocker(0)
+	remove.gate = make(chan struct{})
+	q := newCleanupQueue(10, 3, 0, time.Millisecond, kill.run, remove.run)
+	for _, name := range []string{"a", "b", "c"} {
+		q.add(name)
+	}
+	// The removals run concurrently.
+	names := remove.waitForCalls(t, 3)
+	sort.Strings(names)
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected removals %v, got %v", want, names)
+	}
+	close(remove.gate)
+	q.close()
+}
+
+func TestContainerPool(t *testing.T) {
+	kill, remove := newFakeDocker(0), newFakeDocker(0)
+	cleanup := newCleanupQueue(10, 1, 0, time.Millisecond, kill.run, remove.run)
+	// The first container fails to be created, so it is removed and another
+	// one created.
+	create := newFakeDocker(1)
+	p := newContainerPool(2, time.Millisecond, create.run, cleanup)
+	created := create.waitForCalls(t, 3)
+	if removed := remove.waitForCalls(t, 1); removed[0] != created[0] {
+		t.Errorf("Expected failed container %s to be removed, got %s", created[0], removed[0])
+	}
+
+	// Jobs get the created containers, and the pool is refilled.
+	for _, want := range created[1:] {
+		var name string
+		for deadline := time.Now().Add(time.Second); name == "" && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			name, _ = p.get()
+		}
+		if name != want {
+			t.Errorf("Expected container %s from the pool, got %q", want, name)
+		}
+	}
+	refilled := create.waitForCalls(t, 2)
+
+	// Closing the pool removes the idle containers, and no more are created.
+	for deadline := time.Now().Add(time.Second); len(p.idle) < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if names := kill.waitForCalls(t, 1); names[0] != created[0] {
+		t.Errorf("Expected failed container %s to be killed, got %s", created[0], names[0])
+	}
+	p.close()
+	if names := kill.waitForCalls(t, 2); !reflect.DeepEqual(names, refilled) {
+		t.Errorf("Expected idle containers %v to be killed, got %v", refilled, names)
+	}
+	cleanup.close()
+	if names := remove.waitForCalls(t, 2); !reflect.DeepEqual(names, refilled) {
+		t.Errorf("Expected idle containers %v to be removed, got %v", refilled, names)
+	}
+	create.expectNoCalls(t)
+	if name, ok := p.get(); ok {
+		t.Errorf("Expected no container from closed pool, got %s", name)
+	}
+
+	// A nil pool is always empty.
+	var nilPool *containerPool
+	if name, ok := nilPool.get(); ok {
+		t.Errorf("Expected no container from nil pool, got %s", name)
+	}
+	nilPool.close()
+}
+
+func TestRemoveStaleContainers(t *testing.T) {
+	kill, remove := newFakeDocker(0), newFakeDocker(0)
+	cleanup := newCleanupQueue(10, 1, 0, time.Millisecond, kill.run, remove.run)
+	removeStaleContainers(func() ([]string, error) {
+		return []string{"a", "b"}, nil
+	}, cleanup)
+	cleanup.close()
+	if names, want := remove.waitForCalls(t, 2), []string{"a", "b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected removals %v, got %v", want, names)
+	}
+
+	// Listing errors are logged.
+	removeStaleContainers(func() ([]string, error) {
+		return nil, errors.New("fake docker failure")
+	}, nil)
+}
+
+// fakeDockerScript is a fake docker command for the pooled Docker runner. Like
+// Docker, it only closes the stdin of a started container at the end of the
+// input if stdin was attached when the container was created; otherwise
+// builder waits for more input until it is killed.
+const fakeDockerScript = `#!/bin/sh
+dir=$(dirname "$0")
+case $1 in
+create)
+	prev=
+	for arg; do
+		if [ "$prev" = --name ]; then
+			echo "$*" > "$dir/$arg"
+		fi
+		prev=$arg
+	done
+	;;
+start)
+	case $(cat "$dir/$4") in
+	*"-i --attach stdin"*)
+		cat > /dev/null
+		echo '{"File": "src/main/main.go", "Stream": "stdout", "Message": "STDIN CLOSED"}'
+		;;
+	*)
+		exec sleep 30
+		;;
+	esac
+	;;
+esac
+`
+
+func TestDockerRunnerPooledInteractive(t *testing.T) {
+	binDir, err := ioutil.TempDir("", "pg-fake-docker-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(binDir)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+	if err := ioutil.WriteFile(filepath.Join(binDir, "docker"), []byte(fakeDockerScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	noop := func(name string) error { return nil }
+	cleanup := newCleanupQueue(10, 1, 0, time.Millisecond, noop, noop)
+	defer cleanup.close()
+	pool := newContainerPool(1, time.Millisecond, func(name string) error {
+		return runDocker(dockerCreateArgs(name, 100)...)
+	}, cleanup)
+	defer pool.close()
+	for deadline := time.Now().Add(time.Second); len(pool.idle) < 1 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	newRunner := func(id string) Runner {
+		return &dockerRunner{id: id, memMB: 100, pool: pool, cleanup: cleanup}
+	}
+
+	// The job takes the pooled container, and builder sees the end of the
+	// input once the client has sent it all.
+	d := NewDispatcher(1, 1)
+	defer d.Stop()
+	input := strings.NewReader(`{"File": "src/main/main.go", "Content": "input"}`)
+	job := NewInteractiveJob(mockTestBody, input, newMockResponseEventSink(), defaultMaxSize, defaultMaxTime, newRunner)
+	resultChan, err := d.Enqueue(job)
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	select {
+	case r := <-resultChan:
+		if r.Outcome != OutcomeSuccess || !eventsMatch(r.Events, "STDIN CLOSED") {
+			t.Errorf("Expected builder to see the end of its input, got %#v", r)
+		}
+	case <-time.After(defaultMaxTime / 2):
+		t.Fatalf("Expected builder in the pooled container to see the end of its input")
+	}
+}
@@ -15,11 +15,21 @@
 //   dispatcher.Stop() // Waits for any in-progress jobs to finish, cancels any
 //                     // remaining jobs.
 //
-// Internally, the dispatcher has a channel of workers that represents a worker
-// queue, and a channel of jobs that represents a job queue.  The dispatcher
-// reads a  worker off the worker queue, and then reads a job off the job
-// queue, and runs that job on that worker. When the job finishes, the worker
-// is pushed back on to the worker queue.
+//   dispatcher.Drain(timeout) // Runs the queued jobs too, stopping any jobs
+//                             // left at the timeout.
+//
+// NewCoalescingDispatcher wraps a dispatcher to run identical concurrent jobs
+// only once, see coalesce.go.
+//
+// Internally, the dispatcher has a pool of workers, and a Scheduler that
+// represents a job queue.  Once a worker is idle and a job is queued, the
+// dispatcher takes the next job from the job queue, and runs that job on that
+// worker. When the job finishes, the worker is idle again. The pool can be
+// resized while the dispatcher runs, see pool.go. NewDispatcher runs jobs in
+// the order they were queued; NewDispatcherFromConfig takes a Scheduler
+// deciding the order, see scheduler.go. While jobs wait in the queue, the
+// dispatcher can periodically tell them their position and an estimate of the
+// wait.
 //
 // TODO(nlacasse): There are many types and functions exported in this file
 // which are only exported because they are used by the compile test, in
@@ -31,21 +41,27 @@ package jobqueue
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
-	"os/exec"
 	"sync"
 	"time"
 
 	"v.io/x/playground/lib"
 	"v.io/x/playground/lib/event"
 	"v.io/x/playground/lib/log"
+	"v.io/x/playground/lib/metrics"
 )
 
 var (
 	// A channel which returns unique playground ids.
 	uniq = make(chan string)
+
+	jobsQueued  = metrics.NewGauge("playground_jobs_queued", "Number of jobs waiting in the job queue.")
+	workersBusy = metrics.NewGauge("playground_workers_busy", "Number of workers running a job.")
+	jobDuration = metrics.NewHistogram("playground_job_duration_seconds", "Time spent by jobs in each phase: waiting in the queue, preparing the builder and running it.", metrics.DurationBuckets, "phase")
+	jobOutcomes = metrics.NewCounter("playground_jobs_total", "Number of jobs, by outcome: success, timed_out, sized_out (success with output truncated), errored, cancelled (queued or running), stopped (queued or running at shutdown) or rejected (queue full or shutting down).", "outcome")
 )
 
 func init() {
@@ -61,27 +77,52 @@ func init() {
 type Job struct {
 	id         string
 	body       []byte
+	input      io.Reader
 	res        *event.ResponseEventSink
 	resultChan chan Result
 
 	maxSize   int
 	maxTime   time.Duration
-	useDocker bool
-	dockerMem int
+	newRunner RunnerFactory
+
+	// Key identifying jobs with the same response, see SetKey.
+	key string
+	// Scheduling priority and client, see SetPriority and SetClient.
+	priority Priority
+	client   string
+
+	// Time the job was queued, and time it spent in the queue.
+	enqueued  time.Time
+	queueTime time.Duration
 
 	mu        sync.Mutex
 	cancelled bool
+	// Set if the job was cancelled by the dispatcher shutting down, see stop.
+	stopped bool
+	// Closed when the job is cancelled.
+	cancel chan struct{}
+}
+
+// NewJob creates a job running the builder on body, using a Runner created
+// by newRunner.
+func NewJob(body []byte, res *event.ResponseEventSink, maxSize int, maxTime time.Duration, newRunner RunnerFactory) *Job {
+	return NewInteractiveJob(body, nil, res, maxSize, maxTime, newRunner)
 }
 
-func NewJob(body []byte, res *event.ResponseEventSink, maxSize int, maxTime time.Duration, useDocker bool, dockerMem int) *Job {
+// NewInteractiveJob creates a job like NewJob, additionally passing input to
+// the builder after body while it runs. Input should be a stream of
+// JSON-encoded event.Stdin frames. The caller must make input return EOF once
+// the job's result is available, if not before.
+func NewInteractiveJob(body []byte, input io.Reader, res *event.ResponseEventSink, maxSize int, maxTime time.Duration, newRunner RunnerFactory) *Job {
 	return &Job{
 		id:        <-uniq,
 		body:      body,
+		input:     input,
 		res:       res,
 		maxSize:   maxSize,
 		maxTime:   maxTime,
-		useDocker: useDocker,
-		dockerMem: dockerMem,
+		newRunner: newRunner,
+		cancel:    make(chan struct{}),
 
 		// resultChan has capacity 1 so that writing to the channel won't block
 		// if nobody ever reads the result.
@@ -94,28 +135,104 @@ func (j *Job) Body() []byte {
 	return j.body
 }
 
+// stdin returns the builder's stdin, which is the body followed by the
+// input, if any, and a function closing it once the builder has exited.
+func (j *Job) stdin() (io.Reader, func(), error) {
+	if j.input == nil {
+		return bytes.NewReader(j.body), func() {}, nil
+	}
+	// The input is copied through a pipe rather than passed as is, since
+	// exec.Cmd.Wait would otherwise wait for the input to end even after the
+	// builder has exited.
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		io.Copy(w, io.MultiReader(bytes.NewReader(j.body), bytes.NewReader([]byte("\n")), j.input))
+		w.Close()
+	}()
+	return r, func() {
+		r.Close()
+		w.Close()
+	}, nil
+}
+
 // Cancel will prevent the job from being run, if it has not already been
-// started by a worker.
+// started by a worker. If the job is running, the builder is killed and the
+// result is partial (see Result).
 func (j *Job) Cancel() {
 	j.mu.Lock()
 	defer j.mu.Unlock()
+	if j.cancelled {
+		return
+	}
 	log.Debugf("Cancelling job %v.", j.id)
 	j.cancelled = true
+	close(j.cancel)
+}
+
+// stop cancels the job because the dispatcher is shutting down. The job's
+// outcome is OutcomeStopped rather than OutcomeCancelled.
+func (j *Job) stop() {
+	j.mu.Lock()
+	j.stopped = true
+	j.mu.Unlock()
+	j.Cancel()
+}
+
+// state returns whether the job was cancelled, and whether it was stopped.
+func (j *Job) state() (cancelled, stopped bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.cancelled, j.stopped
 }
 
 // Dispatcher is an interface type so it can be mocked during tests.
 type Dispatcher interface {
 	Enqueue(j *Job) (chan Result, error)
 	Stop()
+	// Drain stops accepting jobs, and runs the queued jobs for up to timeout
+	// before stopping.
+	Drain(timeout time.Duration)
+	// Stats returns the current state of the job queue and workers.
+	Stats() Stats
+	// Resize sets the number of workers, without interrupting running jobs.
+	Resize(n int)
 }
 
 // dispatcherImpl implements Dispatcher interface.
 type dispatcherImpl struct {
-	jobQueue chan *Job
-
-	// A message sent on the stopped channel causes the dispatcher to stop
-	// assigning new jobs to workers.
-	stopped chan bool
+	started time.Time
+
+	mu       sync.Mutex
+	jobQueue Scheduler
+	queueCap int
+	// Number of workers to keep, see Resize.
+	size int
+	// All workers, including retiring ones, in the order they were added, and
+	// the idle ones.
+	pool         []*worker
+	idle         []*worker
+	nextWorkerID int
+	// Moving average of the time workers spend on a job.
+	avgJobTime time.Duration
+	// Receives a value when a job is queued or a worker becomes idle, so that
+	// a dispatcher waiting for either checks again.
+	wake chan struct{}
+	// Set once Stop or Drain is called. New jobs are rejected.
+	closing bool
+	// Closed once the dispatcher is closing and has no queued or running jobs.
+	drained chan struct{}
+
+	statusInterval time.Duration
+
+	// Closing the stopped channel causes the dispatcher to stop assigning new
+	// jobs to workers.
+	stopped  chan struct{}
+	stopOnce sync.Once
+	// Closed once the dispatcher has stopped assigning jobs.
+	closed chan struct{}
 
 	// wg represents currently running workers. It is used during Stop to make
 	// sure that all workers have finished running their active jobs.
@@ -124,183 +241,357 @@ type dispatcherImpl struct {
 
 var _ = Dispatcher((*dispatcherImpl)(nil))
 
+// Weight of the latest job in the moving average of job times.
+const jobTimeWeight = 0.2
+
+// DispatcherConfig configures a dispatcher.
+type DispatcherConfig struct {
+	// Number of workers running jobs in parallel.
+	Workers int
+	// Maximum number of jobs waiting for a worker.
+	QueueCap int
+	// Decides the order in which queued jobs are run. Defaults to running them
+	// in the order they were queued.
+	Scheduler Scheduler
+	// If positive, jobs waiting for a worker are sent a "queue" Event with
+	// their position and estimated wait at this interval.
+	StatusInterval time.Duration
+	// Estimated time to run a job, used to estimate waits until jobs have
+	// finished. Waits are then estimated from recent job times.
+	JobTimeEstimate time.Duration
+}
+
+// NewDispatcher creates a dispatcher running jobs on the given number of
+// workers in the order they were queued, with up to jobQueueCap jobs waiting.
 func NewDispatcher(workers int, jobQueueCap int) Dispatcher {
-	log.Debugf("Creating new dispatcher with %v workers and %v queue capacity.", workers, jobQueueCap)
+	return NewDispatcherFromConfig(DispatcherConfig{
+		Workers:  workers,
+		QueueCap: jobQueueCap,
+	})
+}
+
+// NewDispatcherFromConfig creates a dispatcher configured by c.
+func NewDispatcherFromConfig(c DispatcherConfig) Dispatcher {
+	log.Debugf("Creating new dispatcher with %v workers and %v queue capacity.", c.Workers, c.QueueCap)
+	if c.Scheduler == nil {
+		c.Scheduler = NewFIFOScheduler()
+	}
 	d := &dispatcherImpl{
-		jobQueue: make(chan *Job, jobQueueCap),
-		stopped:  make(chan bool),
+		started:        time.Now(),
+		jobQueue:       c.Scheduler,
+		queueCap:       c.QueueCap,
+		avgJobTime:     c.JobTimeEstimate,
+		wake:           make(chan struct{}, 1),
+		statusInterval: c.StatusInterval,
+		drained:        make(chan struct{}),
+		stopped:        make(chan struct{}),
+		closed:         make(chan struct{}),
 	}
 
-	d.start(workers)
+	d.start(c.Workers)
 	return d
 }
 
-// start starts a given number of workers, then reads from the jobQueue and
-// assigns jobs to free workers.
+// start starts a given number of workers, then takes jobs from the jobQueue
+// and assigns them to free workers.
 func (d *dispatcherImpl) start(num int) {
 	log.Debug("Dispatcher starting.")
 
-	// Workers are published on the workerQueue when they are free.
-	workerQueue := make(chan *worker, num)
-
+	d.size = num
+	workersTotal.Set(float64(num))
 	for i := 0; i < num; i++ {
-		worker := newWorker(i)
-		workerQueue <- worker
+		d.addWorker()
 	}
 
 	d.wg.Add(1)
 
+	if d.statusInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(d.statusInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					d.sendQueueStatus()
+				case <-d.closed:
+					return
+				}
+			}
+		}()
+	}
+
 	go func() {
-	Loop:
 		for {
-			// Wait for the next available worker.
-			select {
-			case <-d.stopped:
-				break Loop
-			case worker := <-workerQueue:
-				// Read the next job from the job queue.
-				select {
-				case <-d.stopped:
-					break Loop
-				case job := <-d.jobQueue:
-					job.mu.Lock()
-					cancelled := job.cancelled
-					job.mu.Unlock()
-					if cancelled {
-						log.Debugf("Dispatcher encountered cancelled job %v, rejecting.", job.id)
-						job.resultChan <- Result{
-							Success: false,
-							Events:  nil,
-						}
-						workerQueue <- worker
-					} else {
-						log.Debugf("Dispatching job %v to worker %v.", job.id, worker.id)
-						d.wg.Add(1)
-						go func() {
-							job.resultChan <- worker.run(job)
-							log.Debugf("Job %v finished on worker %v.", job.id, worker.id)
-							d.wg.Done()
-							workerQueue <- worker
-						}()
-					}
+			// Wait for an idle worker and take the next job from the job queue.
+			worker, job := d.next()
+			if job == nil {
+				break
+			}
+			job.queueTime = time.Since(job.enqueued)
+			jobDuration.Observe(job.queueTime.Seconds(), "queue")
+			if cancelled, stopped := job.state(); cancelled {
+				log.Debugf("Dispatcher encountered cancelled job %v, rejecting.", job.id)
+				outcome := OutcomeCancelled
+				if stopped {
+					outcome = OutcomeStopped
+				}
+				jobOutcomes.Inc(outcome.String())
+				job.resultChan <- Result{
+					Outcome:   outcome,
+					QueueTime: job.queueTime,
 				}
+				d.release(worker)
+			} else {
+				log.Debugf("Dispatching job %v to worker %v.", job.id, worker.id)
+				d.wg.Add(1)
+				workersBusy.Add(1)
+				go func() {
+					start := time.Now()
+					result := worker.run(job)
+					d.observeJobTime(time.Since(start))
+					job.resultChan <- result
+					log.Debugf("Job %v finished on worker %v.", job.id, worker.id)
+					workersBusy.Add(-1)
+					d.wg.Done()
+					d.release(worker)
+				}()
 			}
 		}
 
 		log.Debug("Dispatcher stopped.")
+		close(d.closed)
 
-		// Dispatcher stopped, treat all remaining jobs as cancelled.
+		// Dispatcher stopped, reject all remaining jobs.
 		for {
-			select {
-			case job := <-d.jobQueue:
-				log.Debugf("Dispatcher is stopped, rejecting job %v.", job.id)
-				job.resultChan <- Result{
-					Success: false,
-					Events:  nil,
-				}
-			default:
+			d.mu.Lock()
+			job := d.jobQueue.Pop()
+			d.mu.Unlock()
+			if job == nil {
 				log.Debug("Dispatcher job queue drained.")
 				d.wg.Done()
 				return
 			}
+			log.Debugf("Dispatcher is stopped, rejecting job %v.", job.id)
+			jobsQueued.Add(-1)
+			jobOutcomes.Inc(OutcomeStopped.String())
+			job.resultChan <- Result{
+				Outcome:   OutcomeStopped,
+				QueueTime: time.Since(job.enqueued),
+			}
 		}
 	}()
 }
 
+// next waits for a worker to be idle and a job to be queued, and assigns the
+// job to the worker, removing it from the job queue. It returns nil if the
+// dispatcher is stopped first.
+func (d *dispatcherImpl) next() (*worker, *Job) {
+	for {
+		if worker, job := d.assign(); job != nil {
+			jobsQueued.Add(-1)
+			return worker, job
+		}
+		select {
+		case <-d.stopped:
+			return nil, nil
+		case <-d.wake:
+		}
+	}
+}
+
+// wakeUp wakes up the dispatcher if it is waiting for a job or a worker.
+func (d *dispatcherImpl) wakeUp() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// observeJobTime updates the moving average of job times with the time a
+// worker spent on a job.
+func (d *dispatcherImpl) observeJobTime(t time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.avgJobTime == 0 {
+		d.avgJobTime = t
+		return
+	}
+	d.avgJobTime += time.Duration(jobTimeWeight * float64(t-d.avgJobTime))
+}
+
+// sendQueueStatus sends each job waiting for a worker a "queue" Event with its
+// position and estimated wait.
+func (d *dispatcherImpl) sendQueueStatus() {
+	d.mu.Lock()
+	jobs := d.jobQueue.Jobs()
+	avgJobTime := d.avgJobTime
+	workers := d.size
+	d.mu.Unlock()
+	// Cancelled jobs are skipped by workers, so they are not counted.
+	position := 0
+	for _, job := range jobs {
+		if cancelled, _ := job.state(); cancelled {
+			continue
+		}
+		position++
+		status := event.QueueStatus{Position: position}
+		if workers > 0 {
+			// Workers finish jobs at a rate of workers/avgJobTime, and a worker
+			// is free for the job once the jobs ahead of it and one more have
+			// finished.
+			status.Wait = time.Duration(position) * avgJobTime / time.Duration(workers)
+		}
+		job.res.Write(event.NewQueueStatus(status))
+	}
+}
+
 // Stop stops the dispatcher from assigning any new jobs to workers. Jobs that
-// are currently running are allowed to continue. Other jobs are treated as
-// cancelled. Stop blocks until all jobs have finished.
-// TODO(nlacasse): Consider letting the dispatcher run all currently queued
-// jobs, rather than rejecting them.  Or, put logic in the client to retry
-// cancelled jobs.
+// are currently running are allowed to continue. Other jobs are rejected
+// with OutcomeStopped, as are jobs queued later. Stop blocks until all jobs
+// have finished. See Drain for running the queued jobs too.
 func (d *dispatcherImpl) Stop() {
 	log.Debug("Stopping dispatcher.")
-	d.stopped <- true
+	d.close()
+	d.stop()
 
 	// Wait for workers to finish their current jobs.
 	d.wg.Wait()
 }
 
-// Enqueue queues a job to be run be the next available worker. It returns a
-// channel on which the job's results will be published.
-func (d *dispatcherImpl) Enqueue(j *Job) (chan Result, error) {
+// Drain stops the dispatcher from accepting new jobs, which Enqueue rejects
+// with ErrStopped, and keeps running the queued jobs until none are left or
+// the timeout expires. Jobs still queued at the timeout are rejected with
+// OutcomeStopped, and jobs still running are killed, their partial results
+// having OutcomeStopped too. Drain blocks until all jobs have finished.
+func (d *dispatcherImpl) Drain(timeout time.Duration) {
+	log.Debugf("Draining dispatcher for up to %v.", timeout)
+	d.close()
 	select {
-	case d.jobQueue <- j:
-		return j.resultChan, nil
-	default:
-		return nil, fmt.Errorf("Error queuing job. Job queue full.")
+	case <-d.drained:
+		log.Debug("Dispatcher drained.")
+	case <-time.After(timeout):
+		log.Warnf("Dispatcher not drained in %v, stopping remaining jobs.", timeout)
 	}
+	// No jobs are assigned once stopped, see assign.
+	d.mu.Lock()
+	d.stop()
+	for _, w := range d.pool {
+		if w.job != nil {
+			w.job.stop()
+		}
+	}
+	d.mu.Unlock()
+
+	d.wg.Wait()
 }
 
-type Result struct {
-	Success bool
-	Events  []event.Event
+// close makes Enqueue reject new jobs.
+func (d *dispatcherImpl) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closing = true
+	d.checkDrained()
 }
 
-type worker struct {
-	id int
+// stop makes the dispatcher stop assigning jobs to workers.
+func (d *dispatcherImpl) stop() {
+	d.stopOnce.Do(func() {
+		close(d.stopped)
+	})
 }
 
-func newWorker(id int) *worker {
-	return &worker{
-		id: id,
+// checkDrained closes drained if the dispatcher is closing and has no queued
+// or running jobs left. It must be called with mu held.
+func (d *dispatcherImpl) checkDrained() {
+	if !d.closing || d.jobQueue.Len() > 0 {
+		return
+	}
+	for _, w := range d.pool {
+		if w.job != nil {
+			return
+		}
+	}
+	select {
+	case <-d.drained:
+	default:
+		close(d.drained)
 	}
 }
 
+// ErrStopped is returned by Enqueue once the dispatcher is stopped or
+// draining.
+var ErrStopped = errors.New("Error queuing job. Dispatcher stopped.")
+
+// Enqueue queues a job to be run be the next available worker. It returns a
+// channel on which the job's results will be published. If the job queue is
+// full, it returns a *QueueFullError.
+func (d *dispatcherImpl) Enqueue(j *Job) (chan Result, error) {
+	d.mu.Lock()
+	if d.closing {
+		d.mu.Unlock()
+		jobOutcomes.Inc("rejected")
+		return nil, ErrStopped
+	}
+	if queued := d.jobQueue.Len(); queued >= d.queueCap {
+		d.mu.Unlock()
+		jobOutcomes.Inc("rejected")
+		return nil, &QueueFullError{
+			Queued:  queued,
+			Workers: d.size,
+		}
+	}
+	// The job is counted as queued before adding it to the queue, since the
+	// dispatcher may dequeue it immediately.
+	j.enqueued = time.Now()
+	jobsQueued.Add(1)
+	d.jobQueue.Push(j)
+	d.mu.Unlock()
+
+	d.wakeUp()
+	return j.resultChan, nil
+}
+
+// QueueFullError is returned by Enqueue when the job queue is at capacity.
+// It describes the backlog, so that callers can estimate when to retry.
+type QueueFullError struct {
+	// Number of jobs waiting in the queue.
+	Queued int
+	// Number of workers running jobs from the queue.
+	Workers int
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("Error queuing job. Job queue full (%d jobs waiting for %d workers).", e.Queued, e.Workers)
+}
+
 // run compiles and runs a job, caches the result, and returns the result on
 // the job's result channel.
 func (w *worker) run(j *Job) Result {
 	event.Debug(j.res, "Preparing to run program")
 
-	memoryFlag := fmt.Sprintf("%dm", j.dockerMem)
-
-	var cmd *exec.Cmd
-	if j.useDocker {
-		// TODO(nlacasse,ivanpi): Limit the CPU resources used by this docker
-		// builder instance.  The docker "cpu-shares" flag can only limit on
-		// docker process relative to another, so it's not useful for limiting
-		// the cpu resources of all build instances. The docker "cpuset" flag
-		// can pin the instance to a specific processor, so that might be of
-		// use.
-		cmd = docker("run", "-i",
-			"--name", j.id,
-			// Disable external networking.
-			"--net", "none",
-			// Limit instance memory.
-			"--memory", memoryFlag,
-			// Limit instance memory+swap combined.
-			// Setting to the same value as memory effectively disables swap.
-			"--memory-swap", memoryFlag,
-			"playground")
-	} else {
-		// Run builder directly, without Docker. This should only happen during
-		// development and in tests, never in production.
-		cmd = exec.Command("builder")
-
-		// Run the builder in a temp dir, so the bundle files and binaries do
-		// not clutter up the current working dir. This also allows parallel
-		// bundler runs, since otherwise the files from different runs stomp on
-		// each other.
-		tmpDir, err := ioutil.TempDir("", "pg-builder-")
-		if err != nil {
-			log.Panicf("Error creating temp dir for builder: %v\n", err)
-		} else {
-			cmd.Dir = tmpDir
-		}
+	result := Result{QueueTime: j.queueTime}
+	runner := j.newRunner(j.id)
+	prepareStart := time.Now()
+	stdin, closeStdin, err := j.stdin()
+	if err == nil {
+		defer closeStdin()
+		err = runner.Prepare()
+	}
+	result.PrepareTime = time.Since(prepareStart)
+	jobDuration.Observe(result.PrepareTime.Seconds(), "prepare")
+	if err != nil {
+		log.Error(j.id, " error preparing builder: ", err)
+		result.Outcome = OutcomeErrored
+		jobOutcomes.Inc(result.Outcome.String())
+		runner.Cleanup()
+		j.res.Write(event.New("", "stderr", "Internal error, please retry."))
+		return result
 	}
 	cmdKill := lib.DoOnce(func() {
 		event.Debug(j.res, "Killing program")
-		// The docker client can get in a state where stopping/killing/rm-ing
-		// the container will not kill the client. The opposite should work
-		// correctly (killing the docker client stops the container).
-		// If not, the docker rm call below will.
-		// Note, this wouldn't be sufficient if docker was called through sudo
-		// since sudo doesn't pass sigkill to child processes.
-		cmd.Process.Kill()
+		runner.Kill()
 	})
 
-	cmd.Stdin = bytes.NewReader(j.body)
-
 	// Builder will return all normal output as JSON Events on stdout, and will
 	// return unexpected errors on stderr.
 	// TODO(sadovsky): Security issue: what happens if the program output is huge?
@@ -327,28 +618,38 @@ func (w *worker) run(j *Job) Result {
 		cmdKill()
 	}
 
-	outRelay, outStop := event.LimitedEventRelay(j.res, j.maxSize, userLimitCallback, userErrorCallback)
-	// Builder stdout should already contain a JSON Event stream.
-	cmd.Stdout = outRelay
+	// Builder stdout should already contain a JSON Event stream. The resource
+	// usage reported in it is tallied for the result.
+	usage := &usageSink{Sink: j.res}
+	outRelay, outStop := event.LimitedEventRelay(usage, j.maxSize, userLimitCallback, userErrorCallback)
 
 	// Any stderr is unexpected, most likely a bug (panic) in builder, but could
 	// also result from a malicious exploit inside Docker.
 	// It is quietly logged as long as it doesn't exceed maxSize.
 	errBuffer := new(bytes.Buffer)
-	cmd.Stderr = lib.NewLimitedWriter(errBuffer, j.maxSize, systemLimitCallback)
+	errWriter := lib.NewLimitedWriter(errBuffer, j.maxSize, systemLimitCallback)
 
 	event.Debug(j.res, "Running program")
 
 	timeout := time.After(j.maxTime)
-	// User code execution is time limited in builder.
+	// Each builder phase (service startup, VDL generation, compilation and
+	// user code execution) is time limited in builder, which reports phases
+	// that exceed their budget to the client.
 	// This flag signals only unexpected timeouts. maxTime should be sufficient
-	// for end-to-end request processing by builder for worst-case user input.
-	// TODO(ivanpi): builder doesn't currently time compilation, so builder
-	// worst-case execution time is not clearly bounded.
+	// for end-to-end request processing by builder for worst-case user input,
+	// i.e. at least the sum of the builder phase budgets.
 	timedOut := false
-
-	exit := make(chan error)
-	go func() { exit <- cmd.Run() }()
+	// Whether the job was cancelled while running.
+	cancelledOut := false
+
+	runStart := time.Now()
+	exit := make(chan error, 1)
+	if err := runner.Start(stdin, outRelay, errWriter); err != nil {
+		log.Error(j.id, " error starting builder: ", err)
+		exit <- err
+	} else {
+		go func() { exit <- runner.Wait() }()
+	}
 
 	select {
 	case err := <-exit:
@@ -359,21 +660,40 @@ func (w *worker) run(j *Job) Result {
 		timedOut = true
 		cmdKill()
 		<-exit
+	case <-j.cancel:
+		cancelledOut = true
+		cmdKill()
+		<-exit
 	}
 
 	// Close and wait for the output relay.
 	outStop()
+	result.RunTime = time.Since(runStart)
+	result.Usage = usage.usage
+	jobDuration.Observe(result.RunTime.Seconds(), "run")
 
 	event.Debug(j.res, "Program exited")
 
 	// Return the appropriate error message to the client.
-	if timedOut {
+	if _, stopped := j.state(); cancelledOut && stopped {
+		result.Outcome = OutcomeStopped
+		j.res.Write(event.New("", "stderr", "Program killed, server shutting down."))
+	} else if cancelledOut {
+		result.Outcome = OutcomeCancelled
+		j.res.Write(event.New("", "stderr", "Program cancelled."))
+	} else if timedOut {
+		result.Outcome = OutcomeTimedOut
 		j.res.Write(event.New("", "stderr", "Internal timeout, please retry."))
 	} else if erroredOut {
+		result.Outcome = OutcomeErrored
 		j.res.Write(event.New("", "stderr", "Internal error, please retry."))
 	} else if sizedOut {
+		result.Outcome = OutcomeSizedOut
 		j.res.Write(event.New("", "stderr", "Program output too large, killed."))
+	} else {
+		result.Outcome = OutcomeSuccess
 	}
+	jobOutcomes.Inc(result.Outcome.String())
 
 	// Log builder internal errors, if any.
 	// TODO(ivanpi): Prevent caching? Report to client if debug requested?
@@ -383,36 +703,18 @@ func (w *worker) run(j *Job) Result {
 
 	event.Debug(j.res, "Response finished")
 
-	// TODO(nlacasse): This "docker rm" can be slow (several seconds), and seems
-	// to block other Docker commands, thereby slowing down other concurrent
-	// requests. We should figure out how to make it not block other Docker
-	// commands. Setting GOMAXPROCS may or may not help.
-	// See: https://github.com/docker/docker/issues/6480
-	if j.useDocker {
-		go func() {
-			docker("rm", "-f", j.id).Run()
-		}()
-	} else {
-		// Clean up after the builder process.
-		os.RemoveAll(cmd.Dir)
-	}
+	runner.Cleanup()
 
-	// If we timed out or errored out, do not cache anything.
+	// If we timed out or errored out, do not return the response, so that it
+	// is not cached.
 	// TODO(sadovsky): This policy is helpful for development, but may not be wise
 	// for production. Revisit.
-	if !timedOut && !erroredOut {
-		return Result{
-			Success: true,
-			Events:  j.res.PopWrittenEvents(),
-		}
-	} else {
-		return Result{
-			Success: false,
-			Events:  nil,
-		}
+	if cancelledOut {
+		// Whether partial responses are cached is up to the caller.
+		result.Partial = true
+		result.Events = j.res.PopWrittenEvents()
+	} else if result.Success() {
+		result.Events = j.res.PopWrittenEvents()
 	}
-}
-
-func docker(args ...string) *exec.Cmd {
-	return exec.Command("docker", args...)
+	return result
 }
@@ -7,15 +7,19 @@ package jobqueue
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"v.io/x/playground/compilerd/fakebuilder"
 	"v.io/x/playground/lib/event"
 )
 
@@ -25,24 +29,36 @@ var (
 	defaultMemLimit = 100
 )
 
-func init() {
-	// Compile builder binary and dependencies and put in path.
-	pgDir := os.ExpandEnv("${JIRI_ROOT}/release/projects/playground/go")
-	v23ReleaseDir := os.ExpandEnv("${JIRI_ROOT}/release/go")
+// Fake builder scripts, see package fakebuilder.
+const fakeBuilderTestdata = "../fakebuilder/testdata"
 
-	cmd := exec.Command("make", "builder")
-	cmd.Dir = path.Join(pgDir, "src", "v.io", "x", "playground")
-	if out, err := cmd.CombinedOutput(); err != nil {
-		fmt.Println("Error running 'make builder'")
-		fmt.Println(string(out))
-		panic(err)
-	}
+var buildBuilderOnce sync.Once
 
-	pgBinDir := path.Join(pgDir, "bin")
-	v23ReleaseBinDir := path.Join(v23ReleaseDir, "bin")
-	if err := os.Setenv("PATH", pgBinDir+":"+v23ReleaseBinDir+":"+os.Getenv("PATH")); err != nil {
-		panic(err)
+// requireBuilder compiles the builder binary and dependencies and puts them in
+// PATH. Tests that run the real builder call it first; they are skipped if
+// JIRI_ROOT is not set. Tests using the fake builder do not need it.
+func requireBuilder(t *testing.T) {
+	if os.Getenv("JIRI_ROOT") == "" {
+		t.Skip("JIRI_ROOT not set, skipping test using the real builder")
 	}
+	buildBuilderOnce.Do(func() {
+		pgDir := os.ExpandEnv("${JIRI_ROOT}/release/projects/playground/go")
+		v23ReleaseDir := os.ExpandEnv("${JIRI_ROOT}/release/go")
+
+		cmd := exec.Command("make", "builder")
+		cmd.Dir = path.Join(pgDir, "src", "v.io", "x", "playground")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			fmt.Println("Error running 'make builder'")
+			fmt.Println(string(out))
+			panic(err)
+		}
+
+		pgBinDir := path.Join(pgDir, "bin")
+		v23ReleaseBinDir := path.Join(v23ReleaseDir, "bin")
+		if err := os.Setenv("PATH", pgBinDir+":"+v23ReleaseBinDir+":"+os.Getenv("PATH")); err != nil {
+			panic(err)
+		}
+	})
 }
 
 // mockTestFile is a simple Go progam that will be sent to the dispatcher in the
@@ -86,11 +102,30 @@ type testConfig struct {
 	maxSize   int
 	maxTime   time.Duration
 	memLimit  int
+	// If set, the builder is replaced by the fake builder replaying the named
+	// script from fakeBuilderTestdata.
+	fakeScript string
 
 	// Test expectations. Default is to expect success.
 	expectEnqueueFail    bool
 	expectOutputTooLarge bool
 	expectJobFail        bool
+	// If set, the expected outcome of each job.
+	expectOutcome Outcome
+}
+
+func (c testConfig) runnerFactory(t *testing.T) RunnerFactory {
+	if c.fakeScript != "" {
+		script, err := fakebuilder.LoadFile(filepath.Join(fakeBuilderTestdata, c.fakeScript))
+		if err != nil {
+			t.Fatalf("Failed loading fake builder script: %v", err)
+		}
+		return NewFakeRunnerFactory(script.Run)
+	}
+	if c.useDocker {
+		return NewDockerRunnerFactory(c.memLimit)
+	}
+	return NewDirectRunnerFactory()
 }
 
 func newMockResponseEventSink() *event.ResponseEventSink {
@@ -109,15 +144,30 @@ func eventsMatch(events []event.Event, match string) bool {
 	return false
 }
 
+// waitForEvent waits until an event whose message matches the given string
+// is written to res.
+func waitForEvent(res *event.ResponseEventSink, match string) {
+	for {
+		events, changed := res.WrittenSince(0)
+		if eventsMatch(events, match) {
+			return
+		}
+		<-changed
+	}
+}
+
 // assertExpectedResult asserts that the result matches the test expectations
 // in the test config.
 func assertExpectedResult(t *testing.T, c testConfig, r Result) {
 	expectSuccess := !c.expectJobFail
-	if expectSuccess != r.Success {
-		t.Errorf("Expected result.Success to be %v but was %v. Test config: %#v", expectSuccess, r.Success, c)
+	if expectSuccess != r.Success() {
+		t.Errorf("Expected result.Success to be %v but was %v. Test config: %#v", expectSuccess, r.Success(), c)
+	}
+	if c.expectOutcome != 0 && c.expectOutcome != r.Outcome {
+		t.Errorf("Expected result.Outcome to be %v but was %v. Test config: %#v", c.expectOutcome, r.Outcome, c)
 	}
 
-	if !r.Success {
+	if !r.Success() {
 		return
 	}
 
@@ -145,7 +195,8 @@ func assertExpectedResult(t *testing.T, c testConfig, r Result) {
 // jobs and waits for them to finish, and asserts that they match the
 // expectations in the testConfig.
 func runTest(t *testing.T, c testConfig) {
-	fmt.Printf("Testing %v jobs on %v workers with jobCap of %v and useDocker %v\n", c.jobs, c.workers, c.jobCap, c.useDocker)
+	fmt.Printf("Testing %v jobs on %v workers with jobCap of %v and useDocker %v fakeScript %q\n", c.jobs, c.workers, c.jobCap, c.useDocker, c.fakeScript)
+	newRunner := c.runnerFactory(t)
 	d := NewDispatcher(c.workers, c.jobCap)
 
 	var enqueueError error
@@ -156,7 +207,7 @@ func runTest(t *testing.T, c testConfig) {
 	// Start all the jobs.
 	for i := 0; i < c.jobs; i++ {
 		res := newMockResponseEventSink()
-		job := NewJob(mockTestBody, res, c.maxSize, c.maxTime, c.useDocker, c.memLimit)
+		job := NewJob(mockTestBody, res, c.maxSize, c.maxTime, newRunner)
 
 		resultChan, err := d.Enqueue(job)
 		if err != nil {
@@ -202,6 +253,8 @@ func runTest(t *testing.T, c testConfig) {
 }
 
 func TestJobQueue(t *testing.T) {
+	requireBuilder(t)
+
 	// Test success cases without docker.
 	runTest(t, testConfig{
 		jobs:      1,
@@ -358,24 +411,119 @@ func TestJobQueue(t *testing.T) {
 	})
 }
 
+// TestJobQueueFakeBuilder runs the event relay and job error handling against
+// scripted builder misbehaviour. It does not need JIRI_ROOT.
+func TestJobQueueFakeBuilder(t *testing.T) {
+	// Test success cases.
+	runTest(t, testConfig{
+		jobs:          1,
+		workers:       1,
+		jobCap:        1,
+		maxSize:       defaultMaxSize,
+		maxTime:       defaultMaxTime,
+		fakeScript:    "hello.json",
+		expectOutcome: OutcomeSuccess,
+	})
+
+	runTest(t, testConfig{
+		jobs:       6,
+		workers:    3,
+		jobCap:     10,
+		maxSize:    defaultMaxSize,
+		maxTime:    defaultMaxTime,
+		fakeScript: "slow.json",
+	})
+
+	// Test stderr noise is logged, but does not fail the job.
+	runTest(t, testConfig{
+		jobs:       1,
+		workers:    1,
+		jobCap:     1,
+		maxSize:    defaultMaxSize,
+		maxTime:    defaultMaxTime,
+		fakeScript: "stderr.json",
+	})
+
+	// Test Enqueue should fail when job capacity is exceeded.
+	runTest(t, testConfig{
+		jobs:              5,
+		workers:           2,
+		jobCap:            2,
+		maxSize:           defaultMaxSize,
+		maxTime:           defaultMaxTime,
+		fakeScript:        "slow.json",
+		expectEnqueueFail: true,
+	})
+
+	// Test job should be killed if it exceeds size limit.
+	runTest(t, testConfig{
+		jobs:                 1,
+		workers:              1,
+		jobCap:               1,
+		maxSize:              defaultMaxSize,
+		maxTime:              defaultMaxTime,
+		fakeScript:           "oversized.json",
+		expectOutputTooLarge: true,
+		expectOutcome:        OutcomeSizedOut,
+	})
+
+	// Test job should fail if builder output is not a valid event stream.
+	runTest(t, testConfig{
+		jobs:          1,
+		workers:       1,
+		jobCap:        1,
+		maxSize:       defaultMaxSize,
+		maxTime:       defaultMaxTime,
+		fakeScript:    "malformed.json",
+		expectJobFail: true,
+		expectOutcome: OutcomeErrored,
+	})
+
+	// Test job should fail if builder crashes.
+	runTest(t, testConfig{
+		jobs:          1,
+		workers:       1,
+		jobCap:        1,
+		maxSize:       defaultMaxSize,
+		maxTime:       defaultMaxTime,
+		fakeScript:    "crash.json",
+		expectJobFail: true,
+		expectOutcome: OutcomeErrored,
+	})
+
+	// Test job should fail if it exceeds max time.
+	runTest(t, testConfig{
+		jobs:          1,
+		workers:       1,
+		jobCap:        1,
+		maxSize:       defaultMaxSize,
+		maxTime:       1 * time.Second,
+		fakeScript:    "hang.json",
+		expectJobFail: true,
+		expectOutcome: OutcomeTimedOut,
+	})
+}
+
 func TestJobCancel(t *testing.T) {
+	requireBuilder(t)
+
 	d := NewDispatcher(1, 10)
 
 	// Create five jobs.
 	res1 := newMockResponseEventSink()
-	job1 := NewJob(mockTestBody, res1, defaultMaxSize, defaultMaxTime, false, defaultMemLimit)
+	job1 := NewJob(mockTestBody, res1, defaultMaxSize, defaultMaxTime, NewDirectRunnerFactory())
 
 	res2 := newMockResponseEventSink()
-	job2 := NewJob(mockTestBody, res2, defaultMaxSize, defaultMaxTime, false, defaultMemLimit)
+	job2 := NewJob(mockTestBody, res2, defaultMaxSize, defaultMaxTime, NewDirectRunnerFactory())
 
 	res3 := newMockResponseEventSink()
-	job3 := NewJob(mockTestBody, res3, defaultMaxSize, defaultMaxTime, false, defaultMemLimit)
+	job3 := NewJob(mockTestBody, res3, defaultMaxSize, defaultMaxTime, NewDirectRunnerFactory())
 
 	res4 := newMockResponseEventSink()
-	job4 := NewJob(mockTestBody, res4, defaultMaxSize, defaultMaxTime, false, defaultMemLimit)
+	job4 := NewJob(mockTestBody, res4, defaultMaxSize, defaultMaxTime, NewDirectRunnerFactory())
 
 	res5 := newMockResponseEventSink()
-	job5 := NewJob(mockTestBody, res5, defaultMaxSize, defaultMaxTime, false, defaultMemLimit)
+	job5 := NewJob(mockTestBody, res5, defaultMaxSize, defaultMaxTime, NewDirectRunnerFactory())
 
 	// Cancel first job right away.
 	job1.Cancel()
@@ -421,21 +569,255 @@ func TestJobCancel(t *testing.T) {
 	r5 := <-resultChan5
 
 	// Check that jobs 1 and 4 failed.
-	if r1.Success {
+	if r1.Success() {
 		t.Errorf("Expected job 1 to fail but it succeeded.")
 	}
-	if r4.Success {
+	if r4.Success() {
 		t.Errorf("Expected job 4 to fail but it succeeded.")
 	}
+	if r1.Outcome != OutcomeCancelled || r4.Outcome != OutcomeCancelled {
+		t.Errorf("Expected jobs 1 and 4 to be cancelled, got %v and %v", r1.Outcome, r4.Outcome)
+	}
 
-	// Check that jobs 2, 3, and 5 succeeded.
-	if !r2.Success {
+	// Check that jobs 2 and 3 succeeded.
+	if !r2.Success() {
 		t.Errorf("Expected job 2 to succeed but it failed.")
 	}
-	if !r3.Success {
+	if !r3.Success() {
 		t.Errorf("Expected job 3 to succeed but it failed.")
 	}
-	if !r5.Success {
-		t.Errorf("Expected job 5 to succeed but it failed.")
+
+	// Check that job 5 was killed, with a partial result.
+	if r5.Success() || !r5.Partial {
+		t.Errorf("Expected job 5 to fail with a partial result, got %#v", r5)
+	}
+}
+
+func TestJobCancelRunning(t *testing.T) {
+	script, err := fakebuilder.LoadFile(filepath.Join(fakeBuilderTestdata, "hang.json"))
+	if err != nil {
+		t.Fatalf("Failed loading fake builder script: %v", err)
+	}
+	d := NewDispatcher(1, 1)
+	defer d.Stop()
+
+	res := newMockResponseEventSink()
+	job := NewJob(mockTestBody, res, defaultMaxSize, defaultMaxTime, NewFakeRunnerFactory(script.Run))
+	resultChan, err := d.Enqueue(job)
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+
+	// Wait for the program to start, then cancel it. The job would otherwise
+	// hang until defaultMaxTime.
+	waitForEvent(res, "PROGRAM START")
+	job.Cancel()
+	// Cancelling again is harmless.
+	job.Cancel()
+
+	select {
+	case r := <-resultChan:
+		if r.Outcome != OutcomeCancelled || !r.Partial {
+			t.Errorf("Expected a partial result, got %#v", r)
+		}
+		for _, want := range []string{"PROGRAM START", "Program cancelled."} {
+			if !eventsMatch(r.Events, want) {
+				t.Errorf("Event message %v not found in %#v", want, r.Events)
+			}
+		}
+	case <-time.After(defaultMaxTime / 2):
+		t.Fatalf("Cancelled job did not finish promptly.")
+	}
+}
+
+// processGone returns true iff the process does not exist or is a zombie.
+func processGone(pid int) bool {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	// The state follows the parenthesized command name.
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) == 0 || fields[0] == "Z"
+}
+
+func TestJobCancelKillsProcesses(t *testing.T) {
+	binDir, err := ioutil.TempDir("", "pg-fake-builder-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(binDir)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	// The builder ignores SIGTERM, as it would if it hung, and has a child
+	// that does too. Both have to be killed.
+	pidFile := filepath.Join(binDir, "pids")
+	script := `#!/bin/sh
+trap '' TERM
+sleep 30 &
+echo $! $$ > ` + pidFile + `
+echo '{"File": "src/main/main.go", "Stream": "stdout", "Message": "PROGRAM START"}'
+wait
+`
+	if err := ioutil.WriteFile(filepath.Join(binDir, "builder"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDispatcher(1, 1)
+	defer d.Stop()
+	res := newMockResponseEventSink()
+	job := NewJob(mockTestBody, res, defaultMaxSize, defaultMaxTime, NewDirectRunnerFactory())
+	resultChan, err := d.Enqueue(job)
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	waitForEvent(res, "PROGRAM START")
+	job.Cancel()
+
+	select {
+	case r := <-resultChan:
+		if r.Outcome != OutcomeCancelled {
+			t.Errorf("Expected a cancelled result, got %#v", r)
+		}
+	case <-time.After(defaultMaxTime / 2):
+		t.Fatalf("Cancelled job did not finish promptly.")
+	}
+	body, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range strings.Fields(string(body)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !processGone(pid) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Errorf("Expected process %d to be killed with the job", pid)
+		}
+	}
+}
+
+func TestQueueStatusEvents(t *testing.T) {
+	script, err := fakebuilder.LoadFile(filepath.Join(fakeBuilderTestdata, "hang.json"))
+	if err != nil {
+		t.Fatalf("Failed loading fake builder script: %v", err)
+	}
+	newRunner := NewFakeRunnerFactory(script.Run)
+	d := NewDispatcherFromConfig(DispatcherConfig{
+		Workers:         1,
+		QueueCap:        10,
+		StatusInterval:  10 * time.Millisecond,
+		JobTimeEstimate: time.Second,
+	})
+	defer d.Stop()
+
+	// The first job keeps the only worker busy until cancelled.
+	var jobs []*Job
+	var resultChans []chan Result
+	for i := 0; i < 3; i++ {
+		job := NewJob(mockTestBody, newMockResponseEventSink(), defaultMaxSize, defaultMaxTime, newRunner)
+		resultChan, err := d.Enqueue(job)
+		if err != nil {
+			t.Fatalf("Enqueue failed: %v", err)
+		}
+		jobs = append(jobs, job)
+		resultChans = append(resultChans, resultChan)
+		if i == 0 {
+			waitForEvent(job.res, "PROGRAM START")
+		}
+	}
+
+	for i, want := range []event.QueueStatus{{Position: 1, Wait: time.Second}, {Position: 2, Wait: 2 * time.Second}} {
+		job := jobs[i+1]
+		waitForEvent(job.res, "Service busy")
+		events, _ := job.res.WrittenSince(0)
+		if e := events[0]; e.Stream != "queue" || e.Queue == nil || *e.Queue != want {
+			t.Errorf("Expected queue status %+v for job %d, got %#v", want, i+2, e)
+		}
+	}
+
+	for _, job := range jobs {
+		job.Cancel()
+	}
+	for _, resultChan := range resultChans {
+		<-resultChan
+	}
+}
+
+func newFakeJob(newRunner RunnerFactory) *Job {
+	return NewJob(mockTestBody, newMockResponseEventSink(), defaultMaxSize, defaultMaxTime, newRunner)
+}
+
+func TestDrain(t *testing.T) {
+	slow, _ := countingRunnerFactory(t, "slow.json")
+	hello, runs := countingRunnerFactory(t, "hello.json")
+	d := NewDispatcher(1, 10)
+
+	// The first job keeps the only worker busy while the others are queued.
+	job := newFakeJob(slow)
+	resultChans := []chan Result{enqueue(t, d, job)}
+	waitForEvent(job.res, "PROGRAM START")
+	for i := 0; i < 2; i++ {
+		resultChans = append(resultChans, enqueue(t, d, newFakeJob(hello)))
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		d.Drain(time.Minute)
+		close(drained)
+	}()
+	// New jobs are rejected once draining starts.
+	for impl := d.(*dispatcherImpl); ; time.Sleep(time.Millisecond) {
+		impl.mu.Lock()
+		closing := impl.closing
+		impl.mu.Unlock()
+		if closing {
+			break
+		}
+	}
+	if _, err := d.Enqueue(newFakeJob(hello)); err != ErrStopped {
+		t.Errorf("Expected ErrStopped, got %v", err)
+	}
+
+	// The queued jobs still run.
+	for i, resultChan := range resultChans {
+		if r := <-resultChan; !r.Success() {
+			t.Errorf("Expected job %d to succeed, got %#v", i+1, r)
+		}
+	}
+	<-drained
+	if got, want := runs(), 2; got != want {
+		t.Errorf("Expected builder to run %d times, got %d", want, got)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	hang, _ := countingRunnerFactory(t, "hang.json")
+	hello, runs := countingRunnerFactory(t, "hello.json")
+	d := NewDispatcher(1, 10)
+
+	job := newFakeJob(hang)
+	runningResult := enqueue(t, d, job)
+	waitForEvent(job.res, "PROGRAM START")
+	queuedResult := enqueue(t, d, newFakeJob(hello))
+
+	// The running job is killed and the queued job rejected at the timeout.
+	d.Drain(100 * time.Millisecond)
+	r := <-runningResult
+	if r.Outcome != OutcomeStopped || !r.Partial {
+		t.Errorf("Expected running job to be stopped with a partial result, got %#v", r)
+	}
+	for _, want := range []string{"PROGRAM START", "Program killed, server shutting down."} {
+		if !eventsMatch(r.Events, want) {
+			t.Errorf("Event message %v not found in %#v", want, r.Events)
+		}
+	}
+	if r := <-queuedResult; r.Outcome != OutcomeStopped || r.Partial {
+		t.Errorf("Expected queued job to be stopped, got %#v", r)
+	}
+	if got := runs(); got != 0 {
+		t.Errorf("Expected queued job not to run, ran %d times", got)
 	}
 }
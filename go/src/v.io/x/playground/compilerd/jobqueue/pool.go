@@ -0,0 +1,203 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Worker pool of the dispatcher.
+//
+// The number of workers can be changed while the dispatcher runs, see
+// Resize. Added workers take jobs immediately. Removed workers are taken from
+// the idle ones first; busy ones are marked as retiring and removed once
+// their current job finishes, so that no running job is interrupted.
+
+package jobqueue
+
+import (
+	"time"
+
+	"v.io/x/playground/lib/log"
+	"v.io/x/playground/lib/metrics"
+)
+
+var workersTotal = metrics.NewGauge("playground_workers", "Number of workers the dispatcher keeps, not counting retiring workers finishing their last job.")
+
+// Stats describes the job queue and workers of a dispatcher.
+type Stats struct {
+	// Number of jobs waiting for a worker.
+	Queued int
+	// Number of workers running a job.
+	Running int
+	// Number of workers the dispatcher keeps. There may be more workers while
+	// retiring workers finish their jobs.
+	Size int
+	// Time since the dispatcher was created.
+	Uptime time.Duration
+	// All workers, including retiring ones, in the order they were added.
+	Workers []WorkerStats
+}
+
+// WorkerStats describes a worker of a dispatcher.
+type WorkerStats struct {
+	ID int
+	// Time since the worker was added.
+	Uptime time.Duration
+	// ID of the job the worker is running and time it has been running, or
+	// empty if the worker is idle.
+	Job     string
+	JobTime time.Duration
+	// Whether the worker will be removed once its job finishes.
+	Retiring bool
+}
+
+type worker struct {
+	id      int
+	started time.Time
+
+	// The fields below are protected by the dispatcher's mu.
+
+	// The job the worker is running, if any, and the time it was assigned.
+	job        *Job
+	jobStarted time.Time
+	// Set when the pool shrinks while the worker is busy.
+	retiring bool
+}
+
+func newWorker(id int) *worker {
+	return &worker{
+		id:      id,
+		started: time.Now(),
+	}
+}
+
+// Stats returns the current state of the job queue and workers.
+func (d *dispatcherImpl) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	s := Stats{
+		Queued: d.jobQueue.Len(),
+		Size:   d.size,
+		Uptime: now.Sub(d.started),
+	}
+	for _, w := range d.pool {
+		ws := WorkerStats{
+			ID:       w.id,
+			Uptime:   now.Sub(w.started),
+			Retiring: w.retiring,
+		}
+		if w.job != nil {
+			s.Running++
+			ws.Job = w.job.id
+			ws.JobTime = now.Sub(w.jobStarted)
+		}
+		s.Workers = append(s.Workers, ws)
+	}
+	return s
+}
+
+// Resize sets the number of workers to n. Running jobs are not interrupted:
+// when shrinking the pool, idle workers are removed first, and busy workers
+// are removed once their current job finishes.
+func (d *dispatcherImpl) Resize(n int) {
+	if n < 0 {
+		n = 0
+	}
+	d.mu.Lock()
+	log.Debugf("Resizing dispatcher from %d to %d workers.", d.size, n)
+	d.size = n
+	workersTotal.Set(float64(n))
+
+	active := 0
+	for _, w := range d.pool {
+		if !w.retiring {
+			active++
+		}
+	}
+	// Retiring workers are kept rather than replaced by new ones.
+	for _, w := range d.pool {
+		if active >= n {
+			break
+		}
+		if w.retiring {
+			w.retiring = false
+			active++
+		}
+	}
+	for ; active < n; active++ {
+		d.addWorker()
+	}
+	for active > n && len(d.idle) > 0 {
+		w := d.idle[len(d.idle)-1]
+		d.idle = d.idle[:len(d.idle)-1]
+		d.removeWorker(w)
+		active--
+	}
+	// The remaining workers are all busy. The most recently added ones retire.
+	for i := len(d.pool) - 1; active > n; i-- {
+		if w := d.pool[i]; !w.retiring {
+			log.Debugf("Worker %v retiring after job %v.", w.id, w.job.id)
+			w.retiring = true
+			active--
+		}
+	}
+	d.mu.Unlock()
+
+	d.wakeUp()
+}
+
+// addWorker adds an idle worker to the pool. It must be called with mu held.
+func (d *dispatcherImpl) addWorker() {
+	w := newWorker(d.nextWorkerID)
+	d.nextWorkerID++
+	d.pool = append(d.pool, w)
+	d.idle = append(d.idle, w)
+}
+
+// removeWorker removes the worker from the pool. It must be called with mu
+// held, and the worker must not be in d.idle: idle workers are taken out of
+// it by the caller first.
+func (d *dispatcherImpl) removeWorker(w *worker) {
+	for i, pw := range d.pool {
+		if pw == w {
+			d.pool = append(d.pool[:i], d.pool[i+1:]...)
+			return
+		}
+	}
+}
+
+// assign removes an idle worker from the pool and assigns it the next job
+// from the job queue. It returns nil if no worker is idle, no job is queued or
+// the dispatcher is stopped.
+func (d *dispatcherImpl) assign() (*worker, *Job) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	select {
+	case <-d.stopped:
+		return nil, nil
+	default:
+	}
+	if len(d.idle) == 0 || d.jobQueue.Len() == 0 {
+		return nil, nil
+	}
+	w := d.idle[0]
+	d.idle = d.idle[1:]
+	w.job = d.jobQueue.Pop()
+	w.jobStarted = time.Now()
+	return w, w.job
+}
+
+// release makes the worker available for the next job after it has finished
+// its current job, or removes it from the pool if it is retiring.
+func (d *dispatcherImpl) release(w *worker) {
+	d.mu.Lock()
+	w.job = nil
+	if w.retiring {
+		log.Debugf("Worker %v retired.", w.id)
+		d.removeWorker(w)
+	} else {
+		d.idle = append(d.idle, w)
+	}
+	d.checkDrained()
+	d.mu.Unlock()
+
+	d.wakeUp()
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jobqueue
+
+import (
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// workerIDs returns the IDs of the workers, and the IDs of the jobs they are
+// running.
+func workerIDs(s Stats) ([]int, []string) {
+	var ids []int
+	var jobs []string
+	for _, ws := range s.Workers {
+		ids = append(ids, ws.ID)
+		jobs = append(jobs, ws.Job)
+	}
+	return ids, jobs
+}
+
+func TestResize(t *testing.T) {
+	// The fake builder reports the jobs it starts, and runs them until finish
+	// is closed.
+	started := make(chan string, 10)
+	finish := make(chan struct{})
+	run := func(stdin io.Reader, stdout, stderr io.Writer, killed <-chan struct{}) error {
+		body, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		started <- string(body)
+		select {
+		case <-finish:
+		case <-killed:
+		}
+		return nil
+	}
+	newRunner := NewFakeRunnerFactory(run)
+	d := NewDispatcher(1, 10)
+
+	job1 := newScheduledJob("a", "a", PriorityNormal, newRunner)
+	resultChan1 := enqueue(t, d, job1)
+	<-started
+	job2 := newScheduledJob("b", "b", PriorityNormal, newRunner)
+	resultChan2 := enqueue(t, d, job2)
+	s := d.Stats()
+	if s.Size != 1 || s.Running != 1 || s.Queued != 1 {
+		t.Errorf("Expected 1 worker running 1 job with 1 job queued, got %#v", s)
+	}
+
+	// The added worker takes the queued job.
+	d.Resize(2)
+	if got := <-started; got != "b" {
+		t.Errorf("Expected job b to start, got %s", got)
+	}
+	s = d.Stats()
+	if s.Size != 2 || s.Running != 2 || s.Queued != 0 {
+		t.Errorf("Expected 2 workers running 2 jobs with no job queued, got %#v", s)
+	}
+	ids, jobs := workerIDs(s)
+	if want := []int{0, 1}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("Expected workers %v, got %v", want, ids)
+	}
+	if want := []string{job1.id, job2.id}; !reflect.DeepEqual(jobs, want) {
+		t.Errorf("Expected worker jobs %v, got %v", want, jobs)
+	}
+
+	// Both workers are busy, so the most recent one retires after its job.
+	d.Resize(1)
+	s = d.Stats()
+	if s.Size != 1 || len(s.Workers) != 2 || s.Workers[0].Retiring || !s.Workers[1].Retiring {
+		t.Errorf("Expected worker 1 to be retiring, got %#v", s)
+	}
+	// Growing the pool again keeps the retiring worker.
+	d.Resize(2)
+	s = d.Stats()
+	if s.Size != 2 || len(s.Workers) != 2 || s.Workers[1].Retiring {
+		t.Errorf("Expected worker 1 to be kept, got %#v", s)
+	}
+	d.Resize(1)
+
+	// Running jobs are not interrupted.
+	close(finish)
+	for i, resultChan := range []chan Result{resultChan1, resultChan2} {
+		if r := <-resultChan; !r.Success() {
+			t.Errorf("Expected job %d to succeed, got %#v", i+1, r)
+		}
+	}
+	// The retiring worker is removed once its result is sent.
+	for deadline := time.Now().Add(time.Second); len(d.Stats().Workers) != 1 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ids, _ := workerIDs(d.Stats()); !reflect.DeepEqual(ids, []int{0}) {
+		t.Errorf("Expected workers [0], got %v", ids)
+	}
+
+	// Idle workers are added and removed immediately.
+	d.Resize(3)
+	if ids, _ := workerIDs(d.Stats()); !reflect.DeepEqual(ids, []int{0, 2, 3}) {
+		t.Errorf("Expected workers [0 2 3], got %v", ids)
+	}
+	d.Resize(2)
+	if s := d.Stats(); s.Size != 2 || len(s.Workers) != 2 || s.Running != 0 {
+		t.Errorf("Expected 2 idle workers, got %#v", s)
+	}
+	if r := <-enqueue(t, d, newScheduledJob("c", "c", PriorityNormal, newRunner)); !r.Success() {
+		t.Errorf("Expected job to succeed, got %#v", r)
+	}
+	d.Stop()
+}
@@ -0,0 +1,135 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Results of finished jobs.
+
+package jobqueue
+
+import (
+	"fmt"
+	"time"
+
+	"v.io/x/playground/lib/event"
+)
+
+// Outcome describes how a job finished.
+type Outcome int
+
+const (
+	// The builder ran to completion.
+	OutcomeSuccess Outcome = iota + 1
+	// The builder was killed because the program output exceeded the size
+	// limit. The output up to the limit is still a valid response.
+	OutcomeSizedOut
+	// The builder was killed because it exceeded the job's time limit.
+	OutcomeTimedOut
+	// The builder could not be run, crashed, or produced invalid output.
+	OutcomeErrored
+	// The job was cancelled, either while waiting in the queue or while
+	// running (see Result.Partial).
+	OutcomeCancelled
+	// The job was not run because the dispatcher was stopped.
+	OutcomeStopped
+)
+
+// String returns the outcome as used in metrics and status events, e.g.
+// "timed_out".
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeSuccess:
+		return "success"
+	case OutcomeSizedOut:
+		return "sized_out"
+	case OutcomeTimedOut:
+		return "timed_out"
+	case OutcomeErrored:
+		return "errored"
+	case OutcomeCancelled:
+		return "cancelled"
+	case OutcomeStopped:
+		return "stopped"
+	default:
+		return fmt.Sprintf("Outcome(%d)", int(o))
+	}
+}
+
+// Usage is the resources used by the user code of a job, as reported by
+// builder.
+type Usage struct {
+	// CPU time spent by user processes in user and system mode.
+	UserTime   time.Duration
+	SystemTime time.Duration
+	// Largest maximum resident set size of any user process, in kilobytes.
+	MaxRSS int64
+	// Size of the program output, i.e. of "stdout" and "stderr" messages, in
+	// bytes.
+	OutputBytes int
+}
+
+// add tallies the resources reported by e.
+func (u *Usage) add(e event.Event) {
+	switch e.Stream {
+	case "stdout", "stderr":
+		u.OutputBytes += len(e.Message)
+	case "exit":
+		if e.Exit != nil {
+			u.UserTime += e.Exit.UserTime
+			u.SystemTime += e.Exit.SystemTime
+			if e.Exit.MaxRSS > u.MaxRSS {
+				u.MaxRSS = e.Exit.MaxRSS
+			}
+		}
+	}
+}
+
+// usageSink is an event.Sink that tallies the resource usage reported by the
+// Events written to it before passing them on.
+type usageSink struct {
+	event.Sink
+	usage Usage
+}
+
+func (s *usageSink) Write(events ...event.Event) error {
+	for _, e := range events {
+		s.usage.add(e)
+	}
+	return s.Sink.Write(events...)
+}
+
+type Result struct {
+	Outcome Outcome
+	// Whether the job was cancelled while running. Events then contain the
+	// response up to that point.
+	Partial bool
+	// The response, if the job succeeded or is partial.
+	Events []event.Event
+
+	// Time spent waiting in the queue, preparing the builder and running it.
+	QueueTime   time.Duration
+	PrepareTime time.Duration
+	RunTime     time.Duration
+	Usage       Usage
+}
+
+// Success returns whether the job produced a complete response, possibly with
+// the output truncated.
+func (r Result) Success() bool {
+	return r.Outcome == OutcomeSuccess || r.Outcome == OutcomeSizedOut
+}
+
+// StatusEvent returns a "status" stream Event describing the result, to be
+// sent to the client after the job's other Events.
+func (r Result) StatusEvent() event.Event {
+	msg := fmt.Sprintf("Job %v (queued %v, prepared %v, ran %v).", r.Outcome, r.QueueTime, r.PrepareTime, r.RunTime)
+	return event.NewJobStatus(msg, event.JobStatus{
+		Outcome:     r.Outcome.String(),
+		QueueTime:   r.QueueTime,
+		PrepareTime: r.PrepareTime,
+		RunTime:     r.RunTime,
+		UserTime:    r.Usage.UserTime,
+		SystemTime:  r.Usage.SystemTime,
+		MaxRSS:      r.Usage.MaxRSS,
+		OutputBytes: r.Usage.OutputBytes,
+	})
+}
@@ -0,0 +1,66 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jobqueue
+
+import (
+	"testing"
+	"time"
+
+	"v.io/x/playground/lib/event"
+)
+
+func TestUsageSink(t *testing.T) {
+	res := newMockResponseEventSink()
+	s := &usageSink{Sink: res}
+	s.Write(
+		event.New("a.go", "stdout", "hello"),
+		event.New("a.go", "debug", "not output"),
+		event.NewExit("a.go", "Exited cleanly.", event.ExitStatus{UserTime: time.Second, SystemTime: time.Millisecond, MaxRSS: 100}),
+	)
+	s.Write(
+		event.New("b.go", "stderr", "oops"),
+		event.NewExit("b.go", "Exited cleanly.", event.ExitStatus{UserTime: time.Second, MaxRSS: 50}),
+		// Exit events from older builders carry no status.
+		event.New("c.go", "exit", "Exited cleanly."),
+	)
+	want := Usage{
+		UserTime:    2 * time.Second,
+		SystemTime:  time.Millisecond,
+		MaxRSS:      100,
+		OutputBytes: len("hello") + len("oops"),
+	}
+	if s.usage != want {
+		t.Errorf("Expected usage %+v, got %+v", want, s.usage)
+	}
+	if got := len(res.PopWrittenEvents()); got != 6 {
+		t.Errorf("Expected 6 events to be passed on, got %d", got)
+	}
+}
+
+func TestResultStatusEvent(t *testing.T) {
+	r := Result{
+		Outcome:   OutcomeSizedOut,
+		QueueTime: time.Second,
+		RunTime:   2 * time.Second,
+		Usage:     Usage{MaxRSS: 100, OutputBytes: 10},
+	}
+	if !r.Success() {
+		t.Errorf("Expected sized out result to be a success.")
+	}
+	e := r.StatusEvent()
+	if e.Stream != "status" || e.Status == nil {
+		t.Fatalf("Expected a status event, got %#v", e)
+	}
+	want := event.JobStatus{
+		Outcome:     "sized_out",
+		QueueTime:   time.Second,
+		RunTime:     2 * time.Second,
+		MaxRSS:      100,
+		OutputBytes: 10,
+	}
+	if *e.Status != want {
+		t.Errorf("Expected status %+v, got %+v", want, *e.Status)
+	}
+}
@@ -0,0 +1,420 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Runners execute a builder instance for a job. The available runners are:
+//   - docker:  runs the builder in a Docker container (production),
+//   - sandbox: runs the builder in a native Linux sandbox (see
+//              sandbox_linux.go),
+//   - direct:  runs the builder binary directly, with no isolation
+//              (development and tests only),
+//   - fake:    runs a Go function in place of the builder (tests only).
+
+package jobqueue
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"v.io/x/playground/lib"
+)
+
+// Runner runs a single builder instance. A new Runner is created for every
+// job by the job's RunnerFactory. Methods are called in order: Prepare,
+// Start, Wait, Cleanup. Kill may be called at any time after Start, possibly
+// concurrently with Wait and more than once.
+type Runner interface {
+	// Prepare sets up the environment for the builder.
+	Prepare() error
+	// Start starts the builder. The bundle is passed on stdin. The builder
+	// writes JSON-encoded events to stdout, and unexpected errors to stderr.
+	Start(stdin io.Reader, stdout, stderr io.Writer) error
+	// Wait waits for the builder to exit.
+	Wait() error
+	// Kill forcibly stops the builder.
+	Kill()
+	// Cleanup releases any resources held by the runner. It is called even
+	// if Prepare or Start fail.
+	Cleanup()
+}
+
+// RunnerFactory creates a Runner for the job with the given unique id.
+type RunnerFactory func(id string) Runner
+
+// Time the command has to exit after SIGTERM before its process group is
+// killed.
+const killGracePeriod = time.Second
+
+// cmdRunner is a Runner that executes a command in its own process group.
+//
+// Builder runs the processes it starts in their own process groups, which
+// killing builder would orphan. Instead, Kill sends SIGTERM to builder, which
+// kills these groups before exiting (see builder/groups.go), and kills the
+// command's process group if it has not exited within killGracePeriod.
+type cmdRunner struct {
+	cmd *exec.Cmd
+
+	mu     sync.Mutex
+	exited bool
+}
+
+// setpgid makes cmd run in its own process group.
+func setpgid(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+func (r *cmdRunner) Start(stdin io.Reader, stdout, stderr io.Writer) error {
+	r.cmd.Stdin = stdin
+	r.cmd.Stdout = stdout
+	r.cmd.Stderr = stderr
+	setpgid(r.cmd)
+	return r.cmd.Start()
+}
+
+func (r *cmdRunner) Wait() error {
+	err := r.cmd.Wait()
+	r.mu.Lock()
+	r.exited = true
+	r.mu.Unlock()
+	return err
+}
+
+func (r *cmdRunner) Kill() {
+	if r.cmd == nil || r.cmd.Process == nil {
+		return
+	}
+	r.cmd.Process.Signal(syscall.SIGTERM)
+	pid := r.cmd.Process.Pid
+	time.AfterFunc(killGracePeriod, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		// Once the command has been waited for, its pid may be reused.
+		if !r.exited {
+			syscall.Kill(-pid, syscall.SIGKILL)
+		}
+	})
+}
+
+////////////////////////////////////////
+// Docker runner
+
+// Killing the docker client stops the container. The SIGTERM sent by Kill is
+// proxied by the docker client to builder in the container. The docker client
+// can get in a state where stopping/killing/rm-ing the container will not
+// kill the client, but the opposite should work correctly. If not, the docker
+// rm call queued by Cleanup will.
+// Note, this wouldn't be sufficient if docker was called through sudo since
+// sudo doesn't pass sigkill to child processes.
+type dockerRunner struct {
+	cmdRunner
+	id    string
+	memMB int
+	// Containers are taken from pool, if not nil, and removed through cleanup,
+	// see docker_pool.go.
+	pool    *containerPool
+	cleanup *cleanupQueue
+	// Name of the container used by the job.
+	name string
+}
+
+// DockerConfig configures the Docker runner.
+type DockerConfig struct {
+	// Memory limit per container, in megabytes.
+	MemoryMB int
+	// Number of containers created ahead of jobs. They are only started when
+	// a job takes them, so they use no memory while idle. If 0, every job
+	// runs its own container.
+	PoolSize int
+	// Maximum number of finished containers waiting to be removed. Containers
+	// finishing while the queue is full are left behind until the next
+	// startup. Defaults to 100.
+	CleanupQueueCap int
+	// Number of workers removing containers. Defaults to 3.
+	CleanupWorkers int
+	// Number of times a failed container removal is retried.
+	CleanupRetries int
+}
+
+const (
+	defaultCleanupQueueCap = 100
+	defaultCleanupWorkers  = 3
+	// Delay before retrying a failed container removal, multiplied by the
+	// number of the retry.
+	cleanupRetryDelay = time.Second
+	// Delay before starting a container for the pool after a failure.
+	poolRetryDelay = 5 * time.Second
+)
+
+// NewDockerRunnerFactory returns a RunnerFactory for running builder in the
+// "playground" Docker image, with memMB of memory per instance.
+func NewDockerRunnerFactory(memMB int) RunnerFactory {
+	newRunner, _ := NewDockerRunnerFactoryFromConfig(DockerConfig{MemoryMB: memMB})
+	return newRunner
+}
+
+// NewDockerRunnerFactoryFromConfig returns a RunnerFactory for running
+// builder in the "playground" Docker image, configured by c, and a function
+// removing the pooled containers, to be called once all jobs have finished.
+// Builder containers left behind by previous instances are removed.
+func NewDockerRunnerFactoryFromConfig(c DockerConfig) (RunnerFactory, func()) {
+	if c.CleanupQueueCap <= 0 {
+		c.CleanupQueueCap = defaultCleanupQueueCap
+	}
+	if c.CleanupWorkers <= 0 {
+		c.CleanupWorkers = defaultCleanupWorkers
+	}
+	cleanup := newCleanupQueue(c.CleanupQueueCap, c.CleanupWorkers, c.CleanupRetries, cleanupRetryDelay, func(name string) error {
+		return runDocker("kill", name)
+	}, func(name string) error {
+		return runDocker("rm", "-f", name)
+	})
+	removeStaleContainers(listBuilderContainers, cleanup)
+	var pool *containerPool
+	if c.PoolSize > 0 {
+		pool = newContainerPool(c.PoolSize, poolRetryDelay, func(name string) error {
+			return runDocker(dockerCreateArgs(name, c.MemoryMB)...)
+		}, cleanup)
+	}
+	newRunner := func(id string) Runner {
+		return &dockerRunner{id: id, memMB: c.MemoryMB, pool: pool, cleanup: cleanup}
+	}
+	return newRunner, func() {
+		pool.close()
+		cleanup.close()
+	}
+}
+
+// dockerRunArgs returns the docker arguments for running a builder container
+// with the given name, attached to the docker client.
+func dockerRunArgs(name string, memMB int) []string {
+	return append([]string{"run", "-i"}, containerArgs(name, memMB)...)
+}
+
+// dockerCreateArgs returns the docker arguments for creating a builder
+// container with the given name, to be started by dockerStartArgs. Attaching
+// stdin makes Docker close it once the client started by dockerStartArgs has
+// sent all its input, as for dockerRunArgs; otherwise builder would never see
+// the end of the input of interactive jobs.
+func dockerCreateArgs(name string, memMB int) []string {
+	return append([]string{"create", "-i", "--attach", "stdin"}, containerArgs(name, memMB)...)
+}
+
+// dockerStartArgs returns the docker arguments for starting a container
+// created by dockerCreateArgs, attached to the docker client.
+func dockerStartArgs(name string) []string {
+	return []string{"start", "-a", "-i", name}
+}
+
+// containerArgs returns the options and image of a builder container with
+// the given name.
+func containerArgs(name string, memMB int) []string {
+	memoryFlag := fmt.Sprintf("%dm", memMB)
+	// TODO(nlacasse,ivanpi): Limit the CPU resources used by this docker
+	// builder instance.  The docker "cpu-shares" flag can only limit on
+	// docker process relative to another, so it's not useful for limiting
+	// the cpu resources of all build instances. The docker "cpuset" flag
+	// can pin the instance to a specific processor, so that might be of
+	// use.
+	return []string{
+		"--name", name,
+		"--label", builderLabel,
+		// Disable external networking.
+		"--net", "none",
+		// Limit instance memory.
+		"--memory", memoryFlag,
+		// Limit instance memory+swap combined.
+		// Setting to the same value as memory effectively disables swap.
+		"--memory-swap", memoryFlag,
+		"playground",
+	}
+}
+
+func (r *dockerRunner) Prepare() error {
+	if name, ok := r.pool.get(); ok {
+		r.name = name
+		r.cmd = docker(dockerStartArgs(name)...)
+		return nil
+	}
+	r.name = r.id
+	r.cmd = docker(dockerRunArgs(r.id, r.memMB)...)
+	return nil
+}
+
+func (r *dockerRunner) Cleanup() {
+	if r.name != "" {
+		r.cleanup.add(r.name)
+	}
+}
+
+func docker(args ...string) *exec.Cmd {
+	return exec.Command("docker", args...)
+}
+
+////////////////////////////////////////
+// Direct runner
+
+type directRunner struct {
+	cmdRunner
+	tmpDir string
+}
+
+// NewDirectRunnerFactory returns a RunnerFactory for running the builder
+// binary directly, without any isolation. This should only be used during
+// development and in tests, never in production.
+func NewDirectRunnerFactory() RunnerFactory {
+	return func(id string) Runner {
+		return &directRunner{}
+	}
+}
+
+func (r *directRunner) Prepare() error {
+	// Run the builder in a temp dir, so the bundle files and binaries do not
+	// clutter up the current working dir. This also allows parallel bundler
+	// runs, since otherwise the files from different runs stomp on each other.
+	var err error
+	if r.tmpDir, err = ioutil.TempDir("", "pg-builder-"); err != nil {
+		return fmt.Errorf("Error creating temp dir for builder: %v", err)
+	}
+	r.cmd = exec.Command("builder")
+	r.cmd.Dir = r.tmpDir
+	return nil
+}
+
+func (r *directRunner) Cleanup() {
+	if r.tmpDir != "" {
+		os.RemoveAll(r.tmpDir)
+	}
+}
+
+////////////////////////////////////////
+// Sandbox runner
+
+type sandboxRunner struct {
+	cmdRunner
+	id      string
+	config  SandboxConfig
+	tmpDir  string
+	sandbox *sandbox
+}
+
+// SandboxConfig configures the native sandbox runner.
+type SandboxConfig struct {
+	// Memory limit per process, in megabytes, also used as the size limit of
+	// the sandbox's work dir.
+	MemoryMB int
+	// CPU time limit per process.
+	MaxTime time.Duration
+	// Host directories containing the toolchains builder needs, mounted
+	// read-only in the sandbox. They must not contain secrets. Defaults to
+	// GOROOT, the jiri and release/go toolchain subtrees of $JIRI_ROOT
+	// and the directory of the builder binary.
+	Toolchain []string
+	// Directory of a pids cgroup (v1 or v2) writable by compilerd. Each
+	// sandbox gets its own cgroup in it, limiting the sandbox to MaxProcs
+	// processes.
+	PidsCgroup string
+	MaxProcs   int
+}
+
+const defaultSandboxMaxProcs = 256
+
+// NewSandboxRunnerFactory returns a RunnerFactory for running the builder in
+// a native Linux sandbox, configured by c.
+func NewSandboxRunnerFactory(c SandboxConfig) RunnerFactory {
+	if c.MaxProcs <= 0 {
+		c.MaxProcs = defaultSandboxMaxProcs
+	}
+	return func(id string) Runner {
+		return &sandboxRunner{id: id, config: c}
+	}
+}
+
+func (r *sandboxRunner) Prepare() error {
+	// The sandbox builds its root file system on a tmpfs mounted over the
+	// temp dir, so nothing is written to the host directory.
+	var err error
+	if r.tmpDir, err = ioutil.TempDir("", "pg-sandbox-"); err != nil {
+		return fmt.Errorf("Error creating temp dir for sandbox: %v", err)
+	}
+	if r.sandbox, err = newSandbox(r.config, r.id, r.tmpDir); err != nil {
+		return err
+	}
+	r.cmd = r.sandbox.cmd
+	return nil
+}
+
+func (r *sandboxRunner) Start(stdin io.Reader, stdout, stderr io.Writer) error {
+	r.cmd.Stdin = stdin
+	r.cmd.Stdout = stdout
+	r.cmd.Stderr = stderr
+	setpgid(r.cmd)
+	return r.sandbox.start()
+}
+
+func (r *sandboxRunner) Cleanup() {
+	if r.sandbox != nil {
+		r.sandbox.cleanup()
+	}
+	if r.tmpDir != "" {
+		os.RemoveAll(r.tmpDir)
+	}
+}
+
+////////////////////////////////////////
+// Fake runner
+
+// FakeBuilder is run by the fake runner in place of the builder binary. It
+// must return promptly once killed is closed.
+type FakeBuilder func(stdin io.Reader, stdout, stderr io.Writer, killed <-chan struct{}) error
+
+type fakeRunner struct {
+	builder FakeBuilder
+	killed  chan struct{}
+	kill    func()
+	exit    chan error
+}
+
+// NewFakeRunnerFactory returns a RunnerFactory that runs the given function
+// in-process instead of the builder. For tests only.
+func NewFakeRunnerFactory(builder FakeBuilder) RunnerFactory {
+	return func(id string) Runner {
+		killed := make(chan struct{})
+		return &fakeRunner{
+			builder: builder,
+			killed:  killed,
+			kill:    lib.DoOnce(func() { close(killed) }),
+			exit:    make(chan error, 1),
+		}
+	}
+}
+
+func (r *fakeRunner) Prepare() error {
+	return nil
+}
+
+func (r *fakeRunner) Start(stdin io.Reader, stdout, stderr io.Writer) error {
+	go func() {
+		r.exit <- r.builder(stdin, stdout, stderr, r.killed)
+	}()
+	return nil
+}
+
+func (r *fakeRunner) Wait() error {
+	return <-r.exit
+}
+
+func (r *fakeRunner) Kill() {
+	r.kill()
+}
+
+func (r *fakeRunner) Cleanup() {
+}
@@ -0,0 +1,672 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux && amd64
+// +build linux,amd64
+
+// Native Linux sandbox for running builder without Docker.
+//
+// The sandbox re-executes the current binary with sandboxInitEnv set, in new
+// user, mount, PID, network, IPC and UTS namespaces. Once the re-executed
+// process has been started, compilerd moves it into its own pids cgroup,
+// limiting the number of processes in the sandbox, and then lets it continue.
+// The re-executed process (see sandboxInit below) finishes setting up the
+// sandbox before executing builder:
+//   - builds a minimal root file system on a tmpfs, containing the system and
+//     toolchain directories bind-mounted read-only, a few device nodes, a new
+//     /proc, stub /etc files and a private, size-limited tmpfs on /tmp, which
+//     becomes the work dir,
+//   - makes the root file system read-only and pivots into it, detaching the
+//     host file system,
+//   - brings up the loopback interface, the only network interface available,
+//   - sets resource limits,
+//   - installs a seccomp filter denying dangerous system calls, including
+//     clone with namespace flags.
+//
+// Only the directories listed in the config are visible from the host file
+// system, so they must not contain secrets. Unlike Docker, memory is limited
+// per process rather than for the sandbox as a whole.
+
+package jobqueue
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"v.io/x/playground/lib/log"
+)
+
+const (
+	// Set in the environment of the re-executed sandbox init process. The
+	// value is the JSON-encoded sandboxConfig.
+	sandboxInitEnv = "PLAYGROUND_SANDBOX_INIT"
+	// Work dir inside the sandbox.
+	sandboxWorkDir = "/tmp"
+)
+
+// System directories mounted read-only in every sandbox, if they exist on the
+// host. Symlinks (e.g. /lib -> usr/lib) are recreated rather than mounted.
+var sandboxSystemDirs = []string{"/bin", "/sbin", "/lib", "/lib32", "/lib64", "/usr"}
+
+// Device nodes bind-mounted into the sandbox's /dev.
+var sandboxDevices = []string{"null", "zero", "full", "random", "urandom"}
+
+// sandboxConfig is passed from compilerd to the sandbox init process.
+type sandboxConfig struct {
+	// Program to run inside the sandbox, and its arguments.
+	Program string
+	Args    []string
+	// Empty host directory to build the sandbox root file system on.
+	RootDir string
+	// Host directories mounted read-only at the same path in the sandbox, in
+	// addition to sandboxSystemDirs.
+	Toolchain []string
+	// Memory limit per process, also used as the work dir size limit.
+	MemoryMB int
+	// CPU time limit per process.
+	MaxCPUTime time.Duration
+}
+
+func init() {
+	if cfg := os.Getenv(sandboxInitEnv); cfg != "" {
+		// Never returns.
+		sandboxInit(cfg)
+	}
+}
+
+// Subtrees of $JIRI_ROOT that builder needs: the jiri tool, and the Vanadium
+// binaries (mounttabled, xproxyd, vdl), sources and packages user code is
+// built against. The rest of $JIRI_ROOT, including the playground checkout
+// with its SQL configs, must not be visible in the sandbox.
+var jiriToolchainDirs = []string{
+	".jiri_root/bin",
+	"release/go/bin",
+	"release/go/pkg",
+	"release/go/src",
+}
+
+// defaultToolchain returns the directories builder needs to compile and run
+// user code: GOROOT, the toolchain subtrees of $JIRI_ROOT and the directory of
+// the builder binary.
+func defaultToolchain() []string {
+	goroot := os.Getenv("GOROOT")
+	if goroot == "" {
+		goroot = runtime.GOROOT()
+	}
+	var builderDir string
+	if path, err := exec.LookPath("builder"); err == nil {
+		builderDir = filepath.Dir(path)
+	}
+	return toolchainDirs(goroot, os.Getenv("JIRI_ROOT"), builderDir)
+}
+
+// toolchainDirs returns goroot, the existing toolchain subtrees of jiriRoot
+// and builderDir. Empty arguments are skipped.
+func toolchainDirs(goroot, jiriRoot, builderDir string) []string {
+	var dirs []string
+	if goroot != "" {
+		dirs = append(dirs, goroot)
+	}
+	if jiriRoot != "" {
+		for _, dir := range jiriToolchainDirs {
+			dir = filepath.Join(jiriRoot, dir)
+			if _, err := os.Stat(dir); err == nil {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	if builderDir != "" {
+		dirs = append(dirs, builderDir)
+	}
+	return dirs
+}
+
+// sandbox is a native sandbox prepared to run a command.
+type sandbox struct {
+	cmd    *exec.Cmd
+	cgroup *pidsCgroup
+	// Write end of the pipe the init process waits on until it has been
+	// moved into the cgroup.
+	release *os.File
+}
+
+// newSandbox returns a sandbox configured by c for running builder, with its
+// root file system built on rootDir. The sandbox gets a cgroup named name
+// under c.PidsCgroup.
+func newSandbox(c SandboxConfig, name, rootDir string) (*sandbox, error) {
+	toolchain := c.Toolchain
+	if len(toolchain) == 0 {
+		toolchain = defaultToolchain()
+	}
+	return newSandboxFromConfig(sandboxConfig{
+		Program:    "builder",
+		RootDir:    rootDir,
+		Toolchain:  toolchain,
+		MemoryMB:   c.MemoryMB,
+		MaxCPUTime: c.MaxTime,
+	}, c.PidsCgroup, name, c.MaxProcs)
+}
+
+func newSandboxFromConfig(cfg sandboxConfig, cgroupParent, name string, maxProcs int) (*sandbox, error) {
+	cfgJson, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cgroup, err := newPidsCgroup(cgroupParent, name, maxProcs)
+	if err != nil {
+		return nil, err
+	}
+	wait, release, err := os.Pipe()
+	if err != nil {
+		cgroup.remove()
+		return nil, err
+	}
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Env = append(os.Environ(), sandboxInitEnv+"="+string(cfgJson))
+	// Becomes file descriptor 3 of the init process.
+	cmd.ExtraFiles = []*os.File{wait}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		// Map the calling user to root inside the sandbox, which is needed to
+		// set up mounts and the network interface. Root inside the user
+		// namespace has no privileges on the host.
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		GidMappingsEnableSetgroups: false,
+		// Make sure the sandbox does not outlive compilerd.
+		Pdeathsig: syscall.SIGKILL,
+	}
+	return &sandbox{cmd: cmd, cgroup: cgroup, release: release}, nil
+}
+
+// start starts the sandbox init process, moves it into the sandbox's cgroup
+// and lets it continue. If moving it fails, the init process exits without
+// running anything.
+func (s *sandbox) start() error {
+	defer s.release.Close()
+	err := s.cmd.Start()
+	// The init process has its own copy.
+	s.cmd.ExtraFiles[0].Close()
+	if err != nil {
+		return err
+	}
+	if err = s.cgroup.add(s.cmd.Process.Pid); err == nil {
+		_, err = s.release.Write([]byte{0})
+	}
+	if err != nil {
+		s.release.Close()
+		s.cmd.Wait()
+	}
+	return err
+}
+
+// cleanup removes the sandbox's cgroup. It must be called after the sandbox
+// init process has exited, if it was started.
+func (s *sandbox) cleanup() {
+	s.release.Close()
+	s.cmd.ExtraFiles[0].Close()
+	if err := s.cgroup.remove(); err != nil {
+		log.Errorf("Error removing sandbox cgroup: %v", err)
+	}
+}
+
+// sandboxInit runs inside the new namespaces. It sets up the sandbox and
+// executes the configured program. Errors are reported on stderr.
+func sandboxInit(cfgJson string) {
+	// Namespace and seccomp settings are per thread until exec.
+	runtime.LockOSThread()
+	if err := setUpSandbox(cfgJson); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func setUpSandbox(cfgJson string) error {
+	var cfg sandboxConfig
+	if err := json.Unmarshal([]byte(cfgJson), &cfg); err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+
+	// Wait until compilerd has moved this process into the sandbox's cgroup,
+	// so that all processes in the sandbox are counted.
+	release := os.NewFile(3, "release")
+	if n, _ := release.Read(make([]byte, 1)); n != 1 {
+		return fmt.Errorf("not released by parent")
+	}
+	release.Close()
+
+	if err := buildRoot(cfg); err != nil {
+		return fmt.Errorf("building root file system failed: %v", err)
+	}
+	if err := pivotRoot(cfg.RootDir); err != nil {
+		return fmt.Errorf("pivoting root failed: %v", err)
+	}
+	if err := os.Chdir(sandboxWorkDir); err != nil {
+		return err
+	}
+
+	if err := bringUpLoopback(); err != nil {
+		return fmt.Errorf("bringing up loopback failed: %v", err)
+	}
+
+	if err := setSandboxRlimits(cfg); err != nil {
+		return fmt.Errorf("setting rlimits failed: %v", err)
+	}
+
+	path, err := exec.LookPath(cfg.Program)
+	if err != nil {
+		return err
+	}
+	// The host home and temp dirs are not visible.
+	env := []string{"HOME=" + sandboxWorkDir, "TMPDIR=" + sandboxWorkDir}
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, sandboxInitEnv+"=") && !strings.HasPrefix(v, "HOME=") && !strings.HasPrefix(v, "TMPDIR=") {
+			env = append(env, v)
+		}
+	}
+
+	// The seccomp filter must be installed last, since it denies some of the
+	// system calls used above.
+	if err := installSeccompFilter(); err != nil {
+		return fmt.Errorf("installing seccomp filter failed: %v", err)
+	}
+	return syscall.Exec(path, append([]string{cfg.Program}, cfg.Args...), env)
+}
+
+// buildRoot builds the sandbox root file system on a tmpfs mounted on
+// cfg.RootDir, and makes it read-only.
+func buildRoot(cfg sandboxConfig) error {
+	// Do not propagate mounts back to the host.
+	if err := syscall.Mount("none", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private failed: %v", err)
+	}
+	root := cfg.RootDir
+	const rootFlags = syscall.MS_NOSUID | syscall.MS_NODEV
+	if err := syscall.Mount("tmpfs", root, "tmpfs", rootFlags, "size=1m,mode=0755"); err != nil {
+		return fmt.Errorf("mounting root tmpfs on %q failed: %v", root, err)
+	}
+
+	// The work dir is mounted first, so that toolchain directories under the
+	// host's /tmp are mounted on top of it rather than hidden by it.
+	work := filepath.Join(root, sandboxWorkDir)
+	if err := os.MkdirAll(work, 0755); err != nil {
+		return err
+	}
+	workOpts := fmt.Sprintf("size=%dm,mode=1777", cfg.MemoryMB)
+	if err := syscall.Mount("tmpfs", work, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, workOpts); err != nil {
+		return fmt.Errorf("mounting tmpfs on %q failed: %v", work, err)
+	}
+
+	dev := filepath.Join(root, "dev")
+	if err := os.Mkdir(dev, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID, "size=64k,mode=0755"); err != nil {
+		return fmt.Errorf("mounting /dev failed: %v", err)
+	}
+	for _, name := range sandboxDevices {
+		if err := bindReadOnly(filepath.Join("/dev", name), filepath.Join(dev, name), false); err != nil {
+			return err
+		}
+	}
+	for name, target := range map[string]string{"fd": "/proc/self/fd", "stdin": "/proc/self/fd/0", "stdout": "/proc/self/fd/1", "stderr": "/proc/self/fd/2"} {
+		if err := os.Symlink(target, filepath.Join(dev, name)); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Mount("none", dev, "", syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID, ""); err != nil {
+		return fmt.Errorf("making /dev read-only failed: %v", err)
+	}
+
+	// A new /proc, showing only the processes in the sandbox.
+	proc := filepath.Join(root, "proc")
+	if err := os.Mkdir(proc, 0555); err != nil {
+		return err
+	}
+	if err := syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mounting /proc failed: %v", err)
+	}
+
+	etc := filepath.Join(root, "etc")
+	if err := os.Mkdir(etc, 0755); err != nil {
+		return err
+	}
+	for name, body := range map[string]string{
+		"hosts":  "127.0.0.1 localhost\n::1 localhost\n",
+		"passwd": "root:x:0:0:root:" + sandboxWorkDir + ":/bin/sh\n",
+		"group":  "root:x:0:\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(etc, name), []byte(body), 0644); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range sandboxSystemDirs {
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(dir)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(target, filepath.Join(root, dir)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := bindReadOnly(dir, filepath.Join(root, dir), true); err != nil {
+			return err
+		}
+	}
+	for _, dir := range cfg.Toolchain {
+		if err := bindReadOnly(dir, filepath.Join(root, dir), true); err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Mount("none", root, "", syscall.MS_REMOUNT|syscall.MS_RDONLY|rootFlags, ""); err != nil {
+		return fmt.Errorf("making root read-only failed: %v", err)
+	}
+	return nil
+}
+
+// Mount flags that a bind mount made in a user namespace must keep from its
+// source mount. They have the same values as the corresponding statfs flags.
+const lockedMountFlags = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC |
+	syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME
+
+// bindReadOnly bind-mounts the host path src read-only on dst, creating dst.
+func bindReadOnly(src, dst string, isDir bool) error {
+	if isDir {
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			return err
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(dst, nil, 0644); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Mount(src, dst, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind-mounting %q failed: %v", src, err)
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(src, &st); err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY|syscall.MS_NOSUID) | uintptr(st.Flags)&lockedMountFlags
+	if err := syscall.Mount("none", dst, "", flags, ""); err != nil {
+		return fmt.Errorf("making %q read-only failed: %v", src, err)
+	}
+	return nil
+}
+
+// pivotRoot makes root the root file system, and detaches the old one.
+func pivotRoot(root string) error {
+	if err := os.Chdir(root); err != nil {
+		return err
+	}
+	// With the same new and old root, the old root ends up mounted on top of
+	// the new one, and can be detached from there.
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return err
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("detaching old root failed: %v", err)
+	}
+	return os.Chdir("/")
+}
+
+////////////////////////////////////////
+// Pids cgroup
+
+// pidsCgroup is a cgroup (v1 or v2) with the pids controller, limiting the
+// number of processes in a sandbox.
+type pidsCgroup struct {
+	dir string
+}
+
+// newPidsCgroup creates a cgroup named name under the cgroup directory
+// parent, creating parent if needed, and limits it to max processes.
+func newPidsCgroup(parent, name string, max int) (*pidsCgroup, error) {
+	if parent == "" {
+		return nil, fmt.Errorf("Error creating sandbox cgroup: no pids cgroup configured")
+	}
+	c := &pidsCgroup{dir: filepath.Join(parent, name)}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return nil, fmt.Errorf("Error creating sandbox cgroup: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(c.dir, "pids.max"), []byte(strconv.Itoa(max)), 0644); err != nil {
+		c.remove()
+		return nil, fmt.Errorf("Error limiting sandbox processes: %v", err)
+	}
+	return c, nil
+}
+
+// add moves the process into the cgroup.
+func (c *pidsCgroup) add(pid int) error {
+	if err := ioutil.WriteFile(filepath.Join(c.dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		return fmt.Errorf("Error moving sandbox into cgroup: %v", err)
+	}
+	return nil
+}
+
+// remove removes the cgroup. Processes in a PID namespace are killed when its
+// init process exits, but may take a moment to go away, so remove waits for
+// the cgroup to become empty.
+func (c *pidsCgroup) remove() error {
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if err = syscall.Rmdir(c.dir); err == nil || os.IsNotExist(err) {
+			return nil
+		} else if err != syscall.EBUSY {
+			break
+		}
+	}
+	return fmt.Errorf("rmdir %s: %v", c.dir, err)
+}
+
+////////////////////////////////////////
+// Loopback, rlimits and seccomp
+
+// bringUpLoopback enables the loopback interface in the new network
+// namespace. Services started by builder listen on 127.0.0.1.
+func bringUpLoopback() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	// struct ifreq, with the flags member of the union.
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], "lo")
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	ifr.flags |= syscall.IFF_UP | syscall.IFF_RUNNING
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func setSandboxRlimits(cfg sandboxConfig) error {
+	mem := uint64(cfg.MemoryMB) << 20
+	limits := []struct {
+		resource int
+		value    uint64
+	}{
+		{syscall.RLIMIT_AS, mem},
+		{syscall.RLIMIT_FSIZE, mem},
+		{syscall.RLIMIT_CORE, 0},
+		{syscall.RLIMIT_NOFILE, 1024},
+		{syscall.RLIMIT_CPU, uint64(cfg.MaxCPUTime/time.Second) + 1},
+	}
+	for _, l := range limits {
+		if err := syscall.Setrlimit(l.resource, &syscall.Rlimit{Cur: l.value, Max: l.value}); err != nil {
+			return fmt.Errorf("resource %d: %v", l.resource, err)
+		}
+	}
+	return nil
+}
+
+// System calls denied inside the sandbox. They are either privileged or
+// allow escaping or inspecting other processes.
+var deniedSyscalls = []uintptr{
+	syscall.SYS_PTRACE,
+	310, // process_vm_readv
+	311, // process_vm_writev
+	syscall.SYS_MOUNT,
+	syscall.SYS_UMOUNT2,
+	syscall.SYS_PIVOT_ROOT,
+	syscall.SYS_CHROOT,
+	syscall.SYS_UNSHARE,
+	// Creating namespaces with clone is denied below.
+	308, // setns
+	syscall.SYS_KEXEC_LOAD,
+	syscall.SYS_INIT_MODULE,
+	313, // finit_module
+	syscall.SYS_DELETE_MODULE,
+	syscall.SYS_REBOOT,
+	syscall.SYS_SWAPON,
+	syscall.SYS_SWAPOFF,
+	syscall.SYS_ACCT,
+	syscall.SYS_SETTIMEOFDAY,
+	syscall.SYS_CLOCK_SETTIME,
+	syscall.SYS_ADJTIMEX,
+	syscall.SYS_KEYCTL,
+	syscall.SYS_ADD_KEY,
+	syscall.SYS_REQUEST_KEY,
+	syscall.SYS_PERF_EVENT_OPEN,
+	304, // open_by_handle_at
+	303, // name_to_handle_at
+	syscall.SYS_IOPL,
+	syscall.SYS_IOPERM,
+	syscall.SYS_QUOTACTL,
+	syscall.SYS_SYSLOG,
+	syscall.SYS_VHANGUP,
+	syscall.SYS_LOOKUP_DCOOKIE,
+	321, // bpf
+	323, // userfaultfd
+}
+
+// Classic BPF and seccomp constants, from linux/filter.h and linux/seccomp.h.
+const (
+	bpfLd   = 0x00
+	bpfW    = 0x00
+	bpfAbs  = 0x20
+	bpfJmp  = 0x05
+	bpfJeq  = 0x10
+	bpfJge  = 0x30
+	bpfJset = 0x40
+	bpfK    = 0x00
+	bpfRet  = 0x06
+
+	seccompRetKill  = 0x00000000
+	seccompRetErrno = 0x00050000
+	seccompRetAllow = 0x7fff0000
+
+	// Offset of the low 32 bits of the first system call argument in
+	// struct seccomp_data.
+	seccompDataArg0 = 16
+
+	auditArchX86_64   = 0xc000003e
+	x32SyscallBit     = 0x40000000
+	prSetNoNewPrivs   = 38
+	prSetSeccomp      = 22
+	seccompModeFilter = 2
+)
+
+type sockFilter struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+type sockFprog struct {
+	len    uint16
+	filter *sockFilter
+}
+
+// Flags of clone that create new namespaces. Creating nested namespaces
+// would give user code a fresh set of capabilities, and access to kernel
+// interfaces normally reserved to root.
+const cloneNamespaceFlags = syscall.CLONE_NEWNS | 0x02000000 /* CLONE_NEWCGROUP */ |
+	syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUSER |
+	syscall.CLONE_NEWPID | syscall.CLONE_NEWNET
+
+// clone3 takes its flags in a struct, which seccomp cannot inspect.
+const sysClone3 = 435
+
+// seccompFilter returns a BPF program that kills the process on foreign
+// architectures, fails denied system calls and clone calls creating
+// namespaces with EPERM, fails clone3 with ENOSYS, making callers fall back to
+// clone, and allows the rest.
+func seccompFilter() []sockFilter {
+	deny := sockFilter{bpfRet | bpfK, 0, 0, seccompRetErrno | uint32(syscall.EPERM)}
+	allow := sockFilter{bpfRet | bpfK, 0, 0, seccompRetAllow}
+	prog := []sockFilter{
+		// Load the architecture (seccomp_data.arch).
+		{bpfLd | bpfW | bpfAbs, 0, 0, 4},
+		{bpfJmp | bpfJeq | bpfK, 1, 0, auditArchX86_64},
+		{bpfRet | bpfK, 0, 0, seccompRetKill},
+		// Load the system call number (seccomp_data.nr).
+		{bpfLd | bpfW | bpfAbs, 0, 0, 0},
+		// Deny the x32 ABI.
+		{bpfJmp | bpfJge | bpfK, 0, 1, x32SyscallBit},
+		deny,
+		{bpfJmp | bpfJeq | bpfK, 0, 1, sysClone3},
+		{bpfRet | bpfK, 0, 0, seccompRetErrno | uint32(syscall.ENOSYS)},
+	}
+	for _, nr := range deniedSyscalls {
+		prog = append(prog,
+			sockFilter{bpfJmp | bpfJeq | bpfK, 0, 1, uint32(nr)},
+			deny)
+	}
+	return append(prog,
+		// Any other system call than clone is allowed.
+		sockFilter{bpfJmp | bpfJeq | bpfK, 0, 3, syscall.SYS_CLONE},
+		// Load the clone flags, and deny the call if any namespace flag is set.
+		sockFilter{bpfLd | bpfW | bpfAbs, 0, 0, seccompDataArg0},
+		sockFilter{bpfJmp | bpfJset | bpfK, 0, 1, cloneNamespaceFlags},
+		deny,
+		allow)
+}
+
+func installSeccompFilter() error {
+	filter := seccompFilter()
+	prog := sockFprog{
+		len:    uint16(len(filter)),
+		filter: &filter[0],
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return errno
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return errno
+	}
+	return nil
+}
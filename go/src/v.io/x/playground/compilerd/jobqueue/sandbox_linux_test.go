@@ -0,0 +1,214 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux && amd64
+// +build linux,amd64
+
+package jobqueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Set in the environment of the test binary when it is run inside a sandbox
+// by TestSandboxClone.
+const sandboxCloneTestEnv = "PLAYGROUND_SANDBOX_CLONE_TEST"
+
+func init() {
+	if os.Getenv(sandboxCloneTestEnv) == "" {
+		return
+	}
+	// Plain child processes can be started, but not ones in new namespaces.
+	if err := exec.Command("true").Run(); err != nil {
+		fmt.Println("exec failed:", err)
+	} else {
+		fmt.Println("exec ok")
+	}
+	cmd := exec.Command("true")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWUSER}
+	if err := cmd.Run(); err != nil {
+		fmt.Println("clone denied:", err)
+	} else {
+		fmt.Println("clone ok")
+	}
+	os.Exit(0)
+}
+
+// runSandbox runs the sandbox configured by cfg, limited to maxProcs
+// processes and by default to 100MB of memory, and returns its output. The
+// test is skipped if the sandbox cannot be created.
+func runSandbox(t *testing.T, cfg sandboxConfig, maxProcs int) (string, error) {
+	rootDir, err := ioutil.TempDir("", "pg-sandbox-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		// Nothing is written to the host directory.
+		if files, err := ioutil.ReadDir(rootDir); err != nil || len(files) != 0 {
+			t.Errorf("Expected empty root dir on host, got %v, %v", files, err)
+		}
+		os.RemoveAll(rootDir)
+	}()
+	cfg.RootDir = rootDir
+	if cfg.MemoryMB == 0 {
+		cfg.MemoryMB = 100
+	}
+	cfg.MaxCPUTime = 10 * time.Second
+
+	cgroupParent := "/sys/fs/cgroup/pids/playground-test"
+	s, err := newSandboxFromConfig(cfg, cgroupParent, filepath.Base(rootDir), maxProcs)
+	if err != nil {
+		t.Skipf("Pids cgroup not available: %v", err)
+	}
+	defer os.Remove(cgroupParent)
+	defer s.cleanup()
+
+	var out strings.Builder
+	s.cmd.Stdout = &out
+	s.cmd.Stderr = &out
+	if err := s.start(); err != nil {
+		t.Fatalf("Starting sandbox failed: %v", err)
+	}
+	err = s.cmd.Wait()
+	if err != nil && strings.Contains(out.String(), "operation not permitted") {
+		t.Skipf("Namespaces not available: %s", out.String())
+	}
+	return out.String(), err
+}
+
+func TestSandbox(t *testing.T) {
+	// A host file outside the toolchain directories.
+	secret, err := ioutil.TempFile("", "pg-sandbox-secret-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret.Close()
+	defer os.Remove(secret.Name())
+
+	script := `
+		grep Seccomp: /proc/self/status
+		grep -c : /proc/net/dev
+		pwd
+		echo data > file && cat file
+		mount -t tmpfs tmpfs /mnt || echo mount denied
+		touch /usr/file || echo usr read-only
+		touch /file || echo root read-only
+		test -e ` + secret.Name() + ` || echo secret hidden
+		ls /
+		echo $PPID
+	`
+	out, err := runSandbox(t, sandboxConfig{
+		Program: "sh",
+		Args:    []string{"-c", script},
+	}, 10)
+	if err != nil {
+		t.Fatalf("Sandbox failed: %v: %s", err, out)
+	}
+
+	want := []string{
+		// Seccomp filter mode.
+		"Seccomp:\t2",
+		// Only the loopback interface.
+		"1",
+		// The work dir is a writable private tmpfs.
+		sandboxWorkDir,
+		"data",
+		"mount denied",
+		"usr read-only",
+		"root read-only",
+		"secret hidden",
+		// The minimal root file system.
+		"dev", "etc", "proc", "tmp", "usr",
+		// The shell is PID 1 in its own PID namespace, so its parent is 0.
+		"0",
+	}
+	for _, w := range want {
+		if !strings.Contains(out, w+"\n") {
+			t.Errorf("Expected sandbox output to contain %q, got %q", w, out)
+		}
+	}
+	for _, dir := range []string{"home", "root", "var"} {
+		if strings.Contains(out, "\n"+dir+"\n") {
+			t.Errorf("Expected %s not to be visible in the sandbox, got %q", dir, out)
+		}
+	}
+}
+
+func TestSandboxPidsLimit(t *testing.T) {
+	out, err := runSandbox(t, sandboxConfig{
+		Program: "sh",
+		Args:    []string{"-c", "for i in 1 2 3 4 5 6 7 8 9 10; do sleep 1 & done; wait; echo all started"},
+	}, 5)
+	if err == nil || strings.Contains(out, "all started") || !strings.Contains(strings.ToLower(out), "fork") {
+		t.Errorf("Expected forking to fail, got %v: %q", err, out)
+	}
+}
+
+func TestSandboxClone(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(sandboxCloneTestEnv, "1")
+	defer os.Unsetenv(sandboxCloneTestEnv)
+	out, err := runSandbox(t, sandboxConfig{
+		Program:   exe,
+		Toolchain: []string{filepath.Dir(exe)},
+		// The Go runtime reserves a lot of address space.
+		MemoryMB: 1000,
+	}, 10)
+	if err != nil && strings.Contains(out, "ThreadSanitizer") {
+		t.Skipf("Race detector needs more address space than the sandbox allows: %s", out)
+	} else if err != nil {
+		t.Fatalf("Sandbox failed: %v: %s", err, out)
+	}
+	for _, w := range []string{"exec ok", "clone denied"} {
+		if !strings.Contains(out, w) {
+			t.Errorf("Expected sandbox output to contain %q, got %q", w, out)
+		}
+	}
+}
+
+func TestToolchainDirs(t *testing.T) {
+	jiriRoot, err := ioutil.TempDir("", "jiri-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(jiriRoot)
+	for _, dir := range []string{".jiri_root/bin", "release/go/bin", "release/go/src", "release/projects/playground/config"} {
+		if err := os.MkdirAll(filepath.Join(jiriRoot, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configDir := filepath.Join(jiriRoot, "release/projects/playground/config")
+	if err := ioutil.WriteFile(filepath.Join(configDir, "db.json"), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got := toolchainDirs("/goroot", jiriRoot, "/builder/bin")
+	want := []string{
+		"/goroot",
+		filepath.Join(jiriRoot, ".jiri_root/bin"),
+		filepath.Join(jiriRoot, "release/go/bin"),
+		filepath.Join(jiriRoot, "release/go/src"),
+		"/builder/bin",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	for _, dir := range got {
+		if rel, err := filepath.Rel(dir, configDir); err == nil && !strings.HasPrefix(rel, "..") {
+			t.Errorf("Expected default toolchain not to mount %s, but %s contains it", configDir, dir)
+		}
+	}
+}
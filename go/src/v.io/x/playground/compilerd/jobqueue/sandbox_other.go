@@ -0,0 +1,28 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux || !amd64
+// +build !linux !amd64
+
+package jobqueue
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+type sandbox struct {
+	cmd *exec.Cmd
+}
+
+func newSandbox(c SandboxConfig, name, rootDir string) (*sandbox, error) {
+	return nil, fmt.Errorf("native sandbox is only supported on linux/amd64")
+}
+
+func (s *sandbox) start() error {
+	return nil
+}
+
+func (s *sandbox) cleanup() {
+}
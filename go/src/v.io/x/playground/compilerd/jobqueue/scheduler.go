@@ -0,0 +1,197 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Schedulers decide the order in which the dispatcher runs queued jobs. The
+// available schedulers are:
+//   - fifo: runs jobs in the order they were queued,
+//   - fair: runs jobs with a higher priority first, and takes turns between
+//           clients among jobs with the same priority, so that a client
+//           queuing many jobs at once does not delay everyone else.
+
+package jobqueue
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Priority of a job. Jobs with a higher priority are run first by the fair
+// scheduler.
+type Priority int
+
+const (
+	// For jobs nobody is waiting for, e.g. cache warm-ups.
+	PriorityLow Priority = -1
+	// The default priority.
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+// SetPriority sets the priority of the job. The default is PriorityNormal.
+func (j *Job) SetPriority(p Priority) {
+	j.priority = p
+}
+
+// SetClient sets the key identifying the client that submitted the job, e.g.
+// its IP address. The fair scheduler takes turns between clients.
+func (j *Job) SetClient(client string) {
+	j.client = client
+}
+
+// Scheduler is a queue of jobs waiting for a worker. Schedulers need not be
+// safe for concurrent use; the dispatcher serializes calls.
+type Scheduler interface {
+	// Push adds the job to the queue.
+	Push(j *Job)
+	// Pop removes and returns the next job to run, or nil if the queue is
+	// empty.
+	Pop() *Job
+	// Len returns the number of jobs in the queue.
+	Len() int
+	// Jobs returns the jobs in the queue, in the order they would be popped
+	// if no more jobs were pushed.
+	Jobs() []*Job
+}
+
+// NewScheduler returns the named scheduler, "fifo" or "fair".
+func NewScheduler(name string) (Scheduler, error) {
+	switch name {
+	case "fifo":
+		return NewFIFOScheduler(), nil
+	case "fair":
+		return NewFairScheduler(), nil
+	default:
+		return nil, fmt.Errorf("Unknown scheduler %q", name)
+	}
+}
+
+////////////////////////////////////////
+// FIFO scheduler
+
+type fifoScheduler struct {
+	jobs []*Job
+}
+
+// NewFIFOScheduler returns a Scheduler running jobs in the order they were
+// queued, ignoring priorities and clients.
+func NewFIFOScheduler() Scheduler {
+	return &fifoScheduler{}
+}
+
+func (s *fifoScheduler) Push(j *Job) {
+	s.jobs = append(s.jobs, j)
+}
+
+func (s *fifoScheduler) Pop() *Job {
+	if len(s.jobs) == 0 {
+		return nil
+	}
+	j := s.jobs[0]
+	s.jobs[0] = nil
+	s.jobs = s.jobs[1:]
+	return j
+}
+
+func (s *fifoScheduler) Len() int {
+	return len(s.jobs)
+}
+
+func (s *fifoScheduler) Jobs() []*Job {
+	return append([]*Job(nil), s.jobs...)
+}
+
+////////////////////////////////////////
+// Fair scheduler
+
+// fairScheduler keeps a round-robin queue of clients for each priority.
+type fairScheduler struct {
+	levels map[Priority]*roundRobin
+	n      int
+}
+
+// roundRobin is a queue of clients, each with a queue of jobs. The client at
+// the front of the queue runs a job, then goes to the back of the queue if it
+// has more jobs.
+type roundRobin struct {
+	clients []string
+	jobs    map[string][]*Job
+}
+
+// NewFairScheduler returns a Scheduler running jobs with a higher priority
+// first. Among jobs with the same priority, clients take turns, and each
+// client's jobs are run in the order they were queued. Jobs with a lower
+// priority only run when no jobs with a higher priority are queued.
+func NewFairScheduler() Scheduler {
+	return &fairScheduler{
+		levels: make(map[Priority]*roundRobin),
+	}
+}
+
+func (s *fairScheduler) Push(j *Job) {
+	rr := s.levels[j.priority]
+	if rr == nil {
+		rr = &roundRobin{jobs: make(map[string][]*Job)}
+		s.levels[j.priority] = rr
+	}
+	if len(rr.jobs[j.client]) == 0 {
+		rr.clients = append(rr.clients, j.client)
+	}
+	rr.jobs[j.client] = append(rr.jobs[j.client], j)
+	s.n++
+}
+
+func (s *fairScheduler) Pop() *Job {
+	var rr *roundRobin
+	var top Priority
+	for p, l := range s.levels {
+		if len(l.clients) > 0 && (rr == nil || p > top) {
+			rr, top = l, p
+		}
+	}
+	if rr == nil {
+		return nil
+	}
+	client := rr.clients[0]
+	rr.clients = rr.clients[1:]
+	jobs := rr.jobs[client]
+	j := jobs[0]
+	if len(jobs) > 1 {
+		rr.jobs[client] = jobs[1:]
+		rr.clients = append(rr.clients, client)
+	} else {
+		delete(rr.jobs, client)
+	}
+	s.n--
+	return j
+}
+
+func (s *fairScheduler) Len() int {
+	return s.n
+}
+
+func (s *fairScheduler) Jobs() []*Job {
+	var priorities []int
+	for p, rr := range s.levels {
+		if len(rr.clients) > 0 {
+			priorities = append(priorities, int(p))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+
+	jobs := make([]*Job, 0, s.n)
+	for _, p := range priorities {
+		rr := s.levels[Priority(p)]
+		// Each round, every client with jobs left runs its next job.
+		for round, left := 0, true; left; round++ {
+			left = false
+			for _, client := range rr.clients {
+				if queue := rr.jobs[client]; round < len(queue) {
+					jobs = append(jobs, queue[round])
+					left = left || round+1 < len(queue)
+				}
+			}
+		}
+	}
+	return jobs
+}
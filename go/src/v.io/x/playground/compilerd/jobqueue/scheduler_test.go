@@ -0,0 +1,193 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jobqueue
+
+import (
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// newScheduledJob returns a job with the given name as body, for checking
+// the order in which jobs are scheduled.
+func newScheduledJob(name, client string, p Priority, newRunner RunnerFactory) *Job {
+	job := NewJob([]byte(name), newMockResponseEventSink(), defaultMaxSize, defaultMaxTime, newRunner)
+	job.SetClient(client)
+	job.SetPriority(p)
+	return job
+}
+
+// names returns the names of the jobs.
+func names(jobs []*Job) []string {
+	var names []string
+	for _, j := range jobs {
+		names = append(names, string(j.Body()))
+	}
+	return names
+}
+
+// popAll pops all jobs from s and returns their names.
+func popAll(s Scheduler) []string {
+	var names []string
+	for j := s.Pop(); j != nil; j = s.Pop() {
+		names = append(names, string(j.Body()))
+	}
+	return names
+}
+
+func TestFIFOScheduler(t *testing.T) {
+	s := NewFIFOScheduler()
+	for _, name := range []string{"a1", "a2", "b1", "c1"} {
+		s.Push(newScheduledJob(name, name[:1], PriorityNormal, nil))
+	}
+	if got, want := s.Len(), 4; got != want {
+		t.Errorf("Expected %d queued jobs, got %d", want, got)
+	}
+	if got, want := names(s.Jobs()), []string{"a1", "a2", "b1", "c1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected queued jobs %v, got %v", want, got)
+	}
+	if got, want := popAll(s), []string{"a1", "a2", "b1", "c1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected jobs in order %v, got %v", want, got)
+	}
+}
+
+func TestFairScheduler(t *testing.T) {
+	type push struct {
+		name     string
+		priority Priority
+	}
+	tests := []struct {
+		pushes []push
+		want   []string
+	}{
+		// Clients take turns.
+		{
+			[]push{{"a1", PriorityNormal}, {"a2", PriorityNormal}, {"a3", PriorityNormal}, {"b1", PriorityNormal}, {"c1", PriorityNormal}, {"b2", PriorityNormal}},
+			[]string{"a1", "b1", "c1", "a2", "b2", "a3"},
+		},
+		// Higher priorities go first, regardless of client.
+		{
+			[]push{{"a1", PriorityLow}, {"a2", PriorityNormal}, {"b1", PriorityLow}, {"a3", PriorityHigh}, {"b2", PriorityNormal}, {"c1", PriorityHigh}},
+			[]string{"a3", "c1", "a2", "b2", "a1", "b1"},
+		},
+	}
+	for i, test := range tests {
+		s := NewFairScheduler()
+		for _, p := range test.pushes {
+			s.Push(newScheduledJob(p.name, p.name[:1], p.priority, nil))
+		}
+		if got, want := s.Len(), len(test.pushes); got != want {
+			t.Errorf("%d: expected %d queued jobs, got %d", i, want, got)
+		}
+		if got := names(s.Jobs()); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d: expected queued jobs %v, got %v", i, test.want, got)
+		}
+		if got := popAll(s); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d: expected jobs in order %v, got %v", i, test.want, got)
+		}
+		if got := s.Len(); got != 0 {
+			t.Errorf("%d: expected no queued jobs, got %d", i, got)
+		}
+	}
+
+	// A client whose turn comes after its queue emptied goes to the back.
+	s := NewFairScheduler()
+	s.Push(newScheduledJob("a1", "a", PriorityNormal, nil))
+	s.Push(newScheduledJob("b1", "b", PriorityNormal, nil))
+	if got := s.Pop(); string(got.Body()) != "a1" {
+		t.Errorf("Expected a1, got %s", got.Body())
+	}
+	s.Push(newScheduledJob("a2", "a", PriorityNormal, nil))
+	s.Push(newScheduledJob("b2", "b", PriorityNormal, nil))
+	if got, want := names(s.Jobs()), []string{"b1", "a2", "b2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected queued jobs %v, got %v", want, got)
+	}
+	if got, want := popAll(s), []string{"b1", "a2", "b2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected jobs in order %v, got %v", want, got)
+	}
+}
+
+func TestSchedulingDispatcherOrder(t *testing.T) {
+	// The fake builder records the jobs it runs. The job named "blocker" runs
+	// until killed, keeping the only worker busy while the other jobs are
+	// queued.
+	var mu sync.Mutex
+	var ran []string
+	blocking := make(chan struct{})
+	run := func(stdin io.Reader, stdout, stderr io.Writer, killed <-chan struct{}) error {
+		body, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		if string(body) == "blocker" {
+			close(blocking)
+			<-killed
+			return nil
+		}
+		mu.Lock()
+		ran = append(ran, string(body))
+		mu.Unlock()
+		return nil
+	}
+	newRunner := NewFakeRunnerFactory(run)
+
+	d := NewDispatcherFromConfig(DispatcherConfig{Workers: 1, QueueCap: 10, Scheduler: NewFairScheduler()})
+	defer d.Stop()
+	blocker := newScheduledJob("blocker", "x", PriorityNormal, newRunner)
+	blockerResult := enqueue(t, d, blocker)
+	<-blocking
+
+	var resultChans []chan Result
+	for _, job := range []*Job{
+		newScheduledJob("a1", "a", PriorityNormal, newRunner),
+		newScheduledJob("a2", "a", PriorityNormal, newRunner),
+		newScheduledJob("warm", "w", PriorityLow, newRunner),
+		newScheduledJob("a3", "a", PriorityNormal, newRunner),
+		newScheduledJob("b1", "b", PriorityNormal, newRunner),
+	} {
+		resultChans = append(resultChans, enqueue(t, d, job))
+	}
+	blocker.Cancel()
+	<-blockerResult
+	for _, resultChan := range resultChans {
+		<-resultChan
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"a1", "b1", "a2", "a3", "warm"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("Expected jobs to run in order %v, got %v", want, ran)
+	}
+}
+
+func TestSchedulingDispatcherQueueFull(t *testing.T) {
+	blocking := make(chan struct{})
+	run := func(stdin io.Reader, stdout, stderr io.Writer, killed <-chan struct{}) error {
+		close(blocking)
+		<-killed
+		return nil
+	}
+	d := NewDispatcherFromConfig(DispatcherConfig{Workers: 1, QueueCap: 1, Scheduler: NewFairScheduler()})
+	blocker := newScheduledJob("blocker", "x", PriorityNormal, NewFakeRunnerFactory(run))
+	blockerResult := enqueue(t, d, blocker)
+	<-blocking
+
+	queuedResult := enqueue(t, d, newScheduledJob("a1", "a", PriorityHigh, nil))
+	_, err := d.Enqueue(newScheduledJob("b1", "b", PriorityHigh, nil))
+	if qfe, ok := err.(*QueueFullError); !ok || qfe.Queued != 1 || qfe.Workers != 1 {
+		t.Errorf("Expected QueueFullError with 1 queued job and 1 worker, got %v", err)
+	}
+
+	// Stopping the dispatcher rejects the queued job. The blocker is cancelled
+	// afterwards, since Stop waits for running jobs.
+	go func() {
+		<-queuedResult
+		blocker.Cancel()
+	}()
+	d.Stop()
+	<-blockerResult
+}
@@ -0,0 +1,371 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Handlers for HTTP requests to the asynchronous job API, an alternative to
+// /compile for clients with unreliable connections. Instead of holding a
+// single response open while the job runs, the client submits the job and
+// then fetches its events, resuming where it left off if the connection
+// drops.
+//
+// handlerJobs() handles a POST request to /jobs with bundled example source
+// code, like /compile. The job is queued (or the cached response looked up),
+// and its ID returned in a 201 response with a JSON body {"ID": "<id>"}.
+// Errors are reported as in /compile.
+//
+// handlerJob() handles requests for a job:
+//   - GET /jobs/<id>/events?from=N streams the job's events in the /compile
+//     format, starting with sequence number N (default 1), until the job
+//     finishes. Each event carries its sequence number in Seq, so a dropped
+//     stream can be resumed from the event after the last one received.
+//     Debug events are only included with debug=1, as in /compile.
+//   - DELETE /jobs/<id> cancels the job, killing it if it is running, and
+//     forgets it.
+//
+// Creating a job counts against the client's rate limit, even if the response
+// is cached. Finished jobs are forgotten after --job-retention, or earlier,
+// oldest first, to retain at most --max-retained-jobs jobs. If that many jobs
+// are still running, new jobs are rejected with a 503 response.
+
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"v.io/x/playground/compilerd/jobqueue"
+	"v.io/x/playground/lib/event"
+	"v.io/x/playground/lib/log"
+)
+
+var (
+	jobRetention    = flag.Duration("job-retention", 10*time.Minute, "Time for which the events of finished asynchronous jobs can be fetched.")
+	maxRetainedJobs = flag.Int("max-retained-jobs", 1000, "Maximum number of asynchronous jobs to retain. When reached, the oldest finished jobs are forgotten before --job-retention, and new jobs are rejected if no job has finished.")
+)
+
+// Interval at which expired jobs are forgotten.
+const jobPruneInterval = time.Minute
+
+// asyncJob is a job submitted through the job API.
+type asyncJob struct {
+	id string
+	// The queued job, or nil if the response was cached.
+	job *jobqueue.Job
+	// Sink the job writes events to, or nil if the response was cached.
+	res *event.ResponseEventSink
+	// Closed when the job finishes.
+	done chan struct{}
+
+	mu sync.Mutex
+	// All events written by the job. Only set once the job finishes.
+	events   []event.Event
+	finished time.Time
+}
+
+func newAsyncJob(job *jobqueue.Job, res *event.ResponseEventSink) *asyncJob {
+	return &asyncJob{
+		id:   newJobID(),
+		job:  job,
+		res:  res,
+		done: make(chan struct{}),
+	}
+}
+
+// newJobID returns a random job ID. IDs must not be guessable, since anyone
+// knowing the ID can read the job's events.
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		log.Panicf("Error generating job ID: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// finish records the events of the finished job.
+func (aj *asyncJob) finish(events []event.Event) {
+	aj.mu.Lock()
+	defer aj.mu.Unlock()
+	aj.events = events
+	aj.finished = time.Now()
+	close(aj.done)
+}
+
+// eventsSince returns the job's events after the first n. If the job has not
+// finished, it also returns a channel that is closed when more events are
+// written (or when the job finishes, which closes aj.done).
+func (aj *asyncJob) eventsSince(n int) (events []event.Event, finished bool, changed <-chan struct{}) {
+	aj.mu.Lock()
+	defer aj.mu.Unlock()
+	if !aj.finished.IsZero() {
+		if n < len(aj.events) {
+			events = aj.events[n:]
+		}
+		return events, true, nil
+	}
+	events, changed = aj.res.WrittenSince(n)
+	return events, false, changed
+}
+
+// finishedAt returns the time the job finished, or the zero time if it has
+// not finished.
+func (aj *asyncJob) finishedAt() time.Time {
+	aj.mu.Lock()
+	defer aj.mu.Unlock()
+	return aj.finished
+}
+
+// expired returns whether the job finished more than --job-retention ago.
+func (aj *asyncJob) expired(now time.Time) bool {
+	finished := aj.finishedAt()
+	return !finished.IsZero() && now.Sub(finished) > *jobRetention
+}
+
+// addJob registers the job, forgetting expired jobs, and the oldest finished
+// job if --max-retained-jobs jobs are retained. It returns false, without
+// registering the job, if that many jobs are still running.
+func (c *compiler) addJob(aj *asyncJob) bool {
+	c.jobsMu.Lock()
+	defer c.jobsMu.Unlock()
+	if c.jobs == nil {
+		c.jobs = make(map[string]*asyncJob)
+	}
+	c.pruneJobsLocked(time.Now())
+	if len(c.jobs) >= *maxRetainedJobs {
+		var oldestID string
+		var oldest time.Time
+		for id, j := range c.jobs {
+			if finished := j.finishedAt(); !finished.IsZero() && (oldest.IsZero() || finished.Before(oldest)) {
+				oldestID, oldest = id, finished
+			}
+		}
+		if oldestID == "" {
+			return false
+		}
+		log.Debugf("Forgetting job %s to retain at most %d jobs.", oldestID, *maxRetainedJobs)
+		delete(c.jobs, oldestID)
+	}
+	c.jobs[aj.id] = aj
+	return true
+}
+
+// pruneJobs forgets expired jobs every jobPruneInterval, so that they do not
+// linger until the next job is created. It never returns.
+func (c *compiler) pruneJobs() {
+	for now := range time.Tick(jobPruneInterval) {
+		c.jobsMu.Lock()
+		c.pruneJobsLocked(now)
+		c.jobsMu.Unlock()
+	}
+}
+
+// pruneJobsLocked forgets expired jobs. c.jobsMu must be held.
+func (c *compiler) pruneJobsLocked(now time.Time) {
+	for id, j := range c.jobs {
+		if j.expired(now) {
+			delete(c.jobs, id)
+		}
+	}
+}
+
+// getJob returns the job with the given ID, or nil if there is no such job.
+func (c *compiler) getJob(id string) *asyncJob {
+	c.jobsMu.Lock()
+	defer c.jobsMu.Unlock()
+	aj := c.jobs[id]
+	if aj == nil || aj.expired(time.Now()) {
+		return nil
+	}
+	return aj
+}
+
+// removeJob forgets the job with the given ID, and returns it, or nil if
+// there is no such job.
+func (c *compiler) removeJob(id string) *asyncJob {
+	c.jobsMu.Lock()
+	defer c.jobsMu.Unlock()
+	aj := c.jobs[id]
+	delete(c.jobs, id)
+	return aj
+}
+
+// POST request that queues a job, or looks up its cached response, and
+// returns the job ID.
+func (c *compiler) handlerJobs(w http.ResponseWriter, r *http.Request) {
+	if !handleCORS(w, r) {
+		return
+	}
+
+	// Limit is set to maxSize+1 to allow distinguishing between exactly maxSize
+	// and larger than maxSize requests.
+	requestBody := getPostBody(w, r, *maxSize+1)
+	if requestBody == nil {
+		return
+	}
+
+	// Errors are sent as events, as in /compile.
+	openResponse := func(status int) *event.ResponseEventSink {
+		res := newResponseSink(w, false)
+		w.WriteHeader(status)
+		return res
+	}
+
+	if len(requestBody) > *maxSize {
+		res := openResponse(http.StatusBadRequest)
+		res.Write(event.New("", "stderr", "Program too large."))
+		return
+	}
+
+	if isProbeRequest(requestBody) {
+		res := openResponse(http.StatusBadRequest)
+		res.Write(event.New("", "stderr", "Probe requests are not allowed."))
+		return
+	}
+
+	// Unlike in /compile, cached responses count against the client's rate
+	// limit, since each job is retained.
+	if !c.admitJob(w, r, openResponse) {
+		return
+	}
+	addJob := func(aj *asyncJob) bool {
+		if c.addJob(aj) {
+			return true
+		}
+		log.Warnf("Too many running jobs, rejecting job %s.", aj.id)
+		w.Header().Set("Retry-After", retryAfter(*jobTimeEstimate))
+		res := openResponse(http.StatusServiceUnavailable)
+		res.Write(event.New("", "stderr", "Service busy. Please try again later."))
+		return false
+	}
+
+	var aj *asyncJob
+	canonical := canonicalRequest(requestBody)
+	key := cacheKey(c.currentFingerprint(), canonical)
+	if cr, ok := c.getCachedResponse(key); ok {
+		log.Debug("Creating job from cached response.")
+		aj = newAsyncJob(nil, nil)
+		aj.finish(cr.Events)
+		if !addJob(aj) {
+			return
+		}
+	} else {
+		// The job's events are kept in res until it finishes.
+		res := event.NewResponseEventSink(ioutil.Discard, false)
+		job := jobqueue.NewJob(requestBody, res, *maxSize, *maxTime, c.newRunner)
+		job.SetKey(key.String())
+		c.scheduleJob(job, r)
+		aj = newAsyncJob(job, res)
+		// The job is registered before it is queued, so that it is never run
+		// without being retained.
+		if !addJob(aj) {
+			return
+		}
+		resultChan, err := c.dispatcher.Enqueue(job)
+		if err != nil {
+			c.removeJob(aj.id)
+			rejectJob(w, newResponseSink(w, false), err)
+			return
+		}
+		go func() {
+			result := <-resultChan
+			c.finishJob(res, canonical, result)
+			// Successful jobs return their events in the result; otherwise, they
+			// remain in res, followed by the status event.
+			aj.finish(append(result.Events, res.PopWrittenEvents()...))
+		}()
+	}
+	log.Debugf("Created job %s.", aj.id)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+aj.id)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct{ ID string }{aj.id})
+}
+
+// GET request that streams the events of a job, or DELETE request that
+// cancels it. The URL path is /jobs/<id>/events or /jobs/<id> respectively.
+func (c *compiler) handlerJob(w http.ResponseWriter, r *http.Request) {
+	if !handleCORS(w, r) {
+		return
+	}
+
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	switch {
+	case len(path) == 2 && path[1] == "events" && r.Method == "GET":
+		c.streamJobEvents(w, r, path[0])
+	case len(path) == 1 && r.Method == "DELETE":
+		aj := c.removeJob(path[0])
+		if aj == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Debugf("Cancelling job %s.", aj.id)
+		if aj.job != nil {
+			aj.job.Cancel()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) <= 2:
+		w.WriteHeader(http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (c *compiler) streamJobEvents(w http.ResponseWriter, r *http.Request, id string) {
+	from := 1
+	if s := r.FormValue("from"); s != "" {
+		var err error
+		if from, err = strconv.Atoi(s); err != nil || from < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if from == 0 {
+			from = 1
+		}
+	}
+	wantDebug := r.FormValue("debug") == "1"
+
+	aj := c.getJob(id)
+	if aj == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Go's httptest.NewRecorder does not support http.CloseNotifier, so we
+	// can't assume that w.(httpCloseNotifier) will succeed.
+	var clientDisconnect <-chan bool
+	if closeNotifier, ok := w.(http.CloseNotifier); ok {
+		clientDisconnect = closeNotifier.CloseNotify()
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	sink := event.NewJsonSink(w, !wantDebug)
+	for {
+		events, finished, changed := aj.eventsSince(from - 1)
+		for i := range events {
+			e := events[i]
+			e.Seq = from + i
+			if err := sink.Write(e); err != nil {
+				log.Debugf("Error streaming events of job %s: %v", id, err)
+				return
+			}
+		}
+		from += len(events)
+		if finished {
+			return
+		}
+		select {
+		case <-changed:
+		case <-aj.done:
+		case <-clientDisconnect:
+			return
+		}
+	}
+}
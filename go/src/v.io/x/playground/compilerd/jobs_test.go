@@ -0,0 +1,294 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"v.io/x/playground/lib/event"
+)
+
+func newJobsServer(c *compiler) *httptest.Server {
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/jobs", c.handlerJobs)
+	serveMux.HandleFunc("/jobs/", c.handlerJob)
+	return httptest.NewServer(serveMux)
+}
+
+// createJob submits the body to the job API and returns the job ID.
+func createJob(t *testing.T, s *httptest.Server, body string) string {
+	resp, err := http.Post(s.URL+"/jobs", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("Failed creating job: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status %v but got %v", http.StatusCreated, resp.StatusCode)
+	}
+	var created struct{ ID string }
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("Failed decoding job: %v", err)
+	}
+	if got, want := resp.Header.Get("Location"), "/jobs/"+created.ID; got != want {
+		t.Errorf("Expected Location %q but got %q", want, got)
+	}
+	return created.ID
+}
+
+// getJobEvents fetches the events of a job, starting from sequence number
+// from, and returns the response status and the first limit events (all if
+// limit is 0).
+func getJobEvents(t *testing.T, s *httptest.Server, id string, from, limit int) (int, []event.Event) {
+	resp, err := http.Get(fmt.Sprintf("%s/jobs/%s/events?debug=1&from=%d", s.URL, id, from))
+	if err != nil {
+		t.Fatalf("Failed getting job events: %v", err)
+	}
+	defer resp.Body.Close()
+	var events []event.Event
+	scanner := bufio.NewScanner(resp.Body)
+	for (limit == 0 || len(events) < limit) && scanner.Scan() {
+		var e event.Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Failed decoding job event: %v", err)
+		}
+		events = append(events, e)
+	}
+	return resp.StatusCode, events
+}
+
+func checkSeq(t *testing.T, events []event.Event, from int) {
+	for i, e := range events {
+		if e.Seq != from+i {
+			t.Errorf("Expected event %d to have Seq %d, got %v", i, from+i, e)
+		}
+	}
+}
+
+func TestJobEventsCanBeResumed(t *testing.T) {
+	c := newFakeCompiler(t, "slow.json")
+	defer c.stop()
+	s := newJobsServer(c)
+	defer s.Close()
+
+	id := createJob(t, s, `{"files": [{"name": "src/main/main.go", "body": "fake jobs"}]}`)
+
+	// Drop the connection after the first two events, while the job is still
+	// running, then resume.
+	status, first := getJobEvents(t, s, id, 1, 2)
+	if status != http.StatusOK || len(first) != 2 {
+		t.Fatalf("Expected status %v and 2 events, got %v and %v", http.StatusOK, status, first)
+	}
+	checkSeq(t, first, 1)
+	status, rest := getJobEvents(t, s, id, 3, 0)
+	if status != http.StatusOK {
+		t.Fatalf("Expected status %v but got %v", http.StatusOK, status)
+	}
+	checkSeq(t, rest, 3)
+	events := append(first, rest...)
+	for _, want := range []string{"PROGRAM START", "PROGRAM MIDDLE", "PROGRAM END"} {
+		if !findEvent(events, "stdout", want) {
+			t.Errorf("Expected stdout event %q, got %v", want, events)
+		}
+	}
+
+	// The whole stream can be fetched again once the job has finished.
+	if _, all := getJobEvents(t, s, id, 0, 0); len(all) != len(events) {
+		t.Errorf("Expected %d events, got %v", len(events), all)
+	}
+
+	// The response was cached, so a job for the same bundle finishes
+	// immediately without running the builder.
+	id = createJob(t, s, `{"files": [{"name": "src/main/main.go", "body": "fake jobs"}]}`)
+	_, cached := getJobEvents(t, s, id, 1, 0)
+	checkSeq(t, cached, 1)
+	if !findEvent(cached, "stdout", "PROGRAM END") {
+		t.Errorf("Expected cached job to contain program output, got %v", cached)
+	}
+}
+
+func TestJobCanBeDeleted(t *testing.T) {
+	c := &compiler{
+		dispatcher: &mockDispatcher{sendSuccess: true},
+		cache:      newTestCache(),
+	}
+	s := newJobsServer(c)
+	defer s.Close()
+
+	id := createJob(t, s, `{"files": []}`)
+	del := func() int {
+		req, err := http.NewRequest("DELETE", s.URL+"/jobs/"+id, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed deleting job: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := del(); got != http.StatusNoContent {
+		t.Errorf("Expected status %v but got %v", http.StatusNoContent, got)
+	}
+	if got, _ := getJobEvents(t, s, id, 1, 0); got != http.StatusNotFound {
+		t.Errorf("Expected status %v for deleted job but got %v", http.StatusNotFound, got)
+	}
+	if got := del(); got != http.StatusNotFound {
+		t.Errorf("Expected status %v but got %v", http.StatusNotFound, got)
+	}
+}
+
+func TestJobBadRequests(t *testing.T) {
+	c := &compiler{
+		dispatcher: &mockDispatcher{sendSuccess: true},
+		cache:      newTestCache(),
+	}
+	s := newJobsServer(c)
+	defer s.Close()
+	id := createJob(t, s, `{"files": []}`)
+
+	tests := []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", "/jobs", http.StatusBadRequest},
+		{"GET", "/jobs/unknown/events", http.StatusNotFound},
+		{"GET", "/jobs/" + id + "/events?from=x", http.StatusBadRequest},
+		{"GET", "/jobs/" + id, http.StatusBadRequest},
+		{"GET", "/jobs/" + id + "/events/x", http.StatusNotFound},
+		{"POST", "/jobs/" + id + "/events", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, s.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", test.method, test.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("%s %s: expected status %v but got %v", test.method, test.path, test.want, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Post(s.URL+"/jobs", "application/json", bytes.NewBufferString(`{"files": [], "probe": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status %v for probe request but got %v", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	c.dispatcher = &mockDispatcher{queueFull: 10}
+	resp, err = http.Post(s.URL+"/jobs", "application/json", bytes.NewBufferString(`{"files": [{"name": "a.go", "body": "x"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %v for full queue but got %v", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
+
+// waitForJob waits for the job with the given ID to finish.
+func waitForJob(t *testing.T, c *compiler, id string) {
+	aj := c.getJob(id)
+	if aj == nil {
+		t.Fatalf("Expected job %s to be retained", id)
+	}
+	select {
+	case <-aj.done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected job %s to finish", id)
+	}
+}
+
+func TestRetainedJobsAreCapped(t *testing.T) {
+	defer func(max int) { *maxRetainedJobs = max }(*maxRetainedJobs)
+	*maxRetainedJobs = 2
+	c := &compiler{
+		dispatcher: &mockDispatcher{sendSuccess: true},
+		cache:      newTestCache(),
+	}
+	s := newJobsServer(c)
+	defer s.Close()
+
+	id1 := createJob(t, s, `{"files": [{"name": "a.go", "body": "1"}]}`)
+	waitForJob(t, c, id1)
+	id2 := createJob(t, s, `{"files": [{"name": "a.go", "body": "2"}]}`)
+	// The finished job is forgotten to make room.
+	id3 := createJob(t, s, `{"files": [{"name": "a.go", "body": "3"}]}`)
+	if c.getJob(id1) != nil {
+		t.Errorf("Expected oldest finished job %s to be forgotten", id1)
+	}
+	// Running jobs are not forgotten, so new jobs are rejected.
+	resp, err := http.Post(s.URL+"/jobs", "application/json", bytes.NewBufferString(`{"files": [{"name": "a.go", "body": "4"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %v with too many running jobs but got %v", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	for _, id := range []string{id2, id3} {
+		if c.getJob(id) == nil {
+			t.Errorf("Expected running job %s to be retained", id)
+		}
+	}
+}
+
+func TestJobCreationIsRateLimited(t *testing.T) {
+	c := &compiler{
+		dispatcher:  &mockDispatcher{sendSuccess: true},
+		cache:       newTestCache(),
+		fingerprint: testFingerprint,
+		limiter:     newRateLimiter(bucketConfig{burst: 1, refill: 0.1}, nil),
+	}
+	s := newJobsServer(c)
+	defer s.Close()
+
+	body := `{"files": [{"name": "a.go", "body": "x"}]}`
+	waitForJob(t, c, createJob(t, s, body))
+	if _, ok := c.getCachedResponse(cacheKey(testFingerprint, canonicalRequest([]byte(body)))); !ok {
+		t.Fatalf("Expected response to be cached, but it was not.")
+	}
+	// Jobs are retained even if the response is cached, so creating them
+	// counts against the rate limit.
+	resp, err := http.Post(s.URL+"/jobs", "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected status %v for cached job over the rate limit but got %v", http.StatusTooManyRequests, resp.StatusCode)
+	}
+}
+
+func TestExpiredJobsArePruned(t *testing.T) {
+	c := &compiler{}
+	running, finished := newAsyncJob(nil, nil), newAsyncJob(nil, nil)
+	finished.finish(nil)
+	c.addJob(running)
+	c.addJob(finished)
+
+	c.pruneJobsLocked(time.Now())
+	if len(c.jobs) != 2 {
+		t.Errorf("Expected no job to be pruned before --job-retention, got %d jobs", len(c.jobs))
+	}
+	c.pruneJobsLocked(time.Now().Add(*jobRetention + time.Second))
+	if len(c.jobs) != 1 || c.jobs[running.id] == nil {
+		t.Errorf("Expected only the running job to be retained, got %v", c.jobs)
+	}
+}
@@ -26,6 +26,7 @@ import (
 
 	"v.io/x/lib/dbutil"
 	"v.io/x/playground/lib/log"
+	"v.io/x/playground/lib/metrics"
 	"v.io/x/playground/lib/storage"
 )
 
@@ -40,6 +41,8 @@ var (
 	// No values are ever sent to it.
 	lameduck chan bool = make(chan bool)
 
+	lameduckGauge = metrics.NewGauge("playground_lameduck", "1 if the server is shutting down and failing health checks, 0 otherwise.")
+
 	address = flag.String("address", ":8181", "Address to listen on.")
 
 	origin = flag.String("origin", "https://playground.v.io", "The origin where the playground client is hosted. This will be used in CORS headers to allow XHRs to the playground API. Use '*' to allow all origins.")
@@ -48,6 +51,9 @@ var (
 	// between listenTimeout/2 and listenTimeout.
 	listenTimeout = flag.Duration("listen-timeout", 60*time.Minute, "Maximum amount of time to listen for before exiting. A value of 0 disables the timeout.")
 
+	// Time for running queued jobs when exiting.
+	drainTimeout = flag.Duration("drain-timeout", 60*time.Second, "Maximum time to keep running queued and running jobs when exiting. Jobs still queued or running after it are stopped, and their clients told to retry.")
+
 	// Maximum request and output size.
 	// 1<<16 is the same limit as imposed by Go tour.
 	// Note: The response includes error and status messages as well as output,
@@ -82,7 +88,12 @@ func main() {
 		log.Panic(err)
 	}
 
-	c := newCompiler()
+	c, err := newCompiler()
+	if err != nil {
+		log.Panic(err)
+	}
+	go c.probeFingerprint()
+	go c.pruneJobs()
 
 	listenForNs := listenTimeout.Nanoseconds()
 	if listenForNs > 0 {
@@ -125,7 +136,20 @@ func main() {
 	}
 
 	serveMux.HandleFunc("/compile", c.handlerCompile)
+	serveMux.HandleFunc("/jobs", c.handlerJobs)
+	serveMux.HandleFunc("/jobs/", c.handlerJob)
+	serveMux.HandleFunc("/ws", c.handlerWebSocket)
 	serveMux.HandleFunc("/healthz", handlerHealthz)
+	serveMux.Handle("/metrics", metrics.Handler())
+
+	if *adminAddress != "" {
+		log.Debugf("Serving admin requests on %s", *adminAddress)
+		go func() {
+			if err := http.ListenAndServe(*adminAddress, c.newAdminServeMux()); err != nil {
+				log.Panic(err)
+			}
+		}()
+	}
 
 	log.Debugf("Serving %s", *address)
 	s := http.Server{
@@ -148,7 +172,9 @@ func waitForExit(c *compiler, limit time.Duration) {
 	deadline := time.After(limit)
 	log.Debug("Exiting at ", time.Now().Add(limit))
 
-	exitDelay := *maxTime + (10 * time.Second)
+	// Jobs left after the drain timeout are killed, which should take much
+	// less than the extra delay.
+	exitDelay := *drainTimeout + (10 * time.Second)
 
 Loop:
 	for {
@@ -164,6 +190,7 @@ Loop:
 
 	// Fail health checks so we stop getting requests.
 	close(lameduck)
+	lameduckGauge.Set(1)
 
 	go func() {
 		select {
@@ -173,7 +200,7 @@ Loop:
 		}
 	}()
 
-	// Stop the compiler and wait for all in-progress jobs to finish.
+	// Stop the compiler and wait for the queued and in-progress jobs to finish.
 	c.stop()
 
 	// Give the server some extra time to send any remaning responses that are
@@ -198,8 +225,9 @@ Loop:
 func handleCORS(w http.ResponseWriter, r *http.Request) bool {
 	// CORS headers.
 	w.Header().Set("Access-Control-Allow-Origin", *origin)
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, "+apiKeyHeader)
+	w.Header().Set("Access-Control-Expose-Headers", "Retry-After, Location")
 
 	// CORS sends an OPTIONS pre-flight request to make sure the request will be
 	// allowed.
@@ -0,0 +1,236 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Per-client admission control for compile requests.
+//
+// Every client has a token bucket holding up to burst tokens, refilled at a
+// constant rate. Each compile request that is not served from the cache takes
+// a token, and requests from clients with an empty bucket are rejected. This
+// keeps a single heavy client (e.g. a classroom behind one NAT) from filling
+// the job queue and starving everyone else.
+//
+// Clients are identified by API key if the request carries a known key in the
+// X-Api-Key header, otherwise by IP address. API keys can be given their own
+// burst and refill rates.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	rateLimitBurst  = flag.Float64("rate-limit-burst", 20, "Maximum number of uncached compile requests a client can make in a burst. A value of 0 disables rate limiting.")
+	rateLimitRefill = flag.Float64("rate-limit-refill", 0.5, "Rate at which a client's compile request allowance is refilled, in requests per second.")
+
+	apiKeysFile = flag.String("api-keys", "", "Path to a file listing API keys, one per line, each optionally followed by a burst and refill rate overriding --rate-limit-burst and --rate-limit-refill for that key. Requests with a known key in the "+apiKeyHeader+" header are rate limited per key instead of per IP.")
+
+	// Behind a load balancer, the remote address of every connection is the
+	// load balancer's. Each trusted proxy appends the address it received the
+	// request from to X-Forwarded-For, so entries before the n-th from the end
+	// may be forged by the client.
+	forwardedForHops = flag.Int("forwarded-for-hops", 0, "If positive, the client IP used for rate limiting is the n-th entry from the end of the X-Forwarded-For header, as set by n trusted reverse proxies. Otherwise, the remote address of the connection is used.")
+)
+
+const (
+	apiKeyHeader = "X-Api-Key"
+
+	// Buckets that have been refilled completely are forgotten at most this
+	// often, to bound memory use.
+	bucketSweepInterval = time.Minute
+)
+
+// bucketConfig is the size and refill rate (per second) of a token bucket.
+type bucketConfig struct {
+	burst  float64
+	refill float64
+}
+
+type tokenBucket struct {
+	bucketConfig
+	tokens  float64
+	updated time.Time
+}
+
+// update adds the tokens refilled since the last update.
+func (b *tokenBucket) update(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.updated).Seconds()*b.refill)
+	b.updated = now
+}
+
+// rateLimiter keeps a token bucket per client. Initialize using
+// newRateLimiter.
+type rateLimiter struct {
+	defaults bucketConfig
+	apiKeys  map[string]bucketConfig
+	// Returns the current time. Replaced in tests.
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(defaults bucketConfig, apiKeys map[string]bucketConfig) *rateLimiter {
+	return &rateLimiter{
+		defaults: defaults,
+		apiKeys:  apiKeys,
+		now:      time.Now,
+		buckets:  make(map[string]*tokenBucket),
+	}
+}
+
+// newRateLimiterFromFlags returns the rateLimiter configured by flags, or nil
+// if rate limiting is disabled.
+func newRateLimiterFromFlags() (*rateLimiter, error) {
+	if *rateLimitBurst <= 0 {
+		return nil, nil
+	}
+	defaults := bucketConfig{burst: *rateLimitBurst, refill: *rateLimitRefill}
+	if defaults.refill <= 0 {
+		return nil, fmt.Errorf("Invalid rate limit refill rate: %v", defaults.refill)
+	}
+	apiKeys := make(map[string]bucketConfig)
+	if *apiKeysFile != "" {
+		f, err := os.Open(*apiKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if apiKeys, err = parseAPIKeys(f, defaults); err != nil {
+			return nil, fmt.Errorf("Error parsing %s: %v", *apiKeysFile, err)
+		}
+	}
+	return newRateLimiter(defaults, apiKeys), nil
+}
+
+// parseAPIKeys parses lines of the form "<key> [<burst> <refill>]". Empty
+// lines and lines starting with '#' are ignored.
+func parseAPIKeys(r io.Reader, defaults bucketConfig) (map[string]bucketConfig, error) {
+	keys := make(map[string]bucketConfig)
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		cfg := defaults
+		switch len(fields) {
+		case 1:
+		case 3:
+			var err error
+			if cfg.burst, err = strconv.ParseFloat(fields[1], 64); err != nil || cfg.burst <= 0 {
+				return nil, fmt.Errorf("line %d: invalid burst %q", lineNum, fields[1])
+			}
+			if cfg.refill, err = strconv.ParseFloat(fields[2], 64); err != nil || cfg.refill <= 0 {
+				return nil, fmt.Errorf("line %d: invalid refill rate %q", lineNum, fields[2])
+			}
+		default:
+			return nil, fmt.Errorf("line %d: expected key, optionally followed by burst and refill rate", lineNum)
+		}
+		keys[fields[0]] = cfg
+	}
+	return keys, scanner.Err()
+}
+
+// client returns the bucket key and configuration for the client making the
+// request.
+func (l *rateLimiter) client(r *http.Request) (string, bucketConfig) {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		if cfg, ok := l.apiKeys[key]; ok {
+			return "key:" + key, cfg
+		}
+	}
+	return "ip:" + clientIP(r), l.defaults
+}
+
+// clientKey returns the key identifying the client making the request, as
+// used for rate limiting even if it is disabled.
+func (c *compiler) clientKey(r *http.Request) string {
+	if c.limiter != nil {
+		key, _ := c.limiter.client(r)
+		return key
+	}
+	return "ip:" + clientIP(r)
+}
+
+// clientIP returns the IP address of the client making the request.
+func clientIP(r *http.Request) string {
+	if *forwardedForHops > 0 {
+		var hops []string
+		for _, h := range r.Header[http.CanonicalHeaderKey("X-Forwarded-For")] {
+			hops = append(hops, strings.Split(h, ",")...)
+		}
+		if len(hops) >= *forwardedForHops {
+			return strings.TrimSpace(hops[len(hops)-*forwardedForHops])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// admit takes a token from the bucket of the client making the request. If
+// the bucket is empty, it returns false and the time until a token will be
+// available.
+func (l *rateLimiter) admit(r *http.Request) (bool, time.Duration) {
+	key, cfg := l.client(r)
+	return l.take(key, cfg)
+}
+
+func (l *rateLimiter) take(key string, cfg bucketConfig) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{bucketConfig: cfg, tokens: cfg.burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.update(now)
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / b.refill * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets buckets that have been refilled completely, since they are
+// equivalent to new buckets. Must be called with mu held.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < bucketSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.update(now); b.tokens >= b.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// retryAfter formats a duration as the value of a Retry-After header, in whole
+// seconds rounded up.
+func retryAfter(d time.Duration) string {
+	secs := int64(math.Ceil(d.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.FormatInt(secs, 10)
+}
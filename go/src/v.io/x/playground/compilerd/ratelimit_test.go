@@ -0,0 +1,148 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRateLimiter returns a rateLimiter with a manually advanced clock.
+func newTestRateLimiter(defaults bucketConfig, apiKeys map[string]bucketConfig) (*rateLimiter, *time.Time) {
+	now := time.Unix(1000, 0)
+	l := newRateLimiter(defaults, apiKeys)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func newRequest(remoteAddr, apiKey string) *http.Request {
+	r, err := http.NewRequest("POST", "/compile", nil)
+	if err != nil {
+		panic(err)
+	}
+	r.RemoteAddr = remoteAddr
+	if apiKey != "" {
+		r.Header.Set(apiKeyHeader, apiKey)
+	}
+	return r
+}
+
+func TestTokenBucket(t *testing.T) {
+	l, now := newTestRateLimiter(bucketConfig{burst: 3, refill: 0.5}, nil)
+	r := newRequest("10.0.0.1:1234", "")
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.admit(r); !ok {
+			t.Fatalf("Expected request %d within burst to be admitted", i)
+		}
+	}
+	ok, wait := l.admit(r)
+	if ok {
+		t.Fatalf("Expected request exceeding burst to be rejected")
+	}
+	if wait != 2*time.Second {
+		t.Errorf("Expected wait of %v but got %v", 2*time.Second, wait)
+	}
+
+	// Other clients are not affected.
+	if ok, _ := l.admit(newRequest("10.0.0.2:1234", "")); !ok {
+		t.Errorf("Expected request from another IP to be admitted")
+	}
+
+	*now = now.Add(time.Second)
+	if _, wait := l.admit(r); wait != time.Second {
+		t.Errorf("Expected wait of %v but got %v", time.Second, wait)
+	}
+	*now = now.Add(time.Second)
+	if ok, _ := l.admit(r); !ok {
+		t.Errorf("Expected request to be admitted after refill")
+	}
+	if ok, _ := l.admit(r); ok {
+		t.Errorf("Expected request to be rejected after using refilled token")
+	}
+
+	// Buckets never hold more than burst tokens.
+	*now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.admit(r); !ok {
+			t.Fatalf("Expected request %d within burst to be admitted", i)
+		}
+	}
+	if ok, _ := l.admit(r); ok {
+		t.Errorf("Expected request exceeding burst to be rejected")
+	}
+}
+
+func TestRateLimitAPIKeys(t *testing.T) {
+	keys, err := parseAPIKeys(strings.NewReader(`
+# Comment.
+classroom 5 1
+plainkey
+`), bucketConfig{burst: 1, refill: 1})
+	if err != nil {
+		t.Fatalf("parseAPIKeys failed: %v", err)
+	}
+	l, _ := newTestRateLimiter(bucketConfig{burst: 1, refill: 1}, keys)
+
+	// Known keys get their own buckets, independent of the IP.
+	for i := 0; i < 5; i++ {
+		if ok, _ := l.admit(newRequest("10.0.0.1:1234", "classroom")); !ok {
+			t.Fatalf("Expected request %d with API key to be admitted", i)
+		}
+	}
+	if ok, _ := l.admit(newRequest("10.0.0.1:1234", "classroom")); ok {
+		t.Errorf("Expected request exceeding API key burst to be rejected")
+	}
+	if ok, _ := l.admit(newRequest("10.0.0.1:1234", "plainkey")); !ok {
+		t.Errorf("Expected request with another API key to be admitted")
+	}
+
+	// Unknown keys are limited by IP.
+	if ok, _ := l.admit(newRequest("10.0.0.1:1234", "forged")); !ok {
+		t.Errorf("Expected first request from IP to be admitted")
+	}
+	if ok, _ := l.admit(newRequest("10.0.0.1:1234", "forged2")); ok {
+		t.Errorf("Expected request with unknown API key to share the IP bucket")
+	}
+
+	for _, bad := range []string{"key 1", "key 0 1", "key 1 x", "key 1 2 3"} {
+		if _, err := parseAPIKeys(strings.NewReader(bad), bucketConfig{}); err == nil {
+			t.Errorf("Expected parseAPIKeys to fail for %q", bad)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(hops int) { *forwardedForHops = hops }(*forwardedForHops)
+
+	r := newRequest("10.0.0.1:1234", "")
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8, 10.0.0.9")
+
+	*forwardedForHops = 0
+	if got, want := clientIP(r), "10.0.0.1"; got != want {
+		t.Errorf("Expected client IP %q but got %q", want, got)
+	}
+	*forwardedForHops = 2
+	if got, want := clientIP(r), "5.6.7.8"; got != want {
+		t.Errorf("Expected client IP %q but got %q", want, got)
+	}
+	*forwardedForHops = 4
+	if got, want := clientIP(r), "10.0.0.1"; got != want {
+		t.Errorf("Expected client IP %q but got %q", want, got)
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	c := &compiler{}
+	if got, want := c.clientKey(newRequest("10.0.0.1:1234", "secret")), "ip:10.0.0.1"; got != want {
+		t.Errorf("Expected client key %q without rate limiter but got %q", want, got)
+	}
+	c.limiter, _ = newTestRateLimiter(bucketConfig{burst: 1, refill: 1}, map[string]bucketConfig{"secret": {burst: 1, refill: 1}})
+	if got, want := c.clientKey(newRequest("10.0.0.1:1234", "secret")), "key:secret"; got != want {
+		t.Errorf("Expected client key %q but got %q", want, got)
+	}
+}
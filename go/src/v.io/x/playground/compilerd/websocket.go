@@ -0,0 +1,247 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Handler for WebSocket connections to compile and run playground examples
+// interactively.
+//
+// handlerWebSocket() upgrades a GET request to a WebSocket connection. The
+// client sends bundled example source code in the first message, and the
+// server sends each response event in its own message, encoded as in
+// /compile. While the job runs, the client can send JSON-encoded event.Stdin
+// messages, which are forwarded to builder as input for files marked
+// interactive in the bundle; messages sent while the job is queued are
+// buffered until it starts. The server closes the connection once the job
+// has finished. Errors (program too large, too many requests, service busy)
+// are sent as stderr events, followed by closing the connection.
+//
+// Responses for bundles without interactive files are cached as in /compile.
+// Responses for interactive bundles depend on the input, so they are neither
+// cached nor served from the cache.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"v.io/x/playground/compilerd/jobqueue"
+	"v.io/x/playground/lib"
+	"v.io/x/playground/lib/bundle"
+	"v.io/x/playground/lib/event"
+	"v.io/x/playground/lib/log"
+)
+
+// Time allowed for sending the close message.
+const webSocketCloseTimeout = time.Second
+
+// Maximum number of input messages buffered until builder reads them, e.g.
+// while the job is queued. Their total size is also limited to maxSize.
+const webSocketInputBuffer = 64
+
+var webSocketUpgrader = websocket.Upgrader{
+	CheckOrigin: checkWebSocketOrigin,
+}
+
+// checkWebSocketOrigin allows connections from the origin allowed by CORS for
+// other requests. Browsers do not apply CORS to WebSockets.
+func checkWebSocketOrigin(r *http.Request) bool {
+	o := r.Header.Get("Origin")
+	return *origin == "*" || o == "" || o == *origin
+}
+
+// webSocketWriter sends each write as a text message. It is written to by a
+// JsonSink, which writes one event per line in a single write, so messages
+// contain a single event.
+type webSocketWriter struct {
+	conn *websocket.Conn
+}
+
+func (w webSocketWriter) Write(p []byte) (int, error) {
+	if err := w.conn.WriteMessage(websocket.TextMessage, bytes.TrimSuffix(p, []byte("\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// isInteractive returns whether the request bundle has interactive files.
+func isInteractive(requestBody []byte) bool {
+	var b bundle.Bundle
+	if err := json.Unmarshal(requestBody, &b); err != nil {
+		return false
+	}
+	for _, f := range b.Files {
+		if f != nil && f.Interactive {
+			return true
+		}
+	}
+	return false
+}
+
+// GET request that is upgraded to a WebSocket connection for running a single
+// bundle.
+func (c *compiler) handlerWebSocket(w http.ResponseWriter, r *http.Request) {
+	// Upgrade replies with an error if the request is not a valid WebSocket
+	// handshake.
+	conn, err := webSocketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Debugf("Error upgrading to WebSocket: %v", err)
+		return
+	}
+	defer conn.Close()
+	// Bundles and stdin messages are limited to maxSize. Reading a larger
+	// message fails, closing the connection.
+	conn.SetReadLimit(int64(*maxSize))
+
+	wantDebug := r.FormValue("debug") == "1"
+	// The response is hard limited to 2*maxSize, as in /compile.
+	res := event.NewResponseEventSink(lib.NewLimitedWriter(webSocketWriter{conn}, 2*(*maxSize), lib.DoOnce(func() {
+		log.Error("Hard response size limit reached.")
+	})), !wantDebug)
+	closeWith := func(code int, text string) {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(webSocketCloseTimeout))
+	}
+
+	_, requestBody, err := conn.ReadMessage()
+	if err != nil {
+		log.Debugf("Error reading bundle from WebSocket: %v", err)
+		return
+	}
+
+	if isProbeRequest(requestBody) {
+		res.Write(event.New("", "stderr", "Probe requests are not allowed."))
+		closeWith(websocket.ClosePolicyViolation, "Probe requests are not allowed")
+		return
+	}
+
+	log.Debug("Got valid WebSocket compile request.")
+
+	interactive := isInteractive(requestBody)
+	canonical := canonicalRequest(requestBody)
+	if !interactive {
+		if cr, ok := c.getCachedResponse(cacheKey(c.currentFingerprint(), canonical)); ok {
+			event.Debug(res, "Sending cached response")
+			log.Debug("Sending cached response.")
+			res.Write(cr.Events...)
+			closeWith(websocket.CloseNormalClosure, "")
+			return
+		}
+	}
+
+	if c.limiter != nil {
+		if ok, wait := c.limiter.admit(r); !ok {
+			log.Debug("Client rate limit exceeded.")
+			res.Write(event.New("", "stderr", "Too many requests. Please try again later."))
+			closeWith(websocket.CloseTryAgainLater, "Retry after "+retryAfter(wait)+"s")
+			return
+		}
+	}
+
+	input, inputWriter := io.Pipe()
+	defer inputWriter.Close()
+	job := jobqueue.NewInteractiveJob(requestBody, input, res, *maxSize, *maxTime, c.newRunner)
+	c.scheduleJob(job, r)
+	resultChan, err := c.dispatcher.Enqueue(job)
+	if err == jobqueue.ErrStopped {
+		log.Warn("Failed queuing job: ", err)
+		res.Write(shutdownRetryEvent())
+		closeWith(websocket.CloseTryAgainLater, "Retry after "+retryAfter(0)+"s")
+		return
+	} else if err != nil {
+		log.Warn("Failed queuing job: ", err)
+		res.Write(event.New("", "stderr", "Service busy. Please try again later."))
+		closeWith(websocket.CloseTryAgainLater, "Retry after "+retryAfter(queueWait(err))+"s")
+		return
+	}
+
+	clientDisconnect := make(chan struct{})
+	go relayWebSocketInput(conn, res, inputWriter, clientDisconnect)
+
+	// Wait for the job to finish, since writing to res after returning would
+	// fail, as in /compile.
+	for {
+		select {
+		case <-clientDisconnect:
+			log.Debug("Client disconnected. Cancelling job.")
+			job.Cancel()
+			clientDisconnect = nil
+		case result := <-resultChan:
+			// Builder has exited, so no more input is needed.
+			inputWriter.Close()
+			if interactive {
+				writeStatus(res, result)
+				event.Debug(res, "Interactive run, not caching response.")
+			} else {
+				c.finishJob(res, canonical, result)
+			}
+			closeWith(websocket.CloseNormalClosure, "")
+			return
+		}
+	}
+}
+
+// relayWebSocketInput reads event.Stdin messages from the connection and
+// writes them to w, one per line, until the connection is closed. Invalid
+// messages are reported to res. Closes clientDisconnect once the connection
+// is closed, and w once the buffered input has been written.
+//
+// Writes to w block until builder reads them, which it does not do while the
+// job is queued, so the connection is read independently of w, and messages
+// are buffered in between. Messages that do not fit in the buffer are
+// dropped and reported to res.
+func relayWebSocketInput(conn *websocket.Conn, res event.Sink, w *io.PipeWriter, clientDisconnect chan<- struct{}) {
+	input := make(chan []byte, webSocketInputBuffer)
+	var bufferedMu sync.Mutex
+	buffered := 0
+	go func() {
+		defer w.Close()
+		for line := range input {
+			bufferedMu.Lock()
+			buffered -= len(line)
+			bufferedMu.Unlock()
+			if _, err := w.Write(line); err != nil {
+				// The job has finished, so the remaining input is discarded.
+				return
+			}
+		}
+	}()
+
+	defer close(clientDisconnect)
+	defer close(input)
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var in event.Stdin
+		if err := json.Unmarshal(msg, &in); err != nil || in.File == "" {
+			res.Write(event.New("", "stderr", "Ignoring invalid input message."))
+			continue
+		}
+		js, err := json.Marshal(&in)
+		if err != nil {
+			log.Panicf("Error encoding input: %v", err)
+		}
+		line := append(js, '\n')
+		bufferedMu.Lock()
+		full := buffered+len(line) > *maxSize
+		if !full {
+			select {
+			case input <- line:
+				buffered += len(line)
+			default:
+				full = true
+			}
+		}
+		bufferedMu.Unlock()
+		if full {
+			res.Write(event.New(in.File, "stderr", "Too much pending input, dropping input message."))
+		}
+	}
+}
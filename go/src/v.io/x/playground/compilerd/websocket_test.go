@@ -0,0 +1,208 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"v.io/x/playground/compilerd/jobqueue"
+	"v.io/x/playground/lib/event"
+)
+
+func dialWebSocket(t *testing.T, c *compiler) (*websocket.Conn, func()) {
+	s := httptest.NewServer(http.HandlerFunc(c.handlerWebSocket))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/ws", nil)
+	if err != nil {
+		s.Close()
+		t.Fatalf("Failed dialing WebSocket: %v", err)
+	}
+	return conn, func() {
+		conn.Close()
+		s.Close()
+	}
+}
+
+// readEvent reads the next event from the connection. It returns false once
+// the server closes the connection, failing the test if it did not close it
+// normally.
+func readEvent(t *testing.T, conn *websocket.Conn) (event.Event, bool) {
+	var e event.Event
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			t.Errorf("Expected normal closure, got %v", err)
+		}
+		return e, false
+	}
+	if err := json.Unmarshal(msg, &e); err != nil {
+		t.Fatalf("Failed decoding event %q: %v", msg, err)
+	}
+	return e, true
+}
+
+// readUntil reads events until one with the given message, and returns all
+// events read.
+func readUntil(t *testing.T, conn *websocket.Conn, message string) []event.Event {
+	var events []event.Event
+	for {
+		e, ok := readEvent(t, conn)
+		if !ok {
+			t.Fatalf("Connection closed before %q, got %v", message, events)
+		}
+		events = append(events, e)
+		if e.Message == message {
+			return events
+		}
+	}
+}
+
+// readToClose reads events until the server closes the connection.
+func readToClose(t *testing.T, conn *websocket.Conn) {
+	for {
+		if _, ok := readEvent(t, conn); !ok {
+			return
+		}
+	}
+}
+
+func TestWebSocketInteractiveInput(t *testing.T) {
+	c := newFakeCompiler(t, "echo.json")
+	defer c.stop()
+	conn, closeConn := dialWebSocket(t, c)
+	defer closeConn()
+
+	bundle := `{"files": [{"name": "src/main/main.go", "body": "fake echo", "interactive": true}]}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(bundle)); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, conn, "READY FOR INPUT")
+
+	for _, in := range []event.Stdin{
+		{File: "src/main/main.go", Data: "hello\n"},
+		{File: "src/main/main.go", Data: "world\n", Close: true},
+	} {
+		if err := conn.WriteJSON(in); err != nil {
+			t.Fatal(err)
+		}
+		if e := readUntil(t, conn, in.Data); e[len(e)-1].File != in.File {
+			t.Errorf("Expected echoed input for %s, got %v", in.File, e[len(e)-1])
+		}
+	}
+	readUntil(t, conn, "PROGRAM END")
+	readToClose(t, conn)
+
+	// Interactive responses are not cached.
+	if _, ok := c.getCachedResponse(cacheKey(c.currentFingerprint(), canonicalRequest([]byte(bundle)))); ok {
+		t.Errorf("Expected interactive response not to be cached, but it was.")
+	}
+}
+
+func TestWebSocketInvalidInput(t *testing.T) {
+	c := newFakeCompiler(t, "echo.json")
+	defer c.stop()
+	conn, closeConn := dialWebSocket(t, c)
+	defer closeConn()
+
+	bundle := `{"files": [{"name": "src/main/main.go", "body": "fake echo", "interactive": true}]}`
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(bundle)); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, conn, "READY FOR INPUT")
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, conn, "Ignoring invalid input message.")
+
+	// Closing the connection ends the input, which lets the program finish
+	// before the compiler is stopped.
+	conn.Close()
+}
+
+func TestWebSocketDisconnectWhileQueued(t *testing.T) {
+	c := newFakeCompiler(t, "hang.json")
+	defer c.stop()
+	var runnersMu sync.Mutex
+	runners := 0
+	newRunner := c.newRunner
+	c.newRunner = func(id string) jobqueue.Runner {
+		runnersMu.Lock()
+		runners++
+		runnersMu.Unlock()
+		return newRunner(id)
+	}
+
+	// The first job hangs, occupying the only worker.
+	running, closeRunning := dialWebSocket(t, c)
+	defer closeRunning()
+	if err := running.WriteMessage(websocket.TextMessage, []byte(`{"files": [{"name": "src/main/main.go", "body": "fake hang"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, running, "PROGRAM START")
+
+	handlerDone := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.handlerWebSocket(w, r)
+		close(handlerDone)
+	}))
+	defer s.Close()
+	queued, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Failed dialing WebSocket: %v", err)
+	}
+	bundle := `{"files": [{"name": "src/main/main.go", "body": "fake echo", "interactive": true}]}`
+	if err := queued.WriteMessage(websocket.TextMessage, []byte(bundle)); err != nil {
+		t.Fatal(err)
+	}
+	// Input sent while the job is queued does not keep the disconnect from
+	// being noticed.
+	for i := 0; i < 2; i++ {
+		if err := queued.WriteJSON(event.Stdin{File: "src/main/main.go", Data: "hello\n"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queued.Close()
+
+	// Cancelled jobs are dropped once they reach a worker, without being run.
+	time.Sleep(200 * time.Millisecond)
+	closeRunning()
+	select {
+	case <-handlerDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected queued job to end when the client disconnected")
+	}
+	runnersMu.Lock()
+	defer runnersMu.Unlock()
+	if runners != 1 {
+		t.Errorf("Expected queued job to be cancelled before running, got %d runs", runners)
+	}
+}
+
+func TestWebSocketResponsesAreCached(t *testing.T) {
+	c := newFakeCompiler(t, "hello.json")
+	defer c.stop()
+	c.probeFingerprint()
+
+	bundle := `{"files": [{"name": "src/main/main.go", "body": "fake hello"}]}`
+	for i := 0; i < 2; i++ {
+		conn, closeConn := dialWebSocket(t, c)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(bundle)); err != nil {
+			t.Fatal(err)
+		}
+		readUntil(t, conn, "PROGRAM END")
+		readToClose(t, conn)
+		closeConn()
+		if _, ok := c.getCachedResponse(cacheKey(fakeFingerprint.ID(), canonicalRequest([]byte(bundle)))); !ok {
+			t.Errorf("Expected response to be cached after connection %d, but it was not.", i)
+		}
+	}
+}
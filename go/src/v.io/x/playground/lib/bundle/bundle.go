@@ -11,12 +11,34 @@ package bundle
 // TODO(ivanpi): Add validity check (file extensions, etc) and refactor builder
 // and storage to use the same structure.
 
+// Bundle mirrors the request read by builder. It must contain every field
+// builder reads, since bundles are compared using their canonical encoding
+// (see Canonical).
 type Bundle struct {
 	Files []*CodeFile `json:"files"`
+	// Credentials to run files with, in addition to any given in a .id file.
+	Credentials []*Credentials `json:"credentials,omitempty"`
 	// TODO(ivanpi): Add slug, title, description? Merge with compilerd.BundleFullResponse?
 }
 
 type CodeFile struct {
 	Name string `json:"name"`
 	Body string `json:"body"`
+	// Startup ordering and run options, see codeFile in builder.
+	Kind    string            `json:"kind,omitempty"`
+	WaitFor []string          `json:"waitFor,omitempty"`
+	Ready   string            `json:"ready,omitempty"`
+	Args    []string          `json:"args,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	Stdin   string            `json:"stdin,omitempty"`
+	// Whether the file reads stdin interactively, see event.Stdin.
+	Interactive bool `json:"interactive,omitempty"`
+}
+
+// Credentials for running a set of files, see credentials in builder.
+type Credentials struct {
+	Name     string   `json:"name"`
+	Blesser  string   `json:"blesser,omitempty"`
+	Duration string   `json:"duration,omitempty"`
+	Files    []string `json:"files,omitempty"`
 }
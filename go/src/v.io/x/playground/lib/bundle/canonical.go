@@ -0,0 +1,69 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Canonical encoding of bundles, used to recognize bundles that only differ
+// in ways builder ignores, e.g. when caching builder responses.
+
+package bundle
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"path"
+	"sort"
+	"strings"
+)
+
+type CanonicalOptions struct {
+	// Whether to gofmt Go sources. Sources that fail to parse are left
+	// unchanged. Note that formatting can move code, so compiler errors for
+	// bundles with the same canonical encoding may refer to different
+	// positions.
+	Gofmt bool
+}
+
+// Canonical parses the JSON-encoded bundle and returns its canonical
+// encoding. Bundles differing only in JSON formatting and key order (which is
+// case-insensitive, as in builder), unknown keys, file order or trailing
+// newlines in file bodies have the same canonical encoding.
+func Canonical(data []byte, opts CanonicalOptions) ([]byte, error) {
+	var b Bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, err
+	}
+	if err := b.canonicalize(opts); err != nil {
+		return nil, err
+	}
+	return json.Marshal(&b)
+}
+
+func (b *Bundle) canonicalize(opts CanonicalOptions) error {
+	for _, f := range b.Files {
+		if f == nil {
+			return fmt.Errorf("null file in bundle")
+		}
+		// Stdin is passed to the program as is, but trailing newlines in source
+		// files are insignificant.
+		f.Body = strings.TrimRight(f.Body, "\n") + "\n"
+		if opts.Gofmt && path.Ext(f.Name) == ".go" {
+			if src, err := format.Source([]byte(f.Body)); err == nil {
+				f.Body = string(src)
+			}
+		}
+	}
+	for _, c := range b.Credentials {
+		if c == nil {
+			return fmt.Errorf("null credentials in bundle")
+		}
+	}
+	sort.Stable(byName(b.Files))
+	return nil
+}
+
+type byName []*CodeFile
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,127 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bundle
+
+import (
+	"testing"
+)
+
+func canonical(t *testing.T, data string, opts CanonicalOptions) string {
+	c, err := Canonical([]byte(data), opts)
+	if err != nil {
+		t.Fatalf("Canonical(%s) failed: %v", data, err)
+	}
+	return string(c)
+}
+
+func TestCanonicalEquivalent(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		// Whitespace and key order.
+		{
+			`{"files":[{"name":"a.go","body":"x"}]}`,
+			"{\n  \"files\": [\n    {\"body\": \"x\", \"name\": \"a.go\"}\n  ]\n}\n",
+		},
+		// Key case, as in builder.
+		{
+			`{"files":[{"name":"a.go","body":"x","waitFor":["b"]}]}`,
+			`{"Files":[{"Name":"a.go","BODY":"x","WaitFor":["b"]}]}`,
+		},
+		// Unknown keys and empty values.
+		{
+			`{"files":[{"name":"a.go","body":"x"}]}`,
+			`{"files":[{"name":"a.go","body":"x","args":[],"env":{},"comment":"?"}],"credentials":null,"slug":"s"}`,
+		},
+		// File order.
+		{
+			`{"files":[{"name":"a.go","body":"x"},{"name":"b.go","body":"y"}]}`,
+			`{"files":[{"name":"b.go","body":"y"},{"name":"a.go","body":"x"}]}`,
+		},
+		// Trailing newlines.
+		{
+			`{"files":[{"name":"a.go","body":"x"}]}`,
+			`{"files":[{"name":"a.go","body":"x\n\n\n"}]}`,
+		},
+		// Env order.
+		{
+			`{"files":[{"name":"a.go","body":"x","env":{"A":"1","B":"2"}}]}`,
+			`{"files":[{"name":"a.go","body":"x","env":{"B":"2","A":"1"}}]}`,
+		},
+	}
+	for _, test := range tests {
+		if a, b := canonical(t, test.a, CanonicalOptions{}), canonical(t, test.b, CanonicalOptions{}); a != b {
+			t.Errorf("Expected %s and %s to have the same canonical encoding, got %s and %s", test.a, test.b, a, b)
+		}
+	}
+}
+
+func TestCanonicalDifferent(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		// Leading newlines.
+		{
+			`{"files":[{"name":"a.go","body":"x"}]}`,
+			`{"files":[{"name":"a.go","body":"\nx"}]}`,
+		},
+		// Trailing newlines in stdin.
+		{
+			`{"files":[{"name":"a.go","body":"x","stdin":"in"}]}`,
+			`{"files":[{"name":"a.go","body":"x","stdin":"in\n"}]}`,
+		},
+		// Argument order.
+		{
+			`{"files":[{"name":"a.go","body":"x","args":["-a","-b"]}]}`,
+			`{"files":[{"name":"a.go","body":"x","args":["-b","-a"]}]}`,
+		},
+		// Credentials.
+		{
+			`{"files":[{"name":"a.go","body":"x"}]}`,
+			`{"files":[{"name":"a.go","body":"x"}],"credentials":[{"name":"alice","files":["a.go"]}]}`,
+		},
+		// Formatting, unless gofmt is enabled.
+		{
+			`{"files":[{"name":"a.go","body":"package a\nfunc  f() {}"}]}`,
+			`{"files":[{"name":"a.go","body":"package a\n\nfunc f() {}"}]}`,
+		},
+	}
+	for _, test := range tests {
+		if a, b := canonical(t, test.a, CanonicalOptions{}), canonical(t, test.b, CanonicalOptions{}); a == b {
+			t.Errorf("Expected %s and %s to have different canonical encodings, got %s", test.a, test.b, a)
+		}
+	}
+}
+
+func TestCanonicalGofmt(t *testing.T) {
+	gofmt := CanonicalOptions{Gofmt: true}
+	a := `{"files":[{"name":"a.go","body":"package a\nfunc  f() {}"}]}`
+	b := `{"files":[{"name":"a.go","body":"package a\n\nfunc f() {}"}]}`
+	if ca, cb := canonical(t, a, gofmt), canonical(t, b, gofmt); ca != cb {
+		t.Errorf("Expected %s and %s to have the same canonical encoding with gofmt, got %s and %s", a, b, ca, cb)
+	}
+
+	// Only Go sources that parse are formatted.
+	for _, data := range []string{
+		`{"files":[{"name":"a.vdl","body":"package a\nfunc  f() {}"}]}`,
+		`{"files":[{"name":"a.go","body":"package a\nfunc  f( {}"}]}`,
+	} {
+		if c, want := canonical(t, data, gofmt), canonical(t, data, CanonicalOptions{}); c != want {
+			t.Errorf("Expected %s to be left unformatted, got %s", data, c)
+		}
+	}
+}
+
+func TestCanonicalInvalid(t *testing.T) {
+	for _, data := range []string{
+		`not json`,
+		`{"files":[null]}`,
+		`{"files":[{"name":"a.go","args":"-v"}]}`,
+	} {
+		if c, err := Canonical([]byte(data), CanonicalOptions{}); err == nil {
+			t.Errorf("Expected Canonical(%s) to fail, got %s", data, c)
+		}
+	}
+}
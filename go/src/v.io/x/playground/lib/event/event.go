@@ -7,6 +7,8 @@ package event
 import (
 	"fmt"
 	"time"
+
+	"v.io/x/playground/lib/hash"
 )
 
 // Typed representation of data sent to stdin/stdout from a command.  These
@@ -16,10 +18,107 @@ type Event struct {
 	File string
 	// The text sent to stdin/stderr.
 	Message string
-	// Stream that the message was sent to, either "stdout" or "stderr".
+	// Stream that the message was sent to, usually "stdout" or "stderr".
+	// Builder status messages use other streams, e.g. "debug" or "timeout".
 	Stream string
 	// Unix time, the number of nanoseconds elapsed since January 1, 1970 UTC.
 	Timestamp int64
+	// Structured compiler diagnostic. Only set on "diagnostic" stream Events.
+	Diagnostic *Diagnostic `json:",omitempty"`
+	// Process exit status. Only set on "exit" stream Events.
+	Exit *ExitStatus `json:",omitempty"`
+	// Builder and toolchain fingerprint. Only set on the "fingerprint" stream
+	// Event sent by builder in response to a probe request.
+	Fingerprint *Fingerprint `json:",omitempty"`
+	// Position of a job waiting for a worker. Only set on the "queue" stream
+	// Events sent by compilerd periodically while the job is queued.
+	Queue *QueueStatus `json:",omitempty"`
+	// How the job finished. Only set on the "status" stream Event sent by
+	// compilerd after the job's other Events.
+	Status *JobStatus `json:",omitempty"`
+	// Position of the Event in the event stream of an asynchronous job,
+	// starting at 1. Only set on Events streamed by the compilerd job API.
+	Seq int `json:",omitempty"`
+}
+
+// Diagnostic is a compiler error or warning attributed to a location in a
+// bundle file.
+type Diagnostic struct {
+	// Bundle-relative name of the file, e.g. "src/server/server.go".
+	File string
+	// Line and column are 1-based. Column is 0 if unknown.
+	Line   int
+	Column int
+	// Either "error" or "warning".
+	Severity string
+	Message  string
+}
+
+// ExitStatus describes how a user process ended. Durations are in
+// nanoseconds.
+type ExitStatus struct {
+	// Exit code of the process, or -1 if it was killed by a signal or never
+	// ran.
+	Code int
+	// Number of the signal that terminated the process, or 0.
+	Signal int
+	// Wall-clock time from process start to exit.
+	WallTime time.Duration
+	// CPU time spent in user and system mode.
+	UserTime   time.Duration
+	SystemTime time.Duration
+	// Maximum resident set size, in kilobytes.
+	MaxRSS int64
+	// Whether the process had to be killed because it did not exit in time
+	// after being asked to stop.
+	ForceKilled bool
+}
+
+// Fingerprint identifies the builder and the toolchain it uses to compile and
+// run user code. Builders with different fingerprints may produce different
+// output for the same request.
+type Fingerprint struct {
+	// Output of "go version".
+	GoVersion string
+	// Git revision of the Vanadium code user code is compiled against.
+	VanadiumRevision string
+	// Hash of the builder binary.
+	BuilderID string
+}
+
+// ID returns a string uniquely identifying the fingerprint.
+func (f Fingerprint) ID() string {
+	return hash.String([]byte(f.GoVersion + "\x00" + f.VanadiumRevision + "\x00" + f.BuilderID))
+}
+
+// JobStatus describes how a compilerd job finished. Durations are in
+// nanoseconds.
+type JobStatus struct {
+	// One of "success", "sized_out", "timed_out", "errored", "cancelled" or
+	// "stopped".
+	Outcome string
+	// Time spent waiting in the job queue, preparing the builder and running
+	// it.
+	QueueTime   time.Duration
+	PrepareTime time.Duration
+	RunTime     time.Duration
+	// CPU time spent by user processes in user and system mode, and the
+	// largest maximum resident set size among them in kilobytes, as reported
+	// in "exit" Events.
+	UserTime   time.Duration
+	SystemTime time.Duration
+	MaxRSS     int64
+	// Size of "stdout" and "stderr" messages, in bytes.
+	OutputBytes int
+}
+
+// QueueStatus describes the position of a job in the compilerd job queue.
+type QueueStatus struct {
+	// 1 for the next job to run.
+	Position int
+	// Estimated time until the job starts running, in nanoseconds, or 0 if
+	// unknown.
+	Wait time.Duration
 }
 
 func New(file string, stream string, message string) Event {
@@ -31,6 +130,86 @@ func New(file string, stream string, message string) Event {
 	}
 }
 
+// NewDiagnostic creates a "diagnostic" stream Event for the given compiler
+// diagnostic. The message is the human-readable form of the diagnostic.
+func NewDiagnostic(file string, d Diagnostic) Event {
+	e := New(file, "diagnostic", d.String())
+	e.Diagnostic = &d
+	return e
+}
+
+func (d Diagnostic) String() string {
+	if d.Column > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s: %s", d.File, d.Line, d.Column, d.Severity, d.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s", d.File, d.Line, d.Severity, d.Message)
+}
+
+// NewExit creates an "exit" stream Event for a process that has ended.
+func NewExit(file string, message string, s ExitStatus) Event {
+	e := New(file, "exit", message)
+	e.Exit = &s
+	return e
+}
+
+// NewFingerprint creates a "fingerprint" stream Event reporting the builder
+// fingerprint. Unlike "debug" Events, it is never filtered out.
+func NewFingerprint(f Fingerprint) Event {
+	e := New("<builder>", "fingerprint", fmt.Sprintf("Builder %s (%s, Vanadium revision %s, builder ID %s)", f.ID(), f.GoVersion, f.VanadiumRevision, f.BuilderID))
+	e.Fingerprint = &f
+	return e
+}
+
+// NewJobStatus creates a "status" stream Event reporting how a job finished.
+func NewJobStatus(message string, s JobStatus) Event {
+	e := New("", "status", message)
+	e.Status = &s
+	return e
+}
+
+// NewQueueStatus creates a "queue" stream Event reporting the position of a
+// job waiting for a worker.
+func NewQueueStatus(s QueueStatus) Event {
+	msg := fmt.Sprintf("Service busy, waiting in queue at position %d.", s.Position)
+	if s.Wait > 0 {
+		msg = fmt.Sprintf("Service busy, waiting in queue at position %d, about %v left.", s.Position, roundWait(s.Wait))
+	}
+	e := New("", "queue", msg)
+	e.Queue = &s
+	return e
+}
+
+// roundWait rounds a wait estimate up to a whole number of seconds.
+func roundWait(d time.Duration) time.Duration {
+	return (d + time.Second - 1) / time.Second * time.Second
+}
+
+// NewRetry creates a "retry" stream Event telling the client to send the
+// request again, e.g. because the compilerd instance running it is shutting
+// down. The retry may be served by another instance.
+func NewRetry(message string) Event {
+	return New("", "retry", message)
+}
+
+// NewPhaseTimeout creates a "timeout" stream Event reporting that a builder
+// phase (e.g. "compile") exceeded its time budget.
+func NewPhaseTimeout(phase string, budget time.Duration) Event {
+	return New("<"+phase+">", "timeout", fmt.Sprintf("The %s phase exceeded its time limit of %v; terminated.", phase, budget))
+}
+
+// Stdin is a chunk of input for a running file. Clients send Stdin frames over
+// the compilerd WebSocket transport, and compilerd forwards them to builder
+// on its stdin, after the request.
+type Stdin struct {
+	// Name of the file whose process the input is for. The file must be
+	// marked as interactive in the request.
+	File string
+	// Input to write to the process's stdin.
+	Data string `json:",omitempty"`
+	// Whether to close the process's stdin after writing Data.
+	Close bool `json:",omitempty"`
+}
+
 // Stream for writing Events to.
 type Sink interface {
 	Write(events ...Event) error
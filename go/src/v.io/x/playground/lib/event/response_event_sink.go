@@ -23,6 +23,10 @@ type ResponseEventSink struct {
 	mu sync.Mutex
 	JsonSink
 	written []Event
+	// Number of Events removed from written by PopWrittenEvents.
+	popped int
+	// Closed (and cleared) when Events are written, if not nil.
+	changed chan struct{}
 }
 
 func NewResponseEventSink(writer io.Writer, filterDebug bool) *ResponseEventSink {
@@ -35,6 +39,10 @@ func (r *ResponseEventSink) Write(events ...Event) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.written = append(r.written, events...)
+	if r.changed != nil {
+		close(r.changed)
+		r.changed = nil
+	}
 	return r.JsonSink.Write(events...)
 }
 
@@ -44,9 +52,27 @@ func (r *ResponseEventSink) PopWrittenEvents() []Event {
 	defer r.mu.Unlock()
 	events := r.written
 	r.written = nil
+	r.popped += len(events)
 	return events
 }
 
+// WrittenSince returns the Events written after the first n Events, and a
+// channel that is closed when more Events are written. Events returned by
+// PopWrittenEvents are no longer available; if any of them were written after
+// the first n, no Events are returned.
+func (r *ResponseEventSink) WrittenSince(n int) ([]Event, <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.changed == nil {
+		r.changed = make(chan struct{})
+	}
+	i := n - r.popped
+	if i < 0 || i >= len(r.written) {
+		return nil, r.changed
+	}
+	return append([]Event(nil), r.written[i:]...), r.changed
+}
+
 // Each line written to the returned writer, up to limit bytes total, is parsed
 // into an Event and written to Sink.
 // If the limit is reached or an invalid line read, the corresponding callback
@@ -0,0 +1,386 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package metrics implements counters, gauges and histograms exported in the
+// Prometheus text format, without depending on the Prometheus client library
+// or any external service.
+//
+// Metrics are usually package-level variables registered in the default
+// registry, e.g.:
+//
+//   var requests = metrics.NewCounter("playground_requests_total", "Number of requests, by method.", "method")
+//
+//   requests.Inc("GET")
+//
+// and served by metrics.Handler().
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry is a set of metrics with unique names.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+var defaultRegistry = NewRegistry()
+
+// metric is implemented by Counter, Gauge and Histogram.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// register adds the metric to the registry. Registering two metrics with the
+// same name is a bug, so it panics.
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("metric %q registered twice", name))
+	}
+	r.metrics[name] = m
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format,
+// sorted by name.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ms := make([]metric, len(names))
+	for i, name := range names {
+		ms[i] = r.metrics[name]
+	}
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range ms {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler returns a handler serving the metrics in the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteText(w)
+	})
+}
+
+// Handler returns a handler serving the metrics in the default registry.
+func Handler() http.Handler {
+	return defaultRegistry.Handler()
+}
+
+// desc describes a metric and keeps its series, one per combination of label
+// values.
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	// Value of a counter or gauge, sum of a histogram.
+	value float64
+	// Per-bucket counts and total count of a histogram.
+	counts []uint64
+	count  uint64
+}
+
+func newDesc(name, help, typ string, labels []string) *desc {
+	d := &desc{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: make(map[string]*series),
+	}
+	return d
+}
+
+// get returns the series with the given label values, creating it if needed.
+// Must be called with mu held.
+func (d *desc) get(labelValues []string) *series {
+	if len(labelValues) != len(d.labels) {
+		panic(fmt.Sprintf("metric %q has labels %v, got values %v", d.name, d.labels, labelValues))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := d.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		d.series[key] = s
+	}
+	return s
+}
+
+// sorted returns the series sorted by label values. Must be called with mu
+// held.
+func (d *desc) sorted() []*series {
+	keys := make([]string, 0, len(d.series))
+	for key := range d.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	ss := make([]*series, len(keys))
+	for i, key := range keys {
+		ss[i] = d.series[key]
+	}
+	return ss
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escape(d.help, false))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// writeSample writes a single sample line. extra is an additional label pair,
+// e.g. a histogram bucket bound.
+func (d *desc) writeSample(w *bufio.Writer, suffix string, labelValues []string, extra string, value float64) {
+	w.WriteString(d.name + suffix)
+	if len(labelValues) > 0 || extra != "" {
+		var pairs []string
+		for i, v := range labelValues {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", d.labels[i], escape(v, true)))
+		}
+		if extra != "" {
+			pairs = append(pairs, extra)
+		}
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func escape(s string, quotes bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quotes {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, +1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+////////////////////////////////////////
+// Counter
+
+// Counter is a monotonically increasing value, optionally partitioned by
+// labels.
+type Counter struct {
+	d *desc
+}
+
+// NewCounter creates a counter with the given label names and registers it in
+// the default registry.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return defaultRegistry.NewCounter(name, help, labels...)
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newDesc(name, help, "counter", labels)}
+	if len(labels) == 0 {
+		c.d.get(nil)
+	}
+	r.register(name, c)
+	return c
+}
+
+// Inc increments the counter for the given label values by 1.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter for the given label values by delta, which must
+// not be negative.
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("counter %q decremented", c.d.name))
+	}
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	c.d.get(labelValues).value += delta
+}
+
+// Value returns the counter for the given label values.
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	return c.d.get(labelValues).value
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	c.d.writeHeader(w)
+	for _, s := range c.d.sorted() {
+		c.d.writeSample(w, "", s.labelValues, "", s.value)
+	}
+}
+
+////////////////////////////////////////
+// Gauge
+
+// Gauge is a value that can go up and down, optionally partitioned by labels.
+type Gauge struct {
+	d *desc
+}
+
+// NewGauge creates a gauge with the given label names and registers it in the
+// default registry.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return defaultRegistry.NewGauge(name, help, labels...)
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newDesc(name, help, "gauge", labels)}
+	if len(labels) == 0 {
+		g.d.get(nil)
+	}
+	r.register(name, g)
+	return g
+}
+
+// Set sets the gauge for the given label values.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.d.mu.Lock()
+	defer g.d.mu.Unlock()
+	g.d.get(labelValues).value = v
+}
+
+// Add adds delta, which may be negative, to the gauge for the given label
+// values.
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.d.mu.Lock()
+	defer g.d.mu.Unlock()
+	g.d.get(labelValues).value += delta
+}
+
+// Value returns the gauge for the given label values.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	g.d.mu.Lock()
+	defer g.d.mu.Unlock()
+	return g.d.get(labelValues).value
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.d.mu.Lock()
+	defer g.d.mu.Unlock()
+	g.d.writeHeader(w)
+	for _, s := range g.d.sorted() {
+		g.d.writeSample(w, "", s.labelValues, "", s.value)
+	}
+}
+
+////////////////////////////////////////
+// Histogram
+
+// Histogram counts observed values in buckets, optionally partitioned by
+// labels.
+type Histogram struct {
+	d *desc
+	// Upper bounds of the buckets, in increasing order. The +Inf bucket is
+	// implicit.
+	buckets []float64
+}
+
+// NewHistogram creates a histogram with the given bucket upper bounds and
+// label names, and registers it in the default registry.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return defaultRegistry.NewHistogram(name, help, buckets, labels...)
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("histogram %q buckets not sorted: %v", name, buckets))
+	}
+	h := &Histogram{newDesc(name, help, "histogram", labels), buckets}
+	if len(labels) == 0 {
+		h.get(nil)
+	}
+	r.register(name, h)
+	return h
+}
+
+// get returns the series with the given label values. Must be called with
+// d.mu held.
+func (h *Histogram) get(labelValues []string) *series {
+	s := h.d.get(labelValues)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(h.buckets))
+	}
+	return s
+}
+
+// Observe records a value for the given label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.d.mu.Lock()
+	defer h.d.mu.Unlock()
+	s := h.get(labelValues)
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.value += v
+}
+
+// Count returns the number of values observed for the given label values.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	h.d.mu.Lock()
+	defer h.d.mu.Unlock()
+	return h.get(labelValues).count
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.d.mu.Lock()
+	defer h.d.mu.Unlock()
+	h.d.writeHeader(w)
+	for _, s := range h.d.sorted() {
+		// Bucket counts are cumulative.
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			h.d.writeSample(w, "_bucket", s.labelValues, fmt.Sprintf("le=\"%s\"", formatFloat(bound)), float64(cumulative))
+		}
+		h.d.writeSample(w, "_bucket", s.labelValues, `le="+Inf"`, float64(s.count))
+		h.d.writeSample(w, "_sum", s.labelValues, "", s.value)
+		h.d.writeSample(w, "_count", s.labelValues, "", float64(s.count))
+	}
+}
+
+// DurationBuckets are histogram buckets suitable for request and job
+// durations in seconds, from 5ms to 2 minutes.
+var DurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120}
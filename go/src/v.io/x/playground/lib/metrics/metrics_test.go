@@ -0,0 +1,99 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_requests_total", "Number of requests.", "method", "code")
+	g := r.NewGauge("test_busy", "Whether busy.\nMultiline \\ help.")
+	h := r.NewHistogram("test_duration_seconds", "Duration.", []float64{0.1, 1}, "phase")
+
+	c.Inc("POST", "200")
+	c.Add(2, "GET", "200")
+	c.Inc("GET", `"quoted"`)
+	g.Set(3)
+	g.Add(-2)
+	h.Observe(0.05, "run")
+	h.Observe(0.5, "run")
+	h.Observe(5, "run")
+	h.Observe(1, "queue")
+
+	want := `# HELP test_busy Whether busy.\nMultiline \\ help.
+# TYPE test_busy gauge
+test_busy 1
+# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{phase="queue",le="0.1"} 0
+test_duration_seconds_bucket{phase="queue",le="1"} 1
+test_duration_seconds_bucket{phase="queue",le="+Inf"} 1
+test_duration_seconds_sum{phase="queue"} 1
+test_duration_seconds_count{phase="queue"} 1
+test_duration_seconds_bucket{phase="run",le="0.1"} 1
+test_duration_seconds_bucket{phase="run",le="1"} 2
+test_duration_seconds_bucket{phase="run",le="+Inf"} 3
+test_duration_seconds_sum{phase="run"} 5.55
+test_duration_seconds_count{phase="run"} 3
+# HELP test_requests_total Number of requests.
+# TYPE test_requests_total counter
+test_requests_total{method="GET",code="\"quoted\""} 1
+test_requests_total{method="GET",code="200"} 2
+test_requests_total{method="POST",code="200"} 1
+`
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("Unexpected metrics text, got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if got := c.Value("GET", "200"); got != 2 {
+		t.Errorf("Expected counter value 2, got %v", got)
+	}
+	if got := h.Count("run"); got != 3 {
+		t.Errorf("Expected histogram count 3, got %v", got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Test.").Inc()
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, req)
+	if got, want := w.Body.String(), "# HELP test_total Test.\n# TYPE test_total counter\ntest_total 1\n"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestInvalidUsePanics(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Test.", "label")
+	for name, f := range map[string]func(){
+		"duplicate name":  func() { r.NewGauge("test_total", "Test.") },
+		"missing label":   func() { c.Inc() },
+		"negative add":    func() { c.Add(-1, "a") },
+		"unsorted bucket": func() { r.NewHistogram("test_seconds", "Test.", []float64{1, 0.1}) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected panic", name)
+				}
+			}()
+			f()
+		}()
+	}
+}
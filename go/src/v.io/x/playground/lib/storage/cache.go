@@ -0,0 +1,113 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Shared cache of compile responses, stored in the response_cache table.
+// Responses are opaque to storage; they are encoded and decoded by compilerd.
+// Each entry expires at a fixed time. Expired entries are never returned, and
+// are deleted by PruneCachedResponses along with the entries closest to
+// expiry if the table grows too large. Entries are tagged with the fingerprint
+// of the builder that produced them, so that entries from old builders can be
+// deleted using DeleteCachedResponsesExcept.
+
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type CachedResponse struct {
+	// Raw cache key, usually the SHA256 of the request
+	Hash []byte `db:"hash"` // primary key
+	// Fingerprint of the builder that produced the response
+	Fingerprint string `db:"fingerprint"`
+	// The encoded response
+	Data []byte `db:"data"`
+	// Time after which the entry is no longer valid
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// Number of entries deleted per statement when pruning the cache to size, to
+// avoid holding locks for too long.
+const pruneBatchSize = 100
+
+func getCachedResponse(q sqlx.Queryer, hash []byte, now time.Time) (*CachedResponse, error) {
+	var cr CachedResponse
+	if err := sqlx.Get(q, &cr, "SELECT * FROM response_cache WHERE hash=? AND expires_at>?", hash, now); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	return &cr, nil
+}
+
+// GetCachedResponse retrieves the unexpired cached response with the given
+// hash, or returns ErrNotFound.
+func GetCachedResponse(hash []byte) (*CachedResponse, error) {
+	defer observeQuery("get_cached_response", time.Now())
+	return getCachedResponse(dbRead, hash, time.Now())
+}
+
+// StoreCachedResponse stores the response, replacing any existing response
+// with the same hash.
+func StoreCachedResponse(cr *CachedResponse) error {
+	defer observeQuery("store_cached_response", time.Now())
+	_, err := sqlx.NamedExec(dbSeq, "INSERT INTO response_cache (hash, fingerprint, data, expires_at) VALUES (:hash, :fingerprint, :data, :expires_at) ON DUPLICATE KEY UPDATE fingerprint=VALUES(fingerprint), data=VALUES(data), expires_at=VALUES(expires_at)", cr)
+	return err
+}
+
+// DeleteCachedResponsesExcept deletes all cached responses with a fingerprint
+// other than keep. It returns the number of responses deleted.
+func DeleteCachedResponsesExcept(keep string) (int64, error) {
+	defer observeQuery("delete_cached_responses", time.Now())
+	res, err := dbSeq.Exec("DELETE FROM response_cache WHERE fingerprint<>?", keep)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// PruneCachedResponses deletes expired cached responses, then deletes the
+// responses closest to expiry until the total size of the remaining responses
+// is at most maxBytes. It returns the number of responses deleted.
+func PruneCachedResponses(maxBytes int64) (int64, error) {
+	defer observeQuery("prune_cached_responses", time.Now())
+	res, err := dbSeq.Exec("DELETE FROM response_cache WHERE expires_at<=?", time.Now())
+	if err != nil {
+		return 0, err
+	}
+	deleted, _ := res.RowsAffected()
+
+	var total sql.NullInt64
+	if err := sqlx.Get(dbRead, &total, "SELECT SUM(LENGTH(data)) FROM response_cache"); err != nil {
+		return deleted, err
+	}
+	excess := total.Int64 - maxBytes
+	for excess > 0 {
+		var batch []struct {
+			Hash []byte `db:"hash"`
+			Size int64  `db:"size"`
+		}
+		if err := sqlx.Select(dbRead, &batch, "SELECT hash, LENGTH(data) AS size FROM response_cache ORDER BY expires_at LIMIT ?", pruneBatchSize); err != nil {
+			return deleted, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, e := range batch {
+			if excess <= 0 {
+				break
+			}
+			if _, err := dbSeq.Exec("DELETE FROM response_cache WHERE hash=?", e.Hash); err != nil {
+				return deleted, err
+			}
+			deleted++
+			excess -= e.Size
+		}
+	}
+	return deleted, nil
+}
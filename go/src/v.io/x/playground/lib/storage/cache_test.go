@@ -0,0 +1,116 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Tests for the response cache table.
+//
+// NOTE: These tests cannot be run in parallel on the same machine because they
+// interact with a fixed database on the machine.
+
+package storage_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"v.io/x/playground/lib/hash"
+	"v.io/x/playground/lib/storage"
+)
+
+func storeCachedResponse(t *testing.T, key string, size int, ttl time.Duration) []byte {
+	return storeCachedResponseWithFingerprint(t, key, "fp", size, ttl)
+}
+
+func storeCachedResponseWithFingerprint(t *testing.T, key, fingerprint string, size int, ttl time.Duration) []byte {
+	h := hash.Raw([]byte(key))
+	cr := &storage.CachedResponse{
+		Hash:        h[:],
+		Fingerprint: fingerprint,
+		Data:        bytes.Repeat([]byte{'x'}, size),
+		ExpiresAt:   time.Now().Add(ttl),
+	}
+	if err := storage.StoreCachedResponse(cr); err != nil {
+		t.Fatalf("StoreCachedResponse(%v) failed: %v", key, err)
+	}
+	return h[:]
+}
+
+func TestCachedResponses(t *testing.T) {
+	defer setup(t)()
+
+	h := hash.Raw([]byte("unknown"))
+	if _, err := storage.GetCachedResponse(h[:]); err != storage.ErrNotFound {
+		t.Errorf("Expected GetCachedResponse with unknown hash to return ErrNotFound, but instead got: %v", err)
+	}
+
+	// Stored responses can be retrieved until they expire.
+	valid := storeCachedResponse(t, "valid", 10, time.Hour)
+	if cr, err := storage.GetCachedResponse(valid); err != nil {
+		t.Errorf("GetCachedResponse failed: %v", err)
+	} else if len(cr.Data) != 10 {
+		t.Errorf("Expected cached response of size 10, got %v", len(cr.Data))
+	}
+	expired := storeCachedResponse(t, "expired", 10, -time.Hour)
+	if _, err := storage.GetCachedResponse(expired); err != storage.ErrNotFound {
+		t.Errorf("Expected GetCachedResponse with expired hash to return ErrNotFound, but instead got: %v", err)
+	}
+
+	// Storing again replaces the response.
+	storeCachedResponse(t, "valid", 20, time.Hour)
+	if cr, err := storage.GetCachedResponse(valid); err != nil {
+		t.Errorf("GetCachedResponse failed: %v", err)
+	} else if len(cr.Data) != 20 {
+		t.Errorf("Expected cached response of size 20, got %v", len(cr.Data))
+	}
+}
+
+func TestPruneCachedResponses(t *testing.T) {
+	defer setup(t)()
+
+	storeCachedResponse(t, "expired", 100, -time.Hour)
+	oldest := storeCachedResponse(t, "oldest", 100, time.Hour)
+	middle := storeCachedResponse(t, "middle", 100, 2*time.Hour)
+	newest := storeCachedResponse(t, "newest", 100, 3*time.Hour)
+
+	// The expired response and the response closest to expiry are deleted.
+	deleted, err := storage.PruneCachedResponses(250)
+	if err != nil {
+		t.Fatalf("PruneCachedResponses failed: %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("Expected 2 responses to be deleted, got %v", deleted)
+	}
+	if _, err := storage.GetCachedResponse(oldest); err != storage.ErrNotFound {
+		t.Errorf("Expected oldest response to be pruned, but GetCachedResponse returned: %v", err)
+	}
+	for _, h := range [][]byte{middle, newest} {
+		if _, err := storage.GetCachedResponse(h); err != nil {
+			t.Errorf("Expected response to survive pruning, but GetCachedResponse failed: %v", err)
+		}
+	}
+}
+
+func TestDeleteCachedResponsesExcept(t *testing.T) {
+	defer setup(t)()
+
+	old1 := storeCachedResponseWithFingerprint(t, "old1", "old", 10, time.Hour)
+	old2 := storeCachedResponseWithFingerprint(t, "old2", "older", 10, time.Hour)
+	current := storeCachedResponseWithFingerprint(t, "current", "current", 10, time.Hour)
+
+	deleted, err := storage.DeleteCachedResponsesExcept("current")
+	if err != nil {
+		t.Fatalf("DeleteCachedResponsesExcept failed: %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("Expected 2 responses to be deleted, got %v", deleted)
+	}
+	for _, h := range [][]byte{old1, old2} {
+		if _, err := storage.GetCachedResponse(h); err != storage.ErrNotFound {
+			t.Errorf("Expected response with old fingerprint to be deleted, but GetCachedResponse returned: %v", err)
+		}
+	}
+	if _, err := storage.GetCachedResponse(current); err != nil {
+		t.Errorf("Expected response with current fingerprint to be kept, but GetCachedResponse failed: %v", err)
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"time"
+
+	"v.io/x/playground/lib/metrics"
+)
+
+var queryDuration = metrics.NewHistogram("playground_storage_query_duration_seconds", "Latency of storage operations, including transaction retries, by operation.", metrics.DurationBuckets, "op")
+
+// observeQuery records the latency of a storage operation that started at
+// start. Intended to be deferred.
+func observeQuery(op string, start time.Time) {
+	queryDuration.Observe(time.Since(start).Seconds(), op)
+}
@@ -43,7 +43,7 @@ func TestMigrationsUpAndDown(t *testing.T) {
 	}
 
 	// Remove any existing tables.
-	tableNames := []string{"bundle_link", "bundle_data", "migrations"}
+	tableNames := []string{"response_cache", "bundle_link", "bundle_data", "migrations"}
 	for _, tableName := range tableNames {
 		db.Exec("DROP TABLE " + tableName)
 	}
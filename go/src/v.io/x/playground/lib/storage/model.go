@@ -153,6 +153,7 @@ func getDefaultBundleList(q sqlx.Queryer) ([]*BundleLink, error) {
 // and BundleData. However, it is highly unlikely, costly to mitigate (using
 // a serializable transaction), and unimportant (error 500 instead of 404).
 func GetBundleByLinkIdOrSlug(idOrSlug string) (*BundleLink, *BundleData, error) {
+	defer observeQuery("get_bundle", time.Now())
 	bLink, err := getBundleLinkById(dbRead, idOrSlug)
 	if err == ErrNotFound {
 		bLink, err = getDefaultBundleLinkBySlug(dbRead, idOrSlug)
@@ -170,6 +171,7 @@ func GetBundleByLinkIdOrSlug(idOrSlug string) (*BundleLink, *BundleData, error)
 // GetDefaultBundleList retrieves a list of BundleLink objects describing
 // default bundles. All default bundles have slugs.
 func GetDefaultBundleList() ([]*BundleLink, error) {
+	defer observeQuery("list_default_bundles", time.Now())
 	return getDefaultBundleList(dbRead)
 }
 
@@ -255,6 +257,7 @@ func unmarkDefaultBundles(ext sqlx.Ext) error {
 // times. Both the link and the data are returned, or an error if one occured.
 // Slugs are currently not allowed for user-stored bundles.
 func StoreBundleLinkAndData(json string) (bLink *BundleLink, bData *BundleData, retErr error) {
+	defer observeQuery("store_bundle", time.Now())
 	retErr = runInTransaction(dbSeq, 3, func(tx *sqlx.Tx) (err error) {
 		bLink, bData, err = storeBundle(tx, &NewBundle{Json: string(json)}, false)
 		if err == errIDCollision {
@@ -270,6 +273,7 @@ func StoreBundleLinkAndData(json string) (bLink *BundleLink, bData *BundleData,
 // default bundles and inserts all bundles in newDefBundles as default bundles.
 // Each bundle in newDefBundles must have a unique non-empty slug.
 func ReplaceDefaultBundles(newDefBundles []*NewBundle) (retErr error) {
+	defer observeQuery("replace_default_bundles", time.Now())
 	retErr = runInTransaction(dbSeq, 5, func(tx *sqlx.Tx) error {
 		if err := unmarkDefaultBundles(tx); err != nil {
 			return err
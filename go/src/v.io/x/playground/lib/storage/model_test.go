@@ -45,7 +45,7 @@ func setup(t *testing.T) func() {
 	}
 
 	// Remove any existing tables.
-	tableNames := []string{"bundle_link", "bundle_data", "migrations"}
+	tableNames := []string{"response_cache", "bundle_link", "bundle_data", "migrations"}
 	for _, tableName := range tableNames {
 		db.Exec("DROP TABLE " + tableName)
 	}
@@ -0,0 +1,14 @@
+-- +migrate Up
+
+CREATE TABLE response_cache (
+	hash BINARY(32) NOT NULL PRIMARY KEY,
+	fingerprint VARCHAR(255) CHARACTER SET ascii NOT NULL,
+	data MEDIUMBLOB NOT NULL,
+	expires_at DATETIME NOT NULL,
+	INDEX fingerprint_index (fingerprint),
+	INDEX expires_at_index (expires_at)
+);
+
+-- +migrate Down
+
+DROP TABLE response_cache;